@@ -1,6 +1,7 @@
 package jooki
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"time"
@@ -74,12 +75,13 @@ func (a *Awaiter) Close() *StateUpdate {
 	if a.ch == nil {
 		return a.update
 	}
-	close(a.ch)
+	// unregister before closing so the client can't write to a closed
+	// channel
+	a.c.unregisterAwaiter(a.chid)
 	ch := a.ch
 	a.ch = nil
-	a.c.RemoveAwaiter(a.chid)
-	for len(a.ch) > 0 {
-		update := <-ch
+	close(ch)
+	for update := range ch {
 		a.update.After = update.After
 		a.update.Deltas = append(a.update.Deltas, update.Deltas...)
 	}
@@ -90,34 +92,74 @@ func (a *Awaiter) Closed() bool {
 	return a.ch == nil
 }
 
+func (a *Awaiter) ReadContext(ctx context.Context) (*StateUpdate, bool) {
+	if a.ch == nil {
+		return a.update, false
+	}
+	select {
+	case update, ok := <-a.ch:
+		if !ok {
+			return a.update, false
+		}
+		a.update.After = update.After
+		a.update.Deltas = append(a.update.Deltas, update.Deltas...)
+		return a.update, true
+	case <-ctx.Done():
+		return a.update, false
+	}
+}
+
 func (a *Awaiter) WaitFor(f func(state *JookiState) bool, timeout time.Duration) (*JookiState, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return a.WaitForContext(ctx, f)
+}
+
+func (a *Awaiter) WaitForContext(ctx context.Context, f func(state *JookiState) bool) (*JookiState, error) {
 	state := a.GetState()
 	if f(state) {
 		return state, nil
 	}
-	timer := time.NewTimer(timeout)
 	i := 0
 	for {
-		update, ok := a.Read(timer)
+		update, ok := a.ReadContext(ctx)
 		if !ok {
-			return update.After, errors.New("timeout")
+			if ctx.Err() == nil {
+				return update.After, errors.New("awaiter closed")
+			}
+			return update.After, ctx.Err()
 		}
-		ok = false
 		for i < len(update.Deltas) {
 			if f(update.Deltas[i]) {
-				ok = true
-				break
+				return update.After, nil
 			}
 			i += 1
 		}
-		if ok || f(update.After) {
-			state = update.After
-			break
+		if f(update.After) {
+			return update.After, nil
 		}
 	}
-	if !timer.Stop() {
-		<-timer.C
-	}
-	return state, nil
 }
 
+// WaitForStateContext is like WaitForContext, but only tests the
+// accumulated state and not the individual deltas.  Use it for
+// conditions like "x is absent" that a partial delta would satisfy
+// trivially.
+func (a *Awaiter) WaitForStateContext(ctx context.Context, f func(state *JookiState) bool) (*JookiState, error) {
+	state := a.GetState()
+	if f(state) {
+		return state, nil
+	}
+	for {
+		update, ok := a.ReadContext(ctx)
+		if !ok {
+			if ctx.Err() == nil {
+				return update.After, errors.New("awaiter closed")
+			}
+			return update.After, ctx.Err()
+		}
+		if f(update.After) {
+			return update.After, nil
+		}
+	}
+}
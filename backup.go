@@ -0,0 +1,557 @@
+package jooki
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BackupManifestName is the name of the manifest in a backup directory.
+const BackupManifestName = "manifest.json"
+
+// RestorePlaylistName is the title of the playlist that tracks that
+// weren't on any playlist are uploaded to during a restore.  It's
+// deleted again afterwards, leaving the tracks in the library.
+var RestorePlaylistName = "Restoring..."
+
+// TrackPath and TrackImagePath are where the device serves a track's
+// audio and artwork, given the track ID.  Downloads are checked against
+// the track ID, so a path the device doesn't serve fails the backup
+// rather than saving something else.
+var (
+	TrackPath = "/tracks/%s"
+	TrackImagePath = "/tracks/%s/image"
+)
+
+// BackupManifest describes a backup made by Backup.  Audio files are
+// kept under tracks/<track id>/ with their original file names, and
+// artwork under images/<track id>.
+type BackupManifest struct {
+	Created time.Time `json:"created"`
+	Device string `json:"device"`
+	// the playlists, tokens and track metadata
+	Library *Library `json:"library"`
+	// paths to each track's audio and artwork, relative to the backup
+	// directory, by track ID
+	Files map[string]string `json:"files"`
+	Images map[string]string `json:"images"`
+}
+
+// LoadBackup reads the manifest of a backup.
+func LoadBackup(dir string) (*BackupManifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, BackupManifestName))
+	if err != nil {
+		return nil, err
+	}
+	m := &BackupManifest{}
+	err = json.Unmarshal(data, m)
+	if err != nil {
+		return nil, err
+	}
+	if m.Library == nil {
+		return nil, errors.New("backup has no library")
+	}
+	if m.Files == nil {
+		m.Files = map[string]string{}
+	}
+	if m.Images == nil {
+		m.Images = map[string]string{}
+	}
+	return m, nil
+}
+
+// DownloadTrack copies a track's audio from the device to w.
+func (c *Client) DownloadTrack(trackId string, w io.Writer) error {
+	return c.DownloadTrackContext(context.Background(), trackId, w)
+}
+
+func (c *Client) DownloadTrackContext(ctx context.Context, trackId string, w io.Writer) error {
+	return c.download(ctx, fmt.Sprintf(TrackPath, url.PathEscape(trackId)), w)
+}
+
+// DownloadTrackImage copies a track's artwork from the device to w.
+func (c *Client) DownloadTrackImage(trackId string, w io.Writer) error {
+	return c.DownloadTrackImageContext(context.Background(), trackId, w)
+}
+
+func (c *Client) DownloadTrackImageContext(ctx context.Context, trackId string, w io.Writer) error {
+	return c.download(ctx, fmt.Sprintf(TrackImagePath, url.PathEscape(trackId)), w)
+}
+
+func (c *Client) download(ctx context.Context, path string, w io.Writer) error {
+	u := &url.URL{
+		Scheme: "http",
+		Host: c.Hostname(),
+		Path: path,
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("download %s: %s", path, res.Status)
+	}
+	n, err := io.Copy(w, res.Body)
+	if err != nil {
+		return err
+	}
+	if res.ContentLength >= 0 && n != res.ContentLength {
+		return fmt.Errorf("download %s: got %d of %d bytes", path, n, res.ContentLength)
+	}
+	return nil
+}
+
+type BackupResult struct {
+	Manifest *BackupManifest
+	// IDs of the tracks downloaded from the device
+	Downloaded []string
+	// IDs of the tracks copied from local files instead
+	Copied []string
+	// IDs of the tracks already in the backup directory from an earlier
+	// backup
+	Existing []string
+	// IDs of the tracks whose audio couldn't be backed up
+	Missing []string
+	// what went wrong with each track that failed, audio or artwork, by
+	// track ID
+	Errors map[string]error
+}
+
+// Backup saves everything needed to rebuild the device's library into
+// dir: a manifest of the playlists, tokens and track metadata, and each
+// track's audio and artwork.  The audio is downloaded from the device,
+// unless it's found in one of the sources (directories or M3U
+// playlists), which saves fetching it over the network.  Backing up into
+// the same directory again only fetches tracks that aren't there
+// already.  If any track fails, the manifest is still written, listing
+// only the files that were saved, and an error is returned along with
+// the result.
+func (c *Client) Backup(dir string, sources ...string) (*BackupResult, error) {
+	return c.BackupContext(context.Background(), dir, sources)
+}
+
+func (c *Client) BackupContext(ctx context.Context, dir string, sources []string) (*BackupResult, error) {
+	state := c.GetState()
+	if state == nil || state.Library == nil {
+		return nil, errors.New("jooki library not loaded")
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	lib := state.Library
+	m := &BackupManifest{
+		Created: time.Now().UTC(),
+		Device: c.Hostname(),
+		Library: lib,
+		Files: map[string]string{},
+		Images: map[string]string{},
+	}
+	res := &BackupResult{
+		Manifest: m,
+		Downloaded: []string{},
+		Copied: []string{},
+		Existing: []string{},
+		Missing: []string{},
+		Errors: map[string]error{},
+	}
+	ids := make([]string, 0, len(lib.Tracks))
+	for id := range lib.Tracks {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	// the sources are only searched if something needs fetching
+	var found map[string]string
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		tr := lib.Tracks[id]
+		fn := filepath.Join("tracks", id, backupFileName(id, tr))
+		path := filepath.Join(dir, fn)
+		if ft, err := NewFileTrack(path); err == nil && ft.ID() == id {
+			m.Files[id] = filepath.ToSlash(fn)
+			res.Existing = append(res.Existing, id)
+		} else {
+			if found == nil {
+				found, err = findTrackFiles(ctx, sources)
+				if err != nil {
+					return res, err
+				}
+			}
+			if src, ok := found[id]; ok {
+				err = backupFile(path, id, func(w io.Writer) error {
+					return copyFrom(src, w)
+				})
+				if err == nil {
+					res.Copied = append(res.Copied, id)
+				}
+			} else {
+				err = backupFile(path, id, func(w io.Writer) error {
+					return c.DownloadTrackContext(ctx, id, w)
+				})
+				if err == nil {
+					res.Downloaded = append(res.Downloaded, id)
+				}
+			}
+			if err != nil {
+				res.Missing = append(res.Missing, id)
+				res.Errors[id] = err
+				continue
+			}
+			m.Files[id] = filepath.ToSlash(fn)
+		}
+		if tr.HasImage {
+			imgFn := filepath.Join("images", id)
+			imgPath := filepath.Join(dir, imgFn)
+			if _, err := os.Stat(imgPath); err != nil {
+				err = backupFile(imgPath, "", func(w io.Writer) error {
+					return c.DownloadTrackImageContext(ctx, id, w)
+				})
+				if err != nil {
+					res.Errors[id] = err
+					continue
+				}
+			}
+			m.Images[id] = filepath.ToSlash(imgFn)
+		}
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return res, err
+	}
+	err = writeFileAtomic(filepath.Join(dir, BackupManifestName), func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		return res, err
+	}
+	if len(res.Errors) > 0 {
+		return res, fmt.Errorf("%d of %d tracks failed to back up", len(res.Errors), len(ids))
+	}
+	return res, nil
+}
+
+// findTrackFiles indexes the audio files in the sources by the ID the
+// device gives a track uploaded from them.
+func findTrackFiles(ctx context.Context, sources []string) (map[string]string, error) {
+	found := map[string]string{}
+	for _, source := range sources {
+		files, err := LocalPlaylist(source)
+		if err != nil {
+			return nil, err
+		}
+		for _, fn := range files {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			track, err := NewFileTrack(fn)
+			if err != nil {
+				continue
+			}
+			if _, ok := found[track.ID()]; !ok {
+				found[track.ID()] = fn
+			}
+		}
+	}
+	return found, nil
+}
+
+func copyFrom(src string, w io.Writer) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// backupFile writes a file into the backup, creating its directory if
+// need be.  If trackId is given, the contents are checked against it, as
+// track IDs are derived from the MD5 of the audio.
+func backupFile(path, trackId string, fetch func(io.Writer) error) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, func(w io.Writer) error {
+		h := md5.New()
+		err := fetch(io.MultiWriter(w, h))
+		if err != nil {
+			return err
+		}
+		sum := hex.EncodeToString(h.Sum(nil))
+		if trackId != "" && !strings.HasPrefix(sum, trackId) {
+			return fmt.Errorf("backed up track %s has md5 %s", trackId, sum)
+		}
+		return nil
+	})
+}
+
+// backupFileName picks a name for a track's audio file, preferring the
+// name it was uploaded with.
+func backupFileName(id string, tr *Track) string {
+	if tr.Location != nil {
+		name := filepath.Base(filepath.FromSlash(*tr.Location))
+		if name != "." && name != string(filepath.Separator) && !strings.HasPrefix(name, ".") {
+			return name
+		}
+	}
+	if tr.Format != nil && *tr.Format != "" {
+		return id + "." + *tr.Format
+	}
+	return id
+}
+
+// writeFileAtomic writes a file via a temporary file in the same
+// directory, so that a failed write leaves any existing file alone.
+func writeFileAtomic(fn string, write func(io.Writer) error) error {
+	f, err := ioutil.TempFile(filepath.Dir(fn), "." + filepath.Base(fn) + ".")
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	err = os.Rename(f.Name(), fn)
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+type RestoreResult struct {
+	Manifest *BackupManifest
+	// one for each playlist in the backup, sorted by name
+	Playlists []*SyncResult
+	// the upload of the tracks that weren't on any playlist, or nil if
+	// there weren't any missing from the device
+	Orphans *SyncResult
+	// IDs on the device of the playlists that had their tokens bound
+	// again
+	Tokens []string
+}
+
+// Restore rebuilds the library in a backup on the device, e.g. after a
+// factory reset.  Each playlist is made to hold the same tracks in the
+// same order, uploading any the device doesn't have, and playlists
+// assigned to a token are assigned to it again.  A playlist is restored
+// into the one on the device with the same ID or, failing that, the
+// same name.  Playlists that share a name are only matched if the
+// tracks are the same too, so that they aren't merged; otherwise a new
+// playlist is created.  Tracks that weren't on any playlist are
+// uploaded to a temporary playlist (see RestorePlaylistName), since the
+// device only accepts uploads to a playlist.
+func (c *Client) Restore(dir string) (*RestoreResult, error) {
+	return c.RestoreContext(context.Background(), dir, nil)
+}
+
+func (c *Client) RestoreContext(ctx context.Context, dir string, opts *UploadOptions) (*RestoreResult, error) {
+	m, err := LoadBackup(dir)
+	if err != nil {
+		return nil, err
+	}
+	if opts == nil {
+		opts = &UploadOptions{}
+	}
+	state := c.GetState()
+	if state == nil || state.Library == nil {
+		return nil, errors.New("jooki library not loaded")
+	}
+	targets := restoreTargets(m.Library, state.Library)
+	res := &RestoreResult{Manifest: m, Playlists: []*SyncResult{}, Tokens: []string{}}
+	playlists := m.Library.SortedPlaylists()
+	failed := 0
+	var lastErr error
+	for _, pl := range playlists {
+		sr, err := c.restorePlaylist(ctx, dir, m, pl, targets[*pl.ID], opts)
+		if sr != nil {
+			res.Playlists = append(res.Playlists, sr)
+		}
+		if err == nil && pl.Token != nil && *pl.Token != "" && sr.Playlist != nil {
+			if sr.Playlist.Token == nil || *sr.Playlist.Token != *pl.Token {
+				tokenCtx, cancel := context.WithTimeout(ctx, time.Second * 10)
+				_, err = c.UpdatePlaylistTokenContext(tokenCtx, sr.Plan.PlaylistID, *pl.Token)
+				cancel()
+			}
+			if err == nil {
+				res.Tokens = append(res.Tokens, sr.Plan.PlaylistID)
+			}
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return res, ctx.Err()
+			}
+			failed += 1
+			lastErr = fmt.Errorf("%s: %s", pl.Name, err)
+		}
+	}
+	sr, err := c.restoreOrphans(ctx, dir, m, opts)
+	res.Orphans = sr
+	if err != nil {
+		if ctx.Err() != nil {
+			return res, ctx.Err()
+		}
+		return res, fmt.Errorf("tracks on no playlist failed to restore: %s", err)
+	}
+	if failed > 0 {
+		return res, fmt.Errorf("%d of %d playlists failed to restore: %s", failed, len(playlists), lastErr)
+	}
+	return res, nil
+}
+
+// restoreTargets picks the playlist on the device to restore each backed
+// up playlist into: the one with the same ID, or the same name where the
+// name picks out a single playlist both in the backup and on the device,
+// or else the same name and the same tracks, as an earlier restore would
+// have left it.  Playlists without a target are left out.
+func restoreTargets(backup, lib *Library) map[string]string {
+	targets := map[string]string{}
+	claimed := map[string]bool{}
+	for id := range backup.Playlists {
+		if _, ok := lib.Playlists[id]; ok {
+			targets[id] = id
+			claimed[id] = true
+		}
+	}
+	named := func(playlists map[string]*Playlist, name string) []string {
+		ids := []string{}
+		for id, pl := range playlists {
+			if strings.EqualFold(pl.Name, name) {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	for _, pl := range backup.SortedPlaylists() {
+		id := *pl.ID
+		if _, ok := targets[id]; ok {
+			continue
+		}
+		matches := named(lib.Playlists, pl.Name)
+		if len(matches) == 1 && len(named(backup.Playlists, pl.Name)) == 1 {
+			if !claimed[matches[0]] {
+				targets[id] = matches[0]
+				claimed[matches[0]] = true
+			}
+			continue
+		}
+		// the tracks the device has are all that can have been restored
+		tracks := []string{}
+		for _, trackId := range pl.Tracks {
+			if _, ok := lib.Tracks[trackId]; ok {
+				tracks = append(tracks, trackId)
+			}
+		}
+		for _, match := range matches {
+			if !claimed[match] && sameTracks(lib.Playlists[match].Tracks, tracks) {
+				targets[id] = match
+				claimed[match] = true
+				break
+			}
+		}
+	}
+	return targets
+}
+
+// restorePlaylist restores a backed up playlist into the playlist on the
+// device with the given ID, or a new playlist if the ID is empty.
+func (c *Client) restorePlaylist(ctx context.Context, dir string, m *BackupManifest, pl *Playlist, playlistId string, opts *UploadOptions) (*SyncResult, error) {
+	if playlistId == "" {
+		createCtx, cancel := context.WithTimeout(ctx, time.Second * 10)
+		created, err := c.CreatePlaylistContext(createCtx, pl.Name)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		playlistId = *created.ID
+	}
+	return c.restoreTracks(ctx, dir, m, playlistId, pl.Tracks, opts)
+}
+
+// restoreOrphans uploads the backed up tracks that weren't on any
+// playlist and aren't on the device, by way of a temporary playlist.
+func (c *Client) restoreOrphans(ctx context.Context, dir string, m *BackupManifest, opts *UploadOptions) (*SyncResult, error) {
+	lib := c.GetState().Library
+	ids := []string{}
+	for _, tr := range m.Library.OrphanedTracks() {
+		if _, ok := lib.Tracks[*tr.ID]; !ok {
+			ids = append(ids, *tr.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	createCtx, cancel := context.WithTimeout(ctx, time.Second * 10)
+	pl, err := c.CreatePlaylistContext(createCtx, RestorePlaylistName)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	sr, err := c.restoreTracks(ctx, dir, m, *pl.ID, ids, opts)
+	// deleting the playlist leaves its tracks in the library
+	deleteCtx, cancel := context.WithTimeout(context.Background(), time.Second * 10)
+	derr := c.DeletePlaylistContext(deleteCtx, *pl.ID)
+	cancel()
+	if sr != nil {
+		sr.Playlist = nil
+	}
+	if err == nil {
+		err = derr
+	}
+	return sr, err
+}
+
+// restoreTracks makes a playlist on the device hold the given backed up
+// tracks, uploading any the device doesn't have.
+func (c *Client) restoreTracks(ctx context.Context, dir string, m *BackupManifest, playlistId string, trackIds []string, opts *UploadOptions) (*SyncResult, error) {
+	files := make([]string, len(trackIds))
+	for i, id := range trackIds {
+		fn, ok := m.Files[id]
+		if !ok {
+			fn = filepath.ToSlash(filepath.Join("tracks", id))
+		}
+		files[i] = filepath.Join(dir, filepath.FromSlash(fn))
+	}
+	plan, err := newSyncPlan(c.GetState().Library, playlistId, dir, files, func(i int, lib *Library) (*Track, string, error) {
+		id := trackIds[i]
+		if tr, ok := lib.Tracks[id]; ok {
+			tr = tr.Clone()
+			tr.ID = &id
+			return tr, id, nil
+		}
+		if _, err := os.Stat(files[i]); err != nil {
+			return nil, "", err
+		}
+		return nil, id, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.ApplySyncContext(ctx, plan, &BulkUploadOptions{UploadOptions: *opts})
+}
@@ -1,113 +1,21 @@
 package jooki
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
-	"strconv"
 	"sync"
 	"time"
 
 	"github.com/eclipse/paho.mqtt.golang"
 )
 
-type DiscoveryInfo struct {
-	Hostname string `json:"Hostname"`
-	ID string `json:"Id"`
-	IP string `json:"Ip"`
-	State string `json:"State"`
-}
-
-type DiscoveryPingInfo struct {
-	Version string `json:"version"`
-}
-
-type JookiIP struct {
-	Address string `json:"address"`
-	Ping string `json:"ping"`
-}
-
-type JookiInfo struct {
-	Label string `json:"label"`
-	IP *JookiIP `json:"ip"`
-	Live string `json:"live"`
-	Version string `json:"version"`
-}
-
-type ConnectPayload struct {
-	Jooki *JookiInfo `json:"jooki"`
-}
-
-func Discover() (*Client, error) {
-	c := &http.Client{}
-	u := &url.URL{
-		Scheme: "https",
-		Host: "my.jooki.rocks",
-		Path: "/api/discover/v2/local_jooki",
-		RawQuery: strconv.FormatFloat(rand.Float64(), 'f', -1, 64),
-	}
-	//log.Println("looking for jooki")
-	res, err := c.Get(u.String())
-	if err != nil {
-		return nil, err
-	}
-	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("HTTP %d error in jooki device discovery", res.StatusCode)
-	}
-	body, err := ioutil.ReadAll(res.Body)
-	res.Body.Close()
-	if err != nil {
-		return nil, err
-	}
-	devices := []*DiscoveryInfo{}
-	err = json.Unmarshal(body, &devices)
-	if err != nil {
-		return nil, err
-	}
-	if len(devices) == 0 {
-		return nil, errors.New("no jooki devices found")
-	}
-	for _, device := range devices {
-		u = &url.URL{
-			Scheme: "http",
-			Host: device.IP,
-			Path: "/ping",
-			RawQuery: strconv.FormatFloat(rand.Float64(), 'f', -1, 64),
-		}
-		//log.Println("ping jooki", device.IP)
-		res, err = c.Get(u.String())
-		if err != nil {
-			//log.Println("can't ping jooki", device.IP, err)
-			continue
-		}
-		if res.StatusCode != http.StatusOK {
-			//log.Println("bad ping jooki", device.IP, res.StatusCode)
-			continue
-		}
-		body, err = ioutil.ReadAll(res.Body)
-		res.Body.Close()
-		if err != nil {
-			//log.Println("bad jooki ping body", device.IP, err)
-			continue
-		}
-		dpi := DiscoveryPingInfo{}
-		err = json.Unmarshal(body, &dpi)
-		if err != nil {
-			log.Println("bad jooki unmarshal", device.IP, err)
-			log.Println("bad jooki json:", string(body))
-			continue
-		}
-		//log.Println("good jooki", device.IP)
-		return NewClient(device, &dpi)
-	}
-	return nil, errors.New("no jooki devices online")
-}
-
 type StateUpdate struct {
 	Before *JookiState
 	After *JookiState
@@ -121,19 +29,27 @@ type Client struct {
 	dpi *DiscoveryPingInfo
 	lastError error
 	lastState *JookiState
+	// when the device last reported the playback position
+	playbackUpdated time.Time
+	reducer *StateReducer
 	stateLocker *sync.RWMutex
 	awaitLocker *sync.RWMutex
 	awaiters map[int]*Awaiter
+	connLocker *sync.RWMutex
+	reconnectLocker *sync.Mutex
+	status ConnectionStatus
+	closed bool
+	reconnecting bool
+	done chan bool
+	statusHandlers map[int]func(ConnectionStatus, error)
+	subLocker *sync.RWMutex
+	subscribers map[int]*Subscription
+	clock Clock
+	sleepLocker *sync.Mutex
+	sleepTimer *SleepTimer
 }
 
 func NewClient(device *DiscoveryInfo, dpi *DiscoveryPingInfo) (*Client, error) {
-	u := &url.URL{
-		Scheme: "ws",
-		Host: device.IP + ":8000",
-		Path: "/mqtt",
-	}
-	t := time.Now()
-	ms := t.Unix() * 1000 + int64(t.Nanosecond() / 1e6)
 	client := &Client{
 		conn: nil,
 		hc: &http.Client{
@@ -143,10 +59,47 @@ func NewClient(device *DiscoveryInfo, dpi *DiscoveryPingInfo) (*Client, error) {
 		dpi: dpi,
 		lastError: nil,
 		lastState: &JookiState{},
+		reducer: NewStateReducer(),
 		stateLocker: &sync.RWMutex{},
 		awaitLocker: &sync.RWMutex{},
 		awaiters: map[int]*Awaiter{},
+		connLocker: &sync.RWMutex{},
+		reconnectLocker: &sync.Mutex{},
+		status: StatusConnecting,
+		closed: false,
+		reconnecting: false,
+		done: make(chan bool),
+		statusHandlers: map[int]func(ConnectionStatus, error){},
+		subLocker: &sync.RWMutex{},
+		subscribers: map[int]*Subscription{},
+		clock: SystemClock,
+		sleepLocker: &sync.Mutex{},
+	}
+	client.conn = client.newConn(device)
+	err := client.startup()
+	if err != nil {
+		client.Disconnect()
+		return nil, err
 	}
+	client.setStatus(StatusConnected, nil)
+	return client, nil
+}
+
+func (c *Client) newConn(device *DiscoveryInfo) mqtt.Client {
+	host := device.IP
+	// real devices run the broker on port 8000, but an address with an
+	// explicit port (e.g. a simulated device) serves everything there
+	_, _, err := net.SplitHostPort(host)
+	if err != nil {
+		host += ":8000"
+	}
+	u := &url.URL{
+		Scheme: "ws",
+		Host: host,
+		Path: "/mqtt",
+	}
+	t := time.Now()
+	ms := t.Unix() * 1000 + int64(t.Nanosecond() / 1e6)
 	opts := &mqtt.ClientOptions{
 		Servers: []*url.URL{u},
 		ClientID: fmt.Sprintf("web%d", ms),
@@ -154,54 +107,103 @@ func NewClient(device *DiscoveryInfo, dpi *DiscoveryPingInfo) (*Client, error) {
 		ProtocolVersion: 4,
 		KeepAlive: 60,
 		PingTimeout: time.Minute * 2,
-		DefaultPublishHandler: func(conn mqtt.Client, m mqtt.Message) { client.onMessage(m) },
-		OnConnect: func(conn mqtt.Client) { client.onConnect() },
-		OnConnectionLost: func(conn mqtt.Client, err error) { client.onConnectionLost(err) },
+		ConnectTimeout: ConnectTimeout,
+		// state deltas have to be applied in the order they're sent
+		Order: true,
+		DefaultPublishHandler: func(conn mqtt.Client, m mqtt.Message) { c.onMessage(m) },
+		OnConnect: func(conn mqtt.Client) { c.onConnect() },
+		OnConnectionLost: func(conn mqtt.Client, err error) { c.onConnectionLost(err) },
 	}
 	opts.SetKeepAlive(time.Minute)
-	client.conn = mqtt.NewClient(opts)
-	err := client.startup()
-	if err != nil {
-		client.Disconnect()
-		return nil, err
-	}
-	return client, nil
+	return mqtt.NewClient(opts)
+}
+
+func (c *Client) mqttConn() mqtt.Client {
+	c.connLocker.RLock()
+	defer c.connLocker.RUnlock()
+	return c.conn
 }
 
 func (c *Client) IP() string {
+	c.connLocker.RLock()
+	defer c.connLocker.RUnlock()
 	return c.device.IP
 }
 
+func (c *Client) Hostname() string {
+	c.connLocker.RLock()
+	defer c.connLocker.RUnlock()
+	return c.device.Hostname
+}
+
+// Reconnect immediately attempts to reestablish a lost connection rather
+// than waiting for the automatic reconnection backoff to expire.  If the
+// device can't be reached at its last known address, it is rediscovered
+// by ID or hostname.  A client that was closed with Disconnect is
+// reopened.
 func (c *Client) Reconnect() (*Client, error) {
-	if !c.Closed() {
-		return c, nil
+	c.connLocker.Lock()
+	if c.closed {
+		c.closed = false
+		c.done = make(chan bool)
 	}
-	nc, err := NewClient(c.device, c.dpi)
+	c.connLocker.Unlock()
+	err := c.reconnect()
 	if err == nil {
-		*c = *nc
 		return c, nil
 	}
-	nc, err = Discover()
-	if err == nil {
-		*c = *nc
-		return c, nil
+	err = c.rediscover()
+	if err != nil {
+		return nil, err
+	}
+	err = c.reconnect()
+	if err != nil {
+		return nil, err
 	}
-	return nil, err
+	return c, nil
 }
 
 func (c *Client) Disconnect() {
-	if c.conn != nil {
-		c.conn.Disconnect(1)
-		c.conn = nil
+	c.connLocker.Lock()
+	conn := c.conn
+	wasClosed := c.closed
+	if !c.closed {
+		c.closed = true
+		close(c.done)
+	}
+	c.connLocker.Unlock()
+	if conn != nil && conn.IsConnected() {
+		conn.Disconnect(1)
 	}
 	c.cleanupAwaiters()
+	c.cleanupSubscribers()
+	if !wasClosed {
+		c.setStatus(StatusClosed, nil)
+	}
 }
 
+// Closed reports whether the client has been shut down with Disconnect.
+// A client whose connection has dropped and is reconnecting is not
+// closed; see Connected and Status.
 func (c *Client) Closed() bool {
-	return c.conn == nil
+	c.connLocker.RLock()
+	defer c.connLocker.RUnlock()
+	return c.closed
 }
 
 func (c *Client) startup() error {
+	err := c.connect(c.mqttConn())
+	if err != nil {
+		return err
+	}
+	return c.resume()
+}
+
+// resume subscribes to the device's output topics and requests a full
+// state dump.  Sessions are not persisted by the broker, so this must be
+// repeated on every new connection.
+func (c *Client) resume() error {
+	c.connLocker.RLock()
 	payload := &ConnectPayload{
 		Jooki: &JookiInfo{
 			Label: c.device.Hostname + " *",
@@ -213,13 +215,8 @@ func (c *Client) startup() error {
 			Version: c.dpi.Version,
 		},
 	}
-	tok := c.conn.Connect()
-	tok.Wait()
-	err := tok.Error()
-	if err != nil {
-		return err
-	}
-	err = c.subscribe("/j/all/quit", func(conn mqtt.Client, m mqtt.Message) { c.onQuitMessage(m) })
+	c.connLocker.RUnlock()
+	err := c.subscribe("/j/all/quit", func(conn mqtt.Client, m mqtt.Message) { c.onQuitMessage(m) })
 	if err != nil {
 		return err
 	}
@@ -235,15 +232,21 @@ func (c *Client) startup() error {
 	if err != nil {
 		return err
 	}
-	err = c.publish("/j/debug/input/ping", nil)
+	ctx := context.Background()
+	err = c.publish(ctx, "/j/debug/input/ping", nil)
 	if err != nil {
 		return err
 	}
-	err = c.publish("/j/web/input/CONNECT", payload)
+	err = c.publish(ctx, "/j/web/input/CONNECT", payload)
 	if err != nil {
 		return err
 	}
-	err = c.publish("/j/web/input/GET_STATE", "{}")
+	// the reply is a full dump, without nulls for anything deleted while
+	// we weren't listening
+	c.stateLocker.Lock()
+	c.reducer.Reset()
+	c.stateLocker.Unlock()
+	err = c.publish(ctx, "/j/web/input/GET_STATE", "{}")
 	if err != nil {
 		return err
 	}
@@ -251,7 +254,7 @@ func (c *Client) startup() error {
 }
 
 func (c *Client) subscribe(topic string, handler mqtt.MessageHandler) error {
-	tok := c.conn.Subscribe(topic, 0, handler)
+	tok := c.mqttConn().Subscribe(topic, 0, handler)
 	ok := tok.WaitTimeout(time.Second)
 	if !ok {
 		return errors.New("timeout waiting for subscription ack")
@@ -259,7 +262,11 @@ func (c *Client) subscribe(topic string, handler mqtt.MessageHandler) error {
 	return tok.Error()
 }
 
-func (c *Client) publish(topic string, msg interface{}) error {
+// PublishTimeout is how long publish waits for the broker to accept a
+// message when the context has no deadline of its own.
+var PublishTimeout = time.Second
+
+func (c *Client) publish(ctx context.Context, topic string, msg interface{}) error {
 	var data []byte
 	if msg != nil {
 		switch x := msg.(type) {
@@ -275,12 +282,18 @@ func (c *Client) publish(topic string, msg interface{}) error {
 			}
 		}
 	}
-	tok := c.conn.Publish(topic, 0, false, data)
-	ok := tok.WaitTimeout(time.Second)
-	if !ok {
-		return errors.New("timeout waiting for publish ack")
+	tok := c.mqttConn().Publish(topic, 0, false, data)
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, PublishTimeout)
+		defer cancel()
+	}
+	select {
+	case <-tok.Done():
+		return tok.Error()
+	case <-ctx.Done():
+		return fmt.Errorf("timeout waiting for publish ack: %s", ctx.Err())
 	}
-	return tok.Error()
 }
 
 func (c *Client) AddAwaiter() (*Awaiter, error) {
@@ -305,17 +318,20 @@ func (c *Client) AddAwaiter() (*Awaiter, error) {
 }
 
 func (c *Client) RemoveAwaiter(id int) {
-	c.awaitLocker.Lock()
+	c.awaitLocker.RLock()
 	a, ok := c.awaiters[id]
-	if ok {
-		delete(c.awaiters, id)
-	}
-	c.awaitLocker.Unlock()
+	c.awaitLocker.RUnlock()
 	if ok && a != nil && !a.Closed() {
 		a.Close()
 	}
 }
 
+func (c *Client) unregisterAwaiter(id int) {
+	c.awaitLocker.Lock()
+	delete(c.awaiters, id)
+	c.awaitLocker.Unlock()
+}
+
 func (c *Client) cleanupAwaiters() {
 	c.awaitLocker.Lock()
 	toClose := []*Awaiter{}
@@ -329,21 +345,26 @@ func (c *Client) cleanupAwaiters() {
 }
 
 func (c *Client) Await(timeout time.Duration) (*StateUpdate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return c.AwaitContext(ctx)
+}
+
+func (c *Client) AwaitContext(ctx context.Context) (*StateUpdate, error) {
 	a, err := c.AddAwaiter()
 	if err != nil {
 		return nil, err
 	}
-	t := time.NewTimer(timeout)
-	a.Read(t)
+	a.ReadContext(ctx)
 	return a.Close(), nil
 }
 
-func (c *Client) publishWithAwaiter(topic string, msg interface{}) (*Awaiter, error) {
+func (c *Client) publishWithAwaiter(ctx context.Context, topic string, msg interface{}) (*Awaiter, error) {
 	a, err := c.AddAwaiter()
 	if err != nil {
 		return nil, err
 	}
-	err = c.publish(topic, msg)
+	err = c.publish(ctx, topic, msg)
 	if err != nil {
 		a.Close()
 		return nil, err
@@ -351,13 +372,22 @@ func (c *Client) publishWithAwaiter(topic string, msg interface{}) (*Awaiter, er
 	return a, nil
 }
 
-func (c *Client) publishAndWaitFor(topic string, msg interface{}, f func(*JookiState) bool, timeout time.Duration) (*JookiState, error) {
-	a, err := c.publishWithAwaiter(topic, msg)
+func (c *Client) publishAndWaitFor(ctx context.Context, topic string, msg interface{}, f func(*JookiState) bool) (*JookiState, error) {
+	a, err := c.publishWithAwaiter(ctx, topic, msg)
 	if err != nil {
 		return nil, err
 	}
 	defer a.Close()
-	return a.WaitFor(f, timeout)
+	return a.WaitForContext(ctx, f)
+}
+
+func (c *Client) publishAndWaitForState(ctx context.Context, topic string, msg interface{}, f func(*JookiState) bool) (*JookiState, error) {
+	a, err := c.publishWithAwaiter(ctx, topic, msg)
+	if err != nil {
+		return nil, err
+	}
+	defer a.Close()
+	return a.WaitForStateContext(ctx, f)
 }
 
 func (c *Client) onConnect() {
@@ -366,8 +396,14 @@ func (c *Client) onConnect() {
 
 func (c *Client) onConnectionLost(err error) {
 	log.Println("jooki connection lost:", err)
-	c.conn = nil
-	c.cleanupAwaiters()
+	c.connLocker.RLock()
+	closed := c.closed
+	c.connLocker.RUnlock()
+	if closed {
+		return
+	}
+	c.setStatus(StatusReconnecting, err)
+	go c.reconnectLoop()
 }
 
 func (c *Client) onMessage(m mqtt.Message) {
@@ -382,31 +418,42 @@ func (c *Client) onMessage(m mqtt.Message) {
 
 func (c *Client) onQuitMessage(m mqtt.Message) {
 	log.Println("quit?", string(m.Payload()))
-	c.conn = nil
 }
 
 func (c *Client) onStateMessage(m mqtt.Message) {
-	c.awaitLocker.RLock()
-	defer c.awaitLocker.RUnlock()
+	delta := &JookiState{}
+	json.Unmarshal(m.Payload(), delta)
+	moved := hasPosition(m.Payload())
+	now := c.Clock().Now()
 	c.stateLocker.Lock()
-	before := c.lastState.Clone()
-	err := json.Unmarshal(m.Payload(), c.lastState)
+	// the reducer builds a new state for every message, so the old one
+	// can be handed out as is
+	before := c.lastState
+	state, err := c.reducer.Apply(m.Payload())
 	if err != nil {
 		log.Println("error parsing jooki state:", err)
 		//log.Println("bad json:", string(m.Payload()))
 	}
-	after := c.lastState.Clone()
+	c.lastState = state
+	if moved {
+		c.playbackUpdated = now
+	}
+	after := state.Clone()
 	c.stateLocker.Unlock()
-	delta := &JookiState{}
-	json.Unmarshal(m.Payload(), delta)
 	update := &StateUpdate{
 		Before: before,
 		After: after,
 		Deltas: []*JookiState{delta},
 	}
+	c.awaitLocker.RLock()
 	for _, a := range c.awaiters {
-		a.Write(update)
+		err = a.Write(update)
+		if err != nil {
+			log.Println("dropping jooki state update:", err)
+		}
 	}
+	c.awaitLocker.RUnlock()
+	c.dispatchEvents(stateEvents(update, touchesLibrary(m.Payload())))
 }
 
 func (c *Client) onErrorMessage(m mqtt.Message) {
@@ -0,0 +1,1033 @@
+package jooki_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/rclancey/jooki"
+	"github.com/rclancey/jooki/jookitest"
+)
+
+type ClientSuite struct {
+	dev *jookitest.Device
+	client *jooki.Client
+}
+
+var _ = Suite(&ClientSuite{})
+
+func (s *ClientSuite) SetUpTest(c *C) {
+	s.dev = jookitest.NewDevice()
+	client, err := s.dev.Connect()
+	c.Assert(err, IsNil)
+	s.client = client
+	_, err = s.client.Await(time.Second)
+	c.Assert(err, IsNil)
+}
+
+func (s *ClientSuite) TearDownTest(c *C) {
+	s.client.Disconnect()
+	s.dev.Close()
+}
+
+func (s *ClientSuite) waitFor(c *C, f func(state *jooki.JookiState) bool) *jooki.JookiState {
+	a, err := s.client.AddAwaiter()
+	c.Assert(err, IsNil)
+	defer a.Close()
+	state, err := a.WaitFor(f, time.Second * 2)
+	c.Assert(err, IsNil)
+	return state
+}
+
+type memTrack struct {
+	name string
+	data []byte
+}
+
+func (t *memTrack) ContentType() string {
+	return "audio/mpeg"
+}
+
+func (t *memTrack) FileName() string {
+	return t.name
+}
+
+func (t *memTrack) MD5() string {
+	sum := md5.Sum(t.data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (t *memTrack) Reader() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(t.data)), nil
+}
+
+// timedTrack is a memTrack that knows how long it is.
+type timedTrack struct {
+	memTrack
+	length time.Duration
+}
+
+func (t *timedTrack) Duration() time.Duration {
+	return t.length
+}
+
+func (s *ClientSuite) TestInitialState(c *C) {
+	state := s.client.GetState()
+	c.Assert(state.Device, NotNil)
+	c.Check(state.Device.ID, Equals, "fake0001")
+	c.Check(state.Audio.Config.Volume, Equals, uint8(50))
+}
+
+func (s *ClientSuite) TestPlaybackControls(c *C) {
+	t1 := s.dev.AddTrack("one.mp3", []byte("one"))
+	t2 := s.dev.AddTrack("two.mp3", []byte("two"))
+	pl := s.dev.AddPlaylist("Songs", t1, t2)
+	audio, err := s.client.PlayPlaylist(pl, 0)
+	c.Assert(err, IsNil)
+	c.Check(*audio.NowPlaying.TrackID, Equals, t1)
+	audio, err = s.client.SkipNext()
+	c.Assert(err, IsNil)
+	c.Check(*audio.NowPlaying.TrackID, Equals, t2)
+	audio, err = s.client.Pause()
+	c.Assert(err, IsNil)
+	c.Check(audio.Playback.State, Equals, jooki.PlaybackStatePaused)
+	audio, err = s.client.SetVolume(20)
+	c.Assert(err, IsNil)
+	c.Check(audio.Config.Volume, Equals, uint8(20))
+	audio, err = s.client.SetShuffleMode(true)
+	c.Assert(err, IsNil)
+	c.Check(audio.Config.ShuffleMode, Equals, true)
+	audio, err = s.client.Seek(30000)
+	c.Assert(err, IsNil)
+	c.Check(audio.Playback.Position, Equals, 30000)
+	c.Check(s.dev.State().Audio.Config.Volume, Equals, uint8(20))
+}
+
+func (s *ClientSuite) TestPlaylists(c *C) {
+	pl, err := s.client.CreatePlaylist("Bedtime")
+	c.Assert(err, IsNil)
+	c.Assert(pl.ID, NotNil)
+	id := *pl.ID
+	pl, err = s.client.RenamePlaylist(id, "Naptime")
+	c.Assert(err, IsNil)
+	c.Check(pl.Name, Equals, "Naptime")
+	c.Check(s.dev.State().Library.Playlists[id].Name, Equals, "Naptime")
+	err = s.client.DeletePlaylist(id)
+	c.Assert(err, IsNil)
+}
+
+func (s *ClientSuite) TestUpload(c *C) {
+	pl := s.dev.AddPlaylist("Uploads")
+	track := &memTrack{name: "/music/lullaby.mp3", data: []byte("la la la")}
+	ch := make(chan jooki.ProgressUpdate, 100)
+	done := make(chan bool)
+	var last jooki.ProgressUpdate
+	go func() {
+		for update := range ch {
+			last = update
+		}
+		close(done)
+	}()
+	tr, err := s.client.UploadToPlaylist(pl, track, ch)
+	c.Assert(err, IsNil)
+	<-done
+	c.Check(*tr.ID, Equals, track.MD5()[:16])
+	c.Check(*tr.Location, Equals, "lullaby.mp3")
+	c.Check(last.Track, NotNil)
+	c.Check(last.BytesSent, Equals, int64(len(track.data)))
+	c.Check(last.BytesTotal, Equals, int64(len(track.data)))
+	c.Check(s.dev.State().Library.Playlists[pl].Tracks, DeepEquals, []string{*tr.ID})
+}
+
+func (s *ClientSuite) TestBulkUpload(c *C) {
+	existing := s.dev.AddTrack("old.mp3", []byte("old"))
+	pl := s.dev.AddPlaylist("Bulk")
+	s.waitFor(c, func(state *jooki.JookiState) bool {
+		return state.Library != nil && state.Library.Playlists[pl] != nil
+	})
+	dir := c.MkDir()
+	files := map[string]string{"1.mp3": "one", "2.mp3": "two", "3.mp3": "old", "4.mp3": "four"}
+	for fn, data := range files {
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, fn), []byte(data), 0644), IsNil)
+	}
+	ch := make(chan jooki.BulkProgress, 100)
+	done := make(chan bool)
+	var last jooki.BulkProgress
+	go func() {
+		for prog := range ch {
+			last = prog
+		}
+		close(done)
+	}()
+	results, err := s.client.BulkUpload(pl, dir, &jooki.BulkUploadOptions{Concurrency: 3, Progress: ch})
+	c.Assert(err, IsNil)
+	<-done
+	c.Assert(results, HasLen, 4)
+	for i, res := range results {
+		c.Check(res.Err, IsNil)
+		c.Check(res.Path, Equals, filepath.Join(dir, fmt.Sprintf("%d.mp3", i + 1)))
+		c.Check(res.Existing, Equals, i == 2)
+	}
+	c.Check(*results[2].Track.ID, Equals, existing)
+	c.Check(last.Completed, Equals, 4)
+	c.Check(last.Skipped, Equals, 1)
+	c.Check(last.Failed, Equals, 0)
+	c.Check(last.BytesTotal, Equals, int64(13))
+	c.Check(last.Fraction(), Equals, 1.0)
+	ids := make([]string, len(results))
+	for i, res := range results {
+		ids[i] = *res.Track.ID
+	}
+	c.Check(s.dev.State().Library.Playlists[pl].Tracks, DeepEquals, ids)
+	n := 0
+	for _, cmd := range s.dev.Commands() {
+		if cmd == "PLAYLIST_ADD_UPLOAD" {
+			n += 1
+		}
+	}
+	c.Check(n, Equals, 3)
+}
+
+func (s *ClientSuite) TestUploadRetry(c *C) {
+	pl := s.dev.AddPlaylist("Retries")
+	s.waitFor(c, func(state *jooki.JookiState) bool {
+		return state.Library != nil && state.Library.Playlists[pl] != nil
+	})
+	track := &memTrack{name: "flaky.mp3", data: []byte("twinkle twinkle")}
+	s.dev.InjectUploadFaults(jookitest.UploadFail, jookitest.UploadPartial, jookitest.UploadCorrupt)
+	opts := &jooki.UploadOptions{Retries: 3, MinBackoff: time.Millisecond}
+	res := s.client.UploadTrack(pl, track, opts, nil)
+	c.Assert(res.Err, IsNil)
+	c.Check(res.Attempts, Equals, 4)
+	c.Check(res.Verified, Equals, true)
+	c.Check(*res.Track.ID, Equals, track.MD5()[:16])
+	c.Check(res.Orphaned, HasLen, 2)
+	lib := s.dev.State().Library
+	for _, id := range res.Orphaned {
+		c.Check(*lib.Tracks[id].Location, Equals, "flaky.mp3")
+		c.Check(id, Not(Equals), *res.Track.ID)
+	}
+	// the corrupt upload was added to the playlist, and taken off again
+	c.Check(lib.Playlists[pl].Tracks, DeepEquals, []string{*res.Track.ID})
+
+	// uploading it again finds it in the library
+	res = s.client.UploadTrack(pl, track, opts, nil)
+	c.Assert(res.Err, IsNil)
+	c.Check(res.Existing, Equals, true)
+	c.Check(res.Attempts, Equals, 0)
+
+	track = &memTrack{name: "broken.mp3", data: []byte("broken")}
+	s.dev.InjectUploadFaults(jookitest.UploadFail, jookitest.UploadFail)
+	res = s.client.UploadTrack(pl, track, &jooki.UploadOptions{Retries: 1, MinBackoff: time.Millisecond}, nil)
+	c.Check(res.Err, ErrorMatches, ".*HTTP 500")
+	c.Check(res.Attempts, Equals, 2)
+
+	fn := filepath.Join(c.MkDir(), "gone.mp3")
+	c.Assert(ioutil.WriteFile(fn, []byte("gone"), 0644), IsNil)
+	gone, err := jooki.NewFileTrack(fn)
+	c.Assert(err, IsNil)
+	c.Assert(os.Remove(fn), IsNil)
+	res = s.client.UploadTrack(pl, gone, opts, nil)
+	c.Check(os.IsNotExist(res.Err), Equals, true)
+	c.Check(res.Attempts, Equals, 1)
+}
+
+func (s *ClientSuite) TestUploadDuration(c *C) {
+	pl := s.dev.AddPlaylist("Durations")
+	s.waitFor(c, func(state *jooki.JookiState) bool {
+		return state.Library != nil && state.Library.Playlists[pl] != nil
+	})
+	opts := &jooki.UploadOptions{Retries: 3, MinBackoff: time.Millisecond}
+	track := &timedTrack{memTrack{name: "long.mp3", data: []byte("a long story")}, time.Minute}
+	s.dev.InjectUploadFaults(jookitest.UploadShort)
+	res := s.client.UploadTrack(pl, track, opts, nil)
+	verr, ok := res.Err.(*jooki.VerifyError)
+	c.Assert(ok, Equals, true, Commentf("%v", res.Err))
+	c.Check(verr.Field, Equals, "duration")
+	c.Check(verr.Expected, Equals, "60.000s")
+	c.Check(verr.Actual, Equals, "1.000s")
+	c.Check(res.Verified, Equals, false)
+	// the device has the right file, so it isn't sent again
+	c.Check(res.Attempts, Equals, 1)
+
+	// within the tolerance
+	track = &timedTrack{memTrack{name: "short.mp3", data: []byte("short")}, time.Millisecond * 1500}
+	s.dev.InjectUploadFaults(jookitest.UploadShort)
+	res = s.client.UploadTrack(pl, track, opts, nil)
+	c.Assert(res.Err, IsNil)
+	c.Check(res.Verified, Equals, true)
+}
+
+func (s *ClientSuite) TestSync(c *C) {
+	extra := s.dev.AddTrack("extra.mp3", []byte("extra"))
+	b := s.dev.AddTrack("b.mp3", []byte("bee"))
+	cc := s.dev.AddTrack("c.mp3", []byte("sea"))
+	pl := s.dev.AddPlaylist("Synced", extra, b)
+	s.waitFor(c, func(state *jooki.JookiState) bool {
+		return state.Library != nil && state.Library.Playlists[pl] != nil
+	})
+	dir := c.MkDir()
+	for fn, data := range map[string]string{"a.mp3": "ay", "b.mp3": "bee", "c.mp3": "sea"} {
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, fn), []byte(data), 0644), IsNil)
+	}
+	plan, err := s.client.PlanSync(pl, dir)
+	c.Assert(err, IsNil)
+	c.Check(plan.String(), Equals, strings.Join([]string{
+		"upload " + filepath.Join(dir, "a.mp3"),
+		"add " + filepath.Join(dir, "c.mp3") + " (" + cc + ")",
+		"remove extra (" + extra + ")",
+		"reorder",
+	}, "\n"))
+	res, err := s.client.ApplySync(plan, nil)
+	c.Assert(err, IsNil)
+	c.Assert(res.Uploads, HasLen, 1)
+	a := *res.Uploads[0].Track.ID
+	c.Check(res.Playlist.Tracks, DeepEquals, []string{a, b, cc})
+	c.Check(s.dev.State().Library.Playlists[pl].Tracks, DeepEquals, []string{a, b, cc})
+	plan, err = s.client.PlanSync(pl, dir)
+	c.Assert(err, IsNil)
+	c.Check(plan.InSync(), Equals, true)
+
+	m3u := filepath.Join(dir, "list.m3u")
+	c.Assert(ioutil.WriteFile(m3u, []byte("c.mp3\nb.mp3\n"), 0644), IsNil)
+	res, err = s.client.Sync(pl, m3u, nil)
+	c.Assert(err, IsNil)
+	c.Check(res.Plan.String(), Equals, "remove a (" + a + ")\nreorder")
+	c.Check(s.dev.State().Library.Playlists[pl].Tracks, DeepEquals, []string{cc, b})
+
+	c.Assert(ioutil.WriteFile(m3u, []byte("#EXTM3U\n"), 0644), IsNil)
+	res, err = s.client.Sync(pl, m3u, nil)
+	c.Assert(err, IsNil)
+	c.Check(s.dev.State().Library.Playlists[pl].Tracks, HasLen, 0)
+	c.Check(s.dev.State().Library.Tracks[a], NotNil)
+}
+
+func (s *ClientSuite) TestGC(c *C) {
+	kept := s.dev.AddTrack("kept.mp3", []byte("kept"))
+	orphan := s.dev.AddTrack("orphan.mp3", []byte("orphan"))
+	doomed := s.dev.AddTrack("doomed.mp3", []byte("doomed"))
+	pl := s.dev.AddPlaylist("Kept", kept)
+	gone := s.dev.AddPlaylist("Gone", doomed)
+	s.waitFor(c, func(state *jooki.JookiState) bool {
+		return state.Library != nil && state.Library.Playlists[gone] != nil
+	})
+	c.Assert(s.client.DeletePlaylist(gone), IsNil)
+	plan, err := s.client.PlanGC()
+	c.Assert(err, IsNil)
+	c.Check(plan.Size, Equals, int64(len("orphan") + len("doomed")))
+	c.Check(plan.String(), Equals, strings.Join([]string{
+		"delete doomed (" + doomed + ")",
+		"delete orphan (" + orphan + ")",
+		"2 tracks, 12 bytes",
+	}, "\n"))
+	// rescued between planning and deleting
+	_, err = s.client.AddTrackToPlaylist(pl, doomed)
+	c.Assert(err, IsNil)
+	res, err := s.client.ApplyGC(plan)
+	c.Assert(err, IsNil)
+	c.Check(res.Deleted, DeepEquals, []string{orphan})
+	c.Check(res.Kept, DeepEquals, []string{doomed})
+	c.Check(res.Freed, Equals, int64(len("orphan")))
+	lib := s.dev.State().Library
+	c.Check(lib.Tracks[orphan], IsNil)
+	c.Check(lib.Tracks[doomed], NotNil)
+	c.Check(lib.Tracks[kept], NotNil)
+	c.Check(s.client.GetState().Library.Tracks[orphan], IsNil)
+	c.Check(s.client.DeleteTrack(orphan), ErrorMatches, "no such track")
+	plan, err = s.client.PlanGC()
+	c.Assert(err, IsNil)
+	c.Check(plan.Tracks, HasLen, 0)
+
+	// a delete the device doesn't carry out isn't reported as done
+	orphan = s.dev.AddTrack("ignored.mp3", []byte("ignored"))
+	s.waitFor(c, func(state *jooki.JookiState) bool {
+		return state.Library.Tracks[orphan] != nil
+	})
+	s.dev.IgnoreCommand("TRACK_DELETE", 1)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond * 200)
+	defer cancel()
+	c.Check(s.client.DeleteTrackContext(ctx, orphan), NotNil)
+	c.Check(s.dev.State().Library.Tracks[orphan], NotNil)
+}
+
+func (s *ClientSuite) TestBackupRestore(c *C) {
+	music := c.MkDir()
+	add := func(name, data string) string {
+		c.Assert(ioutil.WriteFile(filepath.Join(music, name), []byte(data), 0644), IsNil)
+		return s.dev.AddTrack(name, []byte(data))
+	}
+	a := add("a.mp3", "ay")
+	b := add("b.mp3", "bee")
+	orphan := add("orphan.mp3", "orphan")
+	// uploaded from somewhere else
+	lost := s.dev.AddTrack("lost.mp3", []byte("lost"))
+	one := s.dev.AddPlaylist("One", b, a)
+	s.dev.AddPlaylist("Same", b, lost)
+	s.dev.AddPlaylist("Same", a)
+	s.waitFor(c, func(state *jooki.JookiState) bool {
+		return state.Library != nil && len(state.Library.Playlists) == 3
+	})
+	s.dev.SetTrackImage(lost, []byte("picture"))
+	s.waitFor(c, func(state *jooki.JookiState) bool {
+		return state.Library.Tracks[lost].HasImage
+	})
+	_, err := s.client.UpdatePlaylistToken(one, "STAR_1")
+	c.Assert(err, IsNil)
+
+	// a track the device won't hand over fails the backup
+	failed := c.MkDir()
+	trackPath := jooki.TrackPath
+	jooki.TrackPath = "/nowhere/%s"
+	res, err := s.client.Backup(failed, music)
+	jooki.TrackPath = trackPath
+	c.Check(err, ErrorMatches, "1 of 4 tracks failed to back up")
+	c.Check(res.Missing, DeepEquals, []string{lost})
+	c.Check(res.Errors[lost], ErrorMatches, ".*404 Not Found")
+	m, err := jooki.LoadBackup(failed)
+	c.Assert(err, IsNil)
+	c.Check(m.Files[lost], Equals, "")
+
+	dir := c.MkDir()
+	res, err = s.client.Backup(dir, music)
+	c.Assert(err, IsNil)
+	c.Check(res.Copied, HasLen, 3)
+	c.Check(res.Downloaded, DeepEquals, []string{lost})
+	c.Check(res.Existing, HasLen, 0)
+	c.Check(res.Missing, HasLen, 0)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "tracks", a, "a.mp3"))
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "ay")
+	data, err = ioutil.ReadFile(filepath.Join(dir, "tracks", lost, "lost.mp3"))
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "lost")
+	data, err = ioutil.ReadFile(filepath.Join(dir, "images", lost))
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "picture")
+	m, err = jooki.LoadBackup(dir)
+	c.Assert(err, IsNil)
+	c.Check(m.Files[orphan], Equals, "tracks/" + orphan + "/orphan.mp3")
+	c.Check(m.Images[lost], Equals, "images/" + lost)
+	c.Check(m.Images[a], Equals, "")
+	c.Check(*m.Library.Playlists[one].Token, Equals, "STAR_1")
+	// everything comes from the device without any sources
+	res, err = s.client.Backup(c.MkDir())
+	c.Assert(err, IsNil)
+	c.Check(res.Downloaded, HasLen, 4)
+	res, err = s.client.Backup(dir)
+	c.Assert(err, IsNil)
+	c.Check(res.Copied, HasLen, 0)
+	c.Check(res.Downloaded, HasLen, 0)
+	c.Check(res.Existing, HasLen, 4)
+
+	// a factory reset device
+	dev := jookitest.NewDevice()
+	defer dev.Close()
+	client, err := dev.Connect()
+	c.Assert(err, IsNil)
+	defer client.Disconnect()
+	_, err = client.Await(time.Second)
+	c.Assert(err, IsNil)
+	rres, err := client.Restore(dir)
+	c.Assert(err, IsNil)
+	c.Assert(rres.Playlists, HasLen, 3)
+	c.Check(rres.Tokens, HasLen, 1)
+	c.Assert(rres.Orphans, NotNil)
+	c.Check(rres.Orphans.Uploads, HasLen, 1)
+	lib := dev.State().Library
+	c.Check(lib.Tracks, HasLen, 4)
+	c.Check(lib.Tracks[orphan], NotNil)
+	c.Check(lib.PlaylistsWithTrack(orphan), HasLen, 0)
+	c.Check(lib.Playlists, HasLen, 3)
+	names := map[string][][]string{}
+	for _, pl := range lib.Playlists {
+		names[pl.Name] = append(names[pl.Name], pl.Tracks)
+		if pl.Name == "One" {
+			c.Check(*pl.Token, Equals, "STAR_1")
+		}
+	}
+	c.Check(names["One"], DeepEquals, [][]string{{b, a}})
+	// the playlists with the same name weren't merged
+	same := []string{}
+	for _, tracks := range names["Same"] {
+		same = append(same, strings.Join(tracks, ","))
+	}
+	sort.Strings(same)
+	expected := []string{a, b + "," + lost}
+	sort.Strings(expected)
+	c.Check(same, DeepEquals, expected)
+
+	// restoring again changes nothing
+	n := len(dev.Commands())
+	_, err = client.Restore(dir)
+	c.Assert(err, IsNil)
+	c.Check(dev.Commands()[n:], HasLen, 0)
+}
+
+func (s *ClientSuite) TestTokens(c *C) {
+	one := s.dev.AddPlaylist("One")
+	two := s.dev.AddPlaylist("Two")
+	s.waitFor(c, func(state *jooki.JookiState) bool {
+		return state.Library != nil && len(state.Library.Playlists) == 2
+	})
+	star := func(id string) string {
+		pl := s.dev.State().Library.Playlists[id]
+		if pl.Token == nil {
+			return ""
+		}
+		return *pl.Token
+	}
+	pl, err := s.client.AssignToken("STAR_1", one)
+	c.Assert(err, IsNil)
+	c.Check(*pl.Token, Equals, "STAR_1")
+	// moves the star from one to two
+	_, err = s.client.AssignToken("STAR_1", two)
+	c.Assert(err, IsNil)
+	c.Check(star(one), Equals, "")
+	c.Check(star(two), Equals, "STAR_1")
+	c.Check(*s.client.GetState().Library.StarPlaylist("STAR_1").ID, Equals, two)
+	_, err = s.client.AssignToken("STAR_2", one)
+	c.Assert(err, IsNil)
+	c.Assert(s.client.SwapTokens(one, two), IsNil)
+	c.Check(star(one), Equals, "STAR_1")
+	c.Check(star(two), Equals, "STAR_2")
+	c.Assert(s.client.UnassignToken("STAR_2"), IsNil)
+	c.Check(star(two), Equals, "")
+	c.Check(s.client.UnassignToken("STAR_2"), ErrorMatches, "star STAR_2 isn't assigned to a playlist")
+	c.Assert(s.client.SwapTokens(one, two), IsNil)
+	c.Check(star(one), Equals, "")
+	c.Check(star(two), Equals, "STAR_1")
+
+	// the star goes back where it was if the assignment is lost
+	s.dev.IgnoreCommand("PLAYLIST_UPDATE", 2)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond * 200)
+	defer cancel()
+	_, err = s.client.AssignTokenContext(ctx, "STAR_1", one)
+	c.Check(err, Equals, context.DeadlineExceeded)
+	c.Check(star(one), Equals, "")
+	c.Check(star(two), Equals, "STAR_1")
+}
+
+func (s *ClientSuite) TestTokenEvents(c *C) {
+	tr := s.dev.AddTrack("a.mp3", []byte("ay"))
+	pl := s.dev.AddPlaylist("One", tr)
+	s.waitFor(c, func(state *jooki.JookiState) bool {
+		return state.Library != nil && state.Library.Playlists[pl] != nil
+	})
+	_, err := s.client.AssignToken("STAR_1", pl)
+	c.Assert(err, IsNil)
+	sub, err := s.client.Subscribe(&jooki.SubscribeOptions{Types: []jooki.EventType{
+		jooki.EventTokenPlaced,
+		jooki.EventTokenRemoved,
+		jooki.EventUnknownTokenPlaced,
+	}})
+	c.Assert(err, IsNil)
+	defer sub.Close()
+	next := func() *jooki.TokenEvent {
+		select {
+		case ev := <-sub.Events():
+			return ev.(*jooki.TokenEvent)
+		case <-time.After(time.Second * 2):
+			c.Fatal("no token event")
+		}
+		return nil
+	}
+	s.dev.PlaceToken("tag1", "STAR_1")
+	e := next()
+	c.Check(e.Type(), Equals, jooki.EventTokenPlaced)
+	c.Check(*e.Playlist.ID, Equals, pl)
+	c.Check(e.Token.SeenTime().IsZero(), Equals, false)
+	state := s.waitFor(c, func(state *jooki.JookiState) bool {
+		return state.Audio.NowPlaying != nil
+	})
+	c.Check(*state.Audio.NowPlaying.PlaylistID, Equals, pl)
+	s.dev.RemoveToken()
+	c.Check(next().Type(), Equals, jooki.EventTokenRemoved)
+	s.dev.PlaceToken("tag2", "")
+	e = next()
+	c.Check(e.Type(), Equals, jooki.EventUnknownTokenPlaced)
+	c.Check(e.NFC.TokenID, Equals, "tag2")
+}
+
+func (s *ClientSuite) TestQuietTime(c *C) {
+	_, ok := s.client.TimeUntilShutdown()
+	c.Check(ok, Equals, false)
+	qt, err := s.client.SetQuietTime(true, jooki.TimeOfDay{Hour: 19, Minute: 30})
+	c.Assert(err, IsNil)
+	c.Check(qt.Active, Equals, true)
+	c.Check(*s.dev.State().Settings.QuietTime.Shutdown, Equals, jooki.TimeOfDay{Hour: 19, Minute: 30})
+	d, ok := s.client.TimeUntilShutdown()
+	c.Check(ok, Equals, true)
+	c.Check(d > 0 && d <= 24 * time.Hour, Equals, true)
+	_, err = s.client.SetQuietTime(false, jooki.TimeOfDay{Hour: 19, Minute: 30})
+	c.Assert(err, IsNil)
+	_, ok = s.client.TimeUntilShutdown()
+	c.Check(ok, Equals, false)
+	_, err = s.client.SetQuietTime(true, jooki.TimeOfDay{Hour: 19, Minute: 60})
+	c.Check(err, ErrorMatches, "bad shutdown time 19:60")
+}
+
+func (s *ClientSuite) TestScheduler(c *C) {
+	t1 := s.dev.AddTrack("one.mp3", []byte("one"))
+	t2 := s.dev.AddTrack("two.mp3", []byte("two"))
+	s.dev.AddPlaylist("Lullabies", t1, t2)
+	dir, err := ioutil.TempDir("", "jooki-schedule")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "schedule.json")
+	clock := jookitest.NewClock(time.Date(2020, 1, 1, 19, 0, 0, 0, time.Local))
+	runs := make(chan *jooki.JobRun, 10)
+	opts := &jooki.SchedulerOptions{
+		Clock: clock,
+		File: fn,
+		OnRun: func(run *jooki.JobRun) { runs <- run },
+	}
+	sched, err := jooki.NewScheduler(s.client, opts)
+	c.Assert(err, IsNil)
+	c.Check(sched.Jobs(), HasLen, 0)
+	vol := 20
+	job, err := sched.Add(&jooki.Job{
+		Name: "bedtime",
+		At: &jooki.TimeOfDay{Hour: 19, Minute: 30},
+		Steps: []*jooki.JobStep{
+			{Action: jooki.SchedulePlay, Playlist: "lullabies"},
+			{Action: jooki.ScheduleVolume, Volume: &vol},
+		},
+	})
+	c.Assert(err, IsNil)
+	c.Check(job.ID, Equals, "1")
+	_, err = sched.Add(&jooki.Job{Cron: "0 7 * * *"})
+	c.Check(err, ErrorMatches, "job has no steps")
+	next, when := sched.Next(clock.Now())
+	c.Assert(next, NotNil)
+	c.Check(next.ID, Equals, "1")
+	c.Check(when, Equals, time.Date(2020, 1, 1, 19, 30, 0, 0, time.Local))
+
+	sched.Start()
+	defer sched.Stop()
+	c.Assert(clock.WaitForTimers(1, time.Second), Equals, true)
+	clock.Advance(time.Minute * 29)
+	select {
+	case run := <-runs:
+		c.Fatalf("job %s ran early", run.Job.ID)
+	case <-time.After(time.Millisecond * 50):
+	}
+	// the job waits for the device to come back
+	s.dev.DropConnections()
+	clock.Advance(time.Minute)
+	select {
+	case run := <-runs:
+		c.Assert(run.Err, IsNil)
+		c.Check(run.Job.Name, Equals, "bedtime")
+		c.Check(run.Scheduled, Equals, time.Date(2020, 1, 1, 19, 30, 0, 0, time.Local))
+	case <-time.After(time.Second * 5):
+		c.Fatal("job didn't run")
+	}
+	state := s.dev.State()
+	c.Check(*state.Audio.NowPlaying.TrackID, Equals, t1)
+	c.Check(state.Audio.Config.Volume, Equals, uint8(20))
+	// and is due again tomorrow
+	c.Assert(clock.WaitForTimers(1, time.Second), Equals, true)
+	_, when = sched.Next(clock.Now())
+	c.Check(when, Equals, time.Date(2020, 1, 2, 19, 30, 0, 0, time.Local))
+
+	loaded, err := jooki.NewScheduler(s.client, &jooki.SchedulerOptions{File: fn})
+	c.Assert(err, IsNil)
+	c.Check(loaded.Jobs(), DeepEquals, sched.Jobs())
+	c.Assert(loaded.Remove("1"), IsNil)
+	c.Check(loaded.Remove("1"), ErrorMatches, "no job 1")
+	loaded, err = jooki.NewScheduler(s.client, &jooki.SchedulerOptions{File: fn})
+	c.Assert(err, IsNil)
+	c.Check(loaded.Jobs(), HasLen, 0)
+}
+
+func (s *ClientSuite) TestSchedulerLateAdd(c *C) {
+	clock := jookitest.NewClock(time.Date(2020, 1, 1, 8, 0, 0, 0, time.Local))
+	runs := make(chan *jooki.JobRun, 10)
+	sched, err := jooki.NewScheduler(s.client, &jooki.SchedulerOptions{
+		Clock: clock,
+		OnRun: func(run *jooki.JobRun) { runs <- run },
+	})
+	c.Assert(err, IsNil)
+	vol := 20
+	steps := []*jooki.JobStep{{Action: jooki.ScheduleVolume, Volume: &vol}}
+	_, err = sched.Add(&jooki.Job{Cron: "0 7 * * *", Steps: steps})
+	c.Assert(err, IsNil)
+	sched.Start()
+	defer sched.Stop()
+	c.Assert(clock.WaitForTimers(1, time.Second), Equals, true)
+	clock.Advance(time.Hour * 12)
+	// added at 20:00, so it isn't due until tomorrow
+	job, err := sched.Add(&jooki.Job{At: &jooki.TimeOfDay{Hour: 19, Minute: 30}, Steps: steps})
+	c.Assert(err, IsNil)
+	select {
+	case run := <-runs:
+		c.Fatalf("job %s ran for %s", run.Job.ID, run.Scheduled)
+	case <-time.After(time.Millisecond * 100):
+	}
+	next, when := sched.Next(clock.Now())
+	c.Check(next.ID, Equals, "1")
+	c.Check(when, Equals, time.Date(2020, 1, 2, 7, 0, 0, 0, time.Local))
+	c.Check(job.Next(clock.Now()), Equals, time.Date(2020, 1, 2, 19, 30, 0, 0, time.Local))
+}
+
+func (s *ClientSuite) countCommands(name string) int {
+	n := 0
+	for _, cmd := range s.dev.Commands() {
+		if cmd == name {
+			n += 1
+		}
+	}
+	return n
+}
+
+func (s *ClientSuite) TestFadeVolume(c *C) {
+	t1 := s.dev.AddTrack("one.mp3", []byte("one"))
+	pl := s.dev.AddPlaylist("Lullabies", t1)
+	_, err := s.client.PlayPlaylist(pl, 0)
+	c.Assert(err, IsNil)
+	_, err = s.client.SetVolume(60)
+	c.Assert(err, IsNil)
+	clock := jookitest.NewClock(time.Now())
+	s.client.SetClock(clock)
+	type result struct {
+		audio *jooki.Audio
+		err error
+	}
+	fade := func(ctx context.Context, target int, d time.Duration, opts *jooki.FadeOptions) chan result {
+		ch := make(chan result, 1)
+		go func() {
+			audio, err := s.client.FadeVolumeContext(ctx, target, d, opts)
+			ch <- result{audio, err}
+		}()
+		return ch
+	}
+
+	// a step a second, each covering six volume steps
+	sent := s.countCommands("SET_VOL")
+	ch := fade(context.Background(), 0, time.Second * 10, &jooki.FadeOptions{Pause: true, Restore: true})
+	vols := []int{}
+	for i := 0; i < 10; i++ {
+		c.Assert(clock.WaitForTimers(1, time.Second), Equals, true)
+		clock.Advance(time.Second)
+		if i < 9 {
+			vol := s.waitFor(c, func(state *jooki.JookiState) bool {
+				return int(state.Audio.Config.Volume) == 54 - i * 6
+			}).Audio.Config.Volume
+			vols = append(vols, int(vol))
+		}
+	}
+	res := <-ch
+	c.Assert(res.err, IsNil)
+	c.Check(vols, DeepEquals, []int{54, 48, 42, 36, 30, 24, 18, 12, 6})
+	c.Check(res.audio.Playback.State, Equals, jooki.PlaybackStatePaused)
+	c.Check(res.audio.Config.Volume, Equals, uint8(60))
+	// ten steps to 0 and one to restore
+	c.Check(s.countCommands("SET_VOL") - sent, Equals, 11)
+
+	// cancelling leaves the volume where it got to
+	ctx, cancel := context.WithCancel(context.Background())
+	ch = fade(ctx, 0, time.Second * 10, nil)
+	c.Assert(clock.WaitForTimers(1, time.Second), Equals, true)
+	clock.Advance(time.Second)
+	s.waitFor(c, func(state *jooki.JookiState) bool { return state.Audio.Config.Volume == 54 })
+	c.Assert(clock.WaitForTimers(1, time.Second), Equals, true)
+	cancel()
+	res = <-ch
+	c.Check(res.err, Equals, context.Canceled)
+	c.Check(s.dev.State().Audio.Config.Volume, Equals, uint8(54))
+
+	// as does someone turning the volume knob
+	ch = fade(context.Background(), 95, time.Second * 10, nil)
+	c.Assert(clock.WaitForTimers(1, time.Second), Equals, true)
+	s.dev.Update(func(state *jooki.JookiState) { state.Audio.Config.Volume = 30 })
+	s.waitFor(c, func(state *jooki.JookiState) bool { return state.Audio.Config.Volume == 30 })
+	clock.Advance(time.Second)
+	res = <-ch
+	c.Check(res.err, Equals, jooki.ErrFadeInterrupted)
+	c.Check(s.dev.State().Audio.Config.Volume, Equals, uint8(30))
+}
+
+func (s *ClientSuite) TestSleepTimer(c *C) {
+	t1 := s.dev.AddTrack("one.mp3", []byte("one"))
+	t2 := s.dev.AddTrack("two.mp3", []byte("two"))
+	t3 := s.dev.AddTrack("three.mp3", []byte("three"))
+	s.dev.Update(func(state *jooki.JookiState) {
+		for i, id := range []string{t1, t2, t3} {
+			d := jooki.FloatStr(60 * (i + 1))
+			state.Library.Tracks[id].Duration = &d
+		}
+	})
+	pl := s.dev.AddPlaylist("Lullabies", t1, t2, t3)
+	clock := jookitest.NewClock(time.Now())
+	s.client.SetClock(clock)
+	c.Check(s.client.SleepTimer(), IsNil)
+	_, err := s.client.SleepAtEndOfTrack()
+	c.Check(err, ErrorMatches, "nothing is playing")
+	_, err = s.client.PlayPlaylist(pl, 0)
+	c.Assert(err, IsNil)
+
+	t, err := s.client.SleepAfter(time.Minute * 20)
+	c.Assert(err, IsNil)
+	c.Check(s.client.SleepTimer(), Equals, t)
+	d, ok := t.Remaining()
+	c.Check(ok, Equals, true)
+	c.Check(d, Equals, time.Minute * 20)
+	clock.Advance(time.Minute * 5)
+	d, _ = t.Remaining()
+	c.Check(d, Equals, time.Minute * 15)
+	// a new timer replaces the old one
+	next, err := s.client.SleepAfter(time.Minute * 30)
+	c.Assert(err, IsNil)
+	c.Check(t.Finished(), Equals, true)
+	c.Check(t.Err(), Equals, jooki.ErrSleepCancelled)
+	c.Check(s.client.CancelSleepTimer(), Equals, true)
+	c.Check(next.Err(), Equals, jooki.ErrSleepCancelled)
+	c.Check(s.client.SleepTimer(), IsNil)
+	c.Check(s.client.CancelSleepTimer(), Equals, false)
+
+	t, err = s.client.SleepAfter(time.Minute * 20)
+	c.Assert(err, IsNil)
+	c.Assert(clock.WaitForTimers(1, time.Second), Equals, true)
+	clock.Advance(time.Minute * 20)
+	select {
+	case <-t.Done():
+	case <-time.After(time.Second * 2):
+		c.Fatal("sleep timer didn't fire")
+	}
+	c.Check(t.Err(), IsNil)
+	c.Check(s.dev.State().Audio.Playback.State, Equals, jooki.PlaybackStatePaused)
+	c.Check(s.client.SleepTimer(), IsNil)
+
+	// after two tracks
+	_, err = s.client.PlayPlaylist(pl, 0)
+	c.Assert(err, IsNil)
+	t, err = s.client.SleepAfterTracks(2)
+	c.Assert(err, IsNil)
+	c.Check(t.TracksLeft(), Equals, 2)
+	_, ok = t.Deadline()
+	c.Check(ok, Equals, false)
+	d, ok = t.Remaining()
+	c.Check(ok, Equals, true)
+	c.Check(d, Equals, time.Minute * 3)
+	_, err = s.client.SkipNext()
+	c.Assert(err, IsNil)
+	for i := 0; t.TracksLeft() != 1 && i < 100; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	c.Check(t.TracksLeft(), Equals, 1)
+	c.Check(t.Finished(), Equals, false)
+	d, ok = t.Remaining()
+	c.Check(ok, Equals, true)
+	c.Check(d, Equals, time.Minute * 2)
+	_, err = s.client.SkipNext()
+	c.Assert(err, IsNil)
+	select {
+	case <-t.Done():
+	case <-time.After(time.Second * 2):
+		c.Fatal("sleep timer didn't fire")
+	}
+	c.Check(t.Err(), IsNil)
+	state := s.dev.State()
+	c.Check(*state.Audio.NowPlaying.TrackID, Equals, t3)
+	c.Check(state.Audio.Playback.State, Equals, jooki.PlaybackStatePaused)
+}
+
+func (s *ClientSuite) TestNowPlayingPosition(c *C) {
+	t1 := s.dev.AddTrack("one.mp3", []byte("one"))
+	s.dev.Update(func(state *jooki.JookiState) {
+		d := jooki.FloatStr(100)
+		state.Library.Tracks[t1].Duration = &d
+	})
+	pl := s.dev.AddPlaylist("Lullabies", t1)
+	clock := jookitest.NewClock(time.Now())
+	s.client.SetClock(clock)
+	_, ok := s.client.NowPlayingPosition()
+	c.Check(ok, Equals, false)
+	_, err := s.client.PlayPlaylist(pl, 0)
+	c.Assert(err, IsNil)
+	_, err = s.client.Seek(10000)
+	c.Assert(err, IsNil)
+	pos, ok := s.client.NowPlayingPosition()
+	c.Assert(ok, Equals, true)
+	c.Check(pos.State, Equals, jooki.PlaybackStatePlaying)
+	c.Check(pos.TrackID, Equals, t1)
+	c.Check(pos.Elapsed, Equals, time.Second * 10)
+	c.Check(pos.Duration, Equals, time.Second * 100)
+	c.Check(pos.Updated, Equals, clock.Now())
+
+	// the position moves on between updates while playing
+	clock.Advance(time.Second * 15)
+	pos, _ = s.client.NowPlayingPosition()
+	c.Check(pos.Elapsed, Equals, time.Second * 25)
+	c.Check(pos.Remaining, Equals, time.Second * 75)
+	c.Check(pos.Percent, Equals, 25.0)
+	// but not past the end of the track
+	clock.Advance(time.Minute * 5)
+	pos, _ = s.client.NowPlayingPosition()
+	c.Check(pos.Elapsed, Equals, time.Second * 100)
+	c.Check(pos.Remaining, Equals, time.Duration(0))
+	c.Check(pos.Percent, Equals, 100.0)
+
+	// and stays put while paused
+	s.dev.Update(func(state *jooki.JookiState) {
+		state.Audio.Playback.Position = 40000
+		state.Audio.Playback.State = jooki.PlaybackStatePaused
+	})
+	s.waitFor(c, func(state *jooki.JookiState) bool { return state.Audio.Playback.State == jooki.PlaybackStatePaused })
+	clock.Advance(time.Second * 30)
+	pos, _ = s.client.NowPlayingPosition()
+	c.Check(pos.State, Equals, jooki.PlaybackStatePaused)
+	c.Check(pos.Elapsed, Equals, time.Second * 40)
+	c.Check(pos.Percent, Equals, 40.0)
+}
+
+const itunesLibrary = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Tracks</key>
+	<dict>
+		<key>1</key>
+		<dict>
+			<key>Track ID</key><integer>1</integer>
+			<key>Name</key><string>On Device</string>
+			<key>Artist</key><string>Someone</string>
+			<key>Album</key><string>Something</string>
+			<key>Size</key><integer>9999</integer>
+			<key>Total Time</key><integer>61000</integer>
+			<key>Location</key><string>file:///nowhere/on-device.mp3</string>
+		</dict>
+		<key>2</key>
+		<dict>
+			<key>Track ID</key><integer>2</integer>
+			<key>Name</key><string>Local</string>
+			<key>Size</key><integer>5</integer>
+			<key>Location</key><string>file://%s</string>
+		</dict>
+		<key>3</key>
+		<dict>
+			<key>Track ID</key><integer>3</integer>
+			<key>Name</key><string>Streaming</string>
+			<key>Track Type</key><string>Remote</string>
+		</dict>
+	</dict>
+	<key>Playlists</key>
+	<array>
+		<dict>
+			<key>Name</key><string>Bedtime</string>
+			<key>Playlist Persistent ID</key><string>0123456789ABCDEF</string>
+			<key>Playlist Items</key>
+			<array>
+				<dict><key>Track ID</key><integer>2</integer></dict>
+				<dict><key>Track ID</key><integer>3</integer></dict>
+				<dict><key>Track ID</key><integer>1</integer></dict>
+			</array>
+		</dict>
+	</array>
+</dict>
+</plist>
+`
+
+func (s *ClientSuite) TestImportITunesPlaylist(c *C) {
+	onDevice := s.dev.AddTrack("on-device.mp3", []byte("whatever"))
+	s.dev.Update(func(state *jooki.JookiState) {
+		tr := state.Library.Tracks[onDevice]
+		name, artist, album := "On Device", "Someone", "Something"
+		size, duration := jooki.IntStr(9999), jooki.FloatStr(61.2)
+		tr.Name, tr.Artist, tr.Album, tr.Size, tr.Duration = &name, &artist, &album, &size, &duration
+	})
+	s.waitFor(c, func(state *jooki.JookiState) bool {
+		return state.Library != nil && state.Library.Tracks[onDevice] != nil && state.Library.Tracks[onDevice].Artist != nil
+	})
+	local := filepath.Join(c.MkDir(), "local song.mp3")
+	c.Assert(ioutil.WriteFile(local, []byte("hello"), 0644), IsNil)
+	lib, err := jooki.ReadITunesLibrary(strings.NewReader(fmt.Sprintf(itunesLibrary, strings.Replace(local, " ", "%20", -1))))
+	c.Assert(err, IsNil)
+	pl := lib.Playlist("Bedtime")
+	c.Assert(pl, NotNil)
+	res, err := s.client.ImportITunesPlaylist(pl, nil)
+	c.Assert(err, IsNil)
+	c.Check(res.Plan.Missing, DeepEquals, []string{"Streaming"})
+	c.Assert(res.Uploads, HasLen, 1)
+	c.Check(res.Uploads[0].Path, Equals, local)
+	uploaded := *res.Uploads[0].Track.ID
+	c.Check(res.Playlist.Name, Equals, "Bedtime")
+	c.Check(res.Playlist.Tracks, DeepEquals, []string{uploaded, onDevice})
+	c.Check(s.dev.State().Library.Playlists[*res.Playlist.ID].Tracks, DeepEquals, []string{uploaded, onDevice})
+}
+
+func (s *ClientSuite) TestReconnect(c *C) {
+	backoff := jooki.ReconnectMinBackoff
+	defer func() { jooki.ReconnectMinBackoff = backoff }()
+	jooki.ReconnectMinBackoff = time.Millisecond * 10
+	statuses := make(chan jooki.ConnectionStatus, 10)
+	s.client.OnStatusChange(func(status jooki.ConnectionStatus, err error) {
+		statuses <- status
+	})
+	s.dev.DropConnections()
+	c.Check(<-statuses, Equals, jooki.StatusReconnecting)
+	c.Check(<-statuses, Equals, jooki.StatusConnected)
+	s.dev.Update(func(state *jooki.JookiState) {
+		state.Power.Level.P = 42
+	})
+	state := s.waitFor(c, func(state *jooki.JookiState) bool {
+		return state.Power != nil && state.Power.Level.P == 42
+	})
+	c.Check(state.Power.Level.P, Equals, 42)
+}
+
+func (s *ClientSuite) TestReconnectDropsDeletedPlaylist(c *C) {
+	keep := s.dev.AddPlaylist("Keep")
+	drop := s.dev.AddPlaylist("Drop")
+	s.waitFor(c, func(state *jooki.JookiState) bool {
+		return state.Library != nil && len(state.Library.Playlists) == 2
+	})
+	statuses := make(chan jooki.ConnectionStatus, 10)
+	s.client.OnStatusChange(func(status jooki.ConnectionStatus, err error) {
+		statuses <- status
+	})
+	s.dev.DropConnections()
+	c.Assert(<-statuses, Equals, jooki.StatusReconnecting)
+	// delete it while the client is waiting out the reconnect backoff,
+	// then reconnect without waiting
+	s.dev.Update(func(state *jooki.JookiState) {
+		delete(state.Library.Playlists, drop)
+	})
+	a, err := s.client.AddAwaiter()
+	c.Assert(err, IsNil)
+	defer a.Close()
+	_, err = s.client.Reconnect()
+	c.Assert(err, IsNil)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 2)
+	defer cancel()
+	state, err := a.WaitForStateContext(ctx, func(state *jooki.JookiState) bool {
+		return len(state.Library.Playlists) == 1
+	})
+	c.Assert(err, IsNil)
+	_, ok := state.Library.Playlists[keep]
+	c.Check(ok, Equals, true)
+}
+
+func (s *ClientSuite) TestDeletedPlaylistDisappears(c *C) {
+	keep := s.dev.AddPlaylist("Keep")
+	drop := s.dev.AddPlaylist("Drop")
+	s.waitFor(c, func(state *jooki.JookiState) bool {
+		return state.Library != nil && len(state.Library.Playlists) == 2
+	})
+	err := s.client.DeletePlaylist(drop)
+	c.Assert(err, IsNil)
+	playlists := s.client.GetState().Library.Playlists
+	c.Check(playlists, HasLen, 1)
+	c.Check(*playlists[keep].ID, Equals, keep)
+}
@@ -0,0 +1,60 @@
+package jooki
+
+import (
+	"time"
+)
+
+// Clock tells the time and sets timers.  Things that act at particular
+// times, like the Scheduler, take a Clock so that tests can control time
+// (see jookitest.Clock).
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is the part of time.Timer that Clocks provide.
+type Timer interface {
+	C() <-chan time.Time
+	// Stop prevents the timer firing, and reports whether it hadn't
+	// already fired.
+	Stop() bool
+}
+
+// SystemClock is the real time.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct {}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return &systemTimer{time.NewTimer(d)}
+}
+
+type systemTimer struct {
+	t *time.Timer
+}
+
+func (t *systemTimer) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t *systemTimer) Stop() bool {
+	return t.t.Stop()
+}
+
+// SetClock sets the clock used for timed operations such as fades, so
+// that tests can control time.  It defaults to SystemClock.
+func (c *Client) SetClock(clock Clock) {
+	c.connLocker.Lock()
+	defer c.connLocker.Unlock()
+	c.clock = clock
+}
+
+func (c *Client) Clock() Clock {
+	c.connLocker.RLock()
+	defer c.connLocker.RUnlock()
+	return c.clock
+}
@@ -2,17 +2,23 @@ package jooki
 
 import (
 	"bytes"
+	"context"
 	//"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"mime/multipart"
 	"net/http"
 	"net/textproto"
 	"net/url"
+	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -30,6 +36,22 @@ type PlaylistUpdate struct {
 	Token *string `json:"star,omitempty"`
 }
 
+// MarshalJSON omits Tracks if it's nil, to leave the playlist's tracks
+// alone, but sends an empty list to clear them.
+func (u *PlaylistUpdate) MarshalJSON() ([]byte, error) {
+	type update struct {
+		ID string `json:"id"`
+		Tracks *[]string `json:"tracks,omitempty"`
+		Title *string `json:"title,omitempty"`
+		Token *string `json:"star,omitempty"`
+	}
+	v := &update{ID: u.ID, Title: u.Title, Token: u.Token}
+	if u.Tracks != nil {
+		v.Tracks = &u.Tracks
+	}
+	return json.Marshal(v)
+}
+
 type PlaylistUpdateWrapper struct {
 	Playlist *PlaylistUpdate `json:"playlist"`
 }
@@ -59,6 +81,14 @@ type PlaylistDelete struct {
 	ID string `json:"playlistId"`
 }
 
+type TrackDelete struct {
+	TrackID string `json:"trackId"`
+}
+
+type SetSettings struct {
+	QuietTime *QuietTime `json:"quietTime,omitempty"`
+}
+
 type SetVol struct {
 	Volume int `json:"vol"`
 }
@@ -76,6 +106,12 @@ type SetSeek struct {
 }
 
 func (c *Client) CreatePlaylist(title string) (*Playlist, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 10)
+	defer cancel()
+	return c.CreatePlaylistContext(ctx, title)
+}
+
+func (c *Client) CreatePlaylistContext(ctx context.Context, title string) (*Playlist, error) {
 	/*
 	tmpTitleBytes := make([]byte, 12)
 	_, err := rand.Read(tmpTitleBytes)
@@ -94,16 +130,15 @@ func (c *Client) CreatePlaylist(title string) (*Playlist, error) {
 	if state != nil && state.Library != nil {
 		prevPlaylists = state.Library.Playlists
 	}
-	a, err := c.publishWithAwaiter("/j/web/input/PLAYLIST_NEW", msg)
+	a, err := c.publishWithAwaiter(ctx, "/j/web/input/PLAYLIST_NEW", msg)
 	if err != nil {
 		return nil, err
 	}
 	defer a.Close()
-	timer := time.NewTimer(time.Second * 10)
 	for {
-		update, ok := a.Read(timer)
+		update, ok := a.ReadContext(ctx)
 		if !ok {
-			return nil, errors.New("can't find newly created playlist")
+			return nil, fmt.Errorf("can't find newly created playlist: %s", ctx.Err())
 		}
 		if update.After.Library == nil || update.After.Library.Playlists == nil {
 			continue
@@ -117,7 +152,6 @@ func (c *Client) CreatePlaylist(title string) (*Playlist, error) {
 			}
 		}
 	}
-	return nil, errors.New("can't find newly created playlist")
 	/*
 	for k, pl := range update.After.Library.Playlists {
 		if _, ok := update.Before.Library.Playlists[k]; !ok {
@@ -133,6 +167,12 @@ func (c *Client) CreatePlaylist(title string) (*Playlist, error) {
 }
 
 func (c *Client) PlayPlaylist(id string, idx int) (*Audio, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+	return c.PlayPlaylistContext(ctx, id, idx)
+}
+
+func (c *Client) PlayPlaylistContext(ctx context.Context, id string, idx int) (*Audio, error) {
 	msg := &PlaylistPlay{ID: id, TrackIndex: idx + 1}
 	f := func(state *JookiState) bool {
 		if state == nil || state.Audio == nil {
@@ -149,7 +189,7 @@ func (c *Client) PlayPlaylist(id string, idx int) (*Audio, error) {
 		}
 		return true
 	}
-	state, err := c.publishAndWaitFor("/j/web/input/PLAYLIST_PLAY", msg, f, time.Second * 5)
+	state, err := c.publishAndWaitFor(ctx, "/j/web/input/PLAYLIST_PLAY", msg, f)
 	if err != nil {
 		return nil, err
 	}
@@ -157,6 +197,12 @@ func (c *Client) PlayPlaylist(id string, idx int) (*Audio, error) {
 }
 
 func (c *Client) UpdatePlaylist(update *PlaylistUpdate) (*Playlist, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+	return c.UpdatePlaylistContext(ctx, update)
+}
+
+func (c *Client) UpdatePlaylistContext(ctx context.Context, update *PlaylistUpdate) (*Playlist, error) {
 	msg := &PlaylistUpdateWrapper{Playlist: update}
 	f := func(state *JookiState) bool {
 		if state == nil || state.Library == nil {
@@ -169,10 +215,10 @@ func (c *Client) UpdatePlaylist(update *PlaylistUpdate) (*Playlist, error) {
 		if update.Title != nil && pl.Name != *update.Title {
 			return false
 		}
-		if update.Token != nil && (pl.Token == nil || *pl.Token != *update.Token) {
+		if update.Token != nil && strOf(pl.Token) != *update.Token {
 			return false
 		}
-		if len(update.Tracks) > 0 && len(update.Tracks) != len(pl.Tracks) {
+		if update.Tracks != nil && len(update.Tracks) != len(pl.Tracks) {
 			return false
 		}
 		for i, tr := range update.Tracks {
@@ -182,7 +228,7 @@ func (c *Client) UpdatePlaylist(update *PlaylistUpdate) (*Playlist, error) {
 		}
 		return true
 	}
-	state, err := c.publishAndWaitFor("/j/web/input/PLAYLIST_UPDATE", msg, f, time.Second * 5)
+	state, err := c.publishAndWaitFor(ctx, "/j/web/input/PLAYLIST_UPDATE", msg, f)
 	if err != nil {
 		return nil, err
 	}
@@ -190,29 +236,110 @@ func (c *Client) UpdatePlaylist(update *PlaylistUpdate) (*Playlist, error) {
 }
 
 func (c *Client) UpdatePlaylistTracks(id string, trackIds []string) (*Playlist, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+	return c.UpdatePlaylistTracksContext(ctx, id, trackIds)
+}
+
+func (c *Client) UpdatePlaylistTracksContext(ctx context.Context, id string, trackIds []string) (*Playlist, error) {
+	if trackIds == nil {
+		trackIds = []string{}
+	}
 	msg := &PlaylistUpdate{
 		ID: id,
 		Tracks: trackIds,
 	}
-	return c.UpdatePlaylist(msg)
+	return c.UpdatePlaylistContext(ctx, msg)
 }
 
 func (c *Client) RenamePlaylist(id, title string) (*Playlist, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+	return c.RenamePlaylistContext(ctx, id, title)
+}
+
+func (c *Client) RenamePlaylistContext(ctx context.Context, id, title string) (*Playlist, error) {
 	msg := &PlaylistUpdate{
 		ID: id,
 		Title: &title,
 	}
-	return c.UpdatePlaylist(msg)
+	return c.UpdatePlaylistContext(ctx, msg)
 }
 
+// UpdatePlaylistToken assigns a star to a playlist.  An empty token is
+// sent as an empty star ID, in the hope of unassigning the playlist's
+// star, but that hasn't been seen to work on a real device.  See also
+// AssignToken.
 func (c *Client) UpdatePlaylistToken(id, token string) (*Playlist, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+	return c.UpdatePlaylistTokenContext(ctx, id, token)
+}
+
+func (c *Client) UpdatePlaylistTokenContext(ctx context.Context, id, token string) (*Playlist, error) {
 	msg := &PlaylistUpdate{
 		ID: id,
 		Token: &token,
 	}
-	return c.UpdatePlaylist(msg)
+	return c.UpdatePlaylistContext(ctx, msg)
+}
+
+// TrackSizer is implemented by TrackUploads that know their size up
+// front, such as FileTrack.  Other tracks are spooled to a temporary file
+// to find out how big they are before they're uploaded.
+type TrackSizer interface {
+	Size() int64
+}
+
+// UploadBody is an upload request body that reports how much of it has
+// been sent.  The HTTP transport reads the body as it writes it to the
+// connection, so the count tracks what has actually gone over the wire.
+type UploadBody struct {
+	r io.Reader
+	size int64
+	sent int64
+	onProgress func(sent, size int64)
+}
+
+func NewUploadBody(r io.Reader, size int64, onProgress func(sent, size int64)) *UploadBody {
+	return &UploadBody{
+		r: r,
+		size: size,
+		onProgress: onProgress,
+	}
+}
+
+func (ub *UploadBody) Read(dst []byte) (int, error) {
+	n, err := ub.r.Read(dst)
+	if n > 0 {
+		sent := atomic.AddInt64(&ub.sent, int64(n))
+		if ub.onProgress != nil {
+			ub.onProgress(sent, ub.size)
+		}
+	}
+	return n, err
+}
+
+func (ub *UploadBody) Sent() int64 {
+	return atomic.LoadInt64(&ub.sent)
+}
+
+func (ub *UploadBody) UploadProgress() float64 {
+	if ub.size <= 0 {
+		return 0
+	}
+	return float64(ub.Sent()) / float64(ub.size)
 }
 
+func (ub *UploadBody) Len() int64 {
+	return ub.size
+}
+
+// ProgressBody is a request body that's written in full and then read,
+// sending the fraction read so far on Progress.
+//
+// Deprecated: ProgressBody holds the whole body in memory.  Use
+// UploadBody, which streams it.
 type ProgressBody struct {
 	buf *bytes.Buffer
 	size *int
@@ -252,6 +379,9 @@ func (pb *ProgressBody) Read(dst []byte) (int, error) {
 }
 
 func (pb *ProgressBody) UploadProgress() float64 {
+	if pb.size == nil || *pb.size == 0 {
+		return 0
+	}
 	return float64(pb.pos) / float64(*pb.size)
 }
 
@@ -266,66 +396,185 @@ type ProgressUpdate struct {
 	FileName string
 	UploadID int
 	UploadProgress float64
+	BytesSent int64
+	BytesTotal int64
 	Track *Track
 	Err error
 }
 
-func (c *Client) UploadToPlaylist(id string, track TrackUpload, ch chan ProgressUpdate) (*Track, error) {
-	defer close(ch)
-	md5 := track.MD5()[:16]
-	c.hc.CloseIdleConnections()
-	uploadId := int(rand.Intn(1e7))
-	progUpdate := ProgressUpdate{FileName: track.FileName(), UploadID: uploadId}
-	ch <- progUpdate
-	u := &url.URL{
-		Scheme: "http",
-		Host: c.device.Hostname,
-		Path: "/upload",
+type uploadForm struct {
+	io.Reader
+	r io.ReadCloser
+	// length of the whole form and of the file within it
+	length int64
+	size int64
+	contentType string
+}
+
+func (f *uploadForm) Close() error {
+	return f.r.Close()
+}
+
+// newUploadForm builds a streaming multipart/form-data body containing a
+// single file part.  Its exact length is known up front, so the device
+// gets a Content-Length rather than a chunked upload.  The caller must
+// close it once the request is done.
+func newUploadForm(uploadId int, track TrackUpload) (*uploadForm, error) {
+	r, err := track.Reader()
+	if err != nil {
+		return nil, err
 	}
-	body := NewProgressBody()
-	go func() {
-		for {
-			prog, ok := <-body.Progress
-			if !ok {
-				break
-			}
-			progUpdate.UploadProgress = prog
-			ch <- progUpdate
+	var size int64
+	if sizer, ok := track.(TrackSizer); ok {
+		size = sizer.Size()
+	} else {
+		r, size, err = spool(r)
+		if err != nil {
+			return nil, err
 		}
-	}()
-	w := multipart.NewWriter(body)
+	}
+	buf := &bytes.Buffer{}
+	w := multipart.NewWriter(buf)
 	h := textproto.MIMEHeader{}
 	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%d"; filename="%s"`, uploadId, filepath.Base(track.FileName())))
 	h.Set("Content-Type", track.ContentType())
-	part, err := w.CreatePart(h)
-	if err != nil {
-		progUpdate.Err = err
-		ch <- progUpdate
-		return nil, err
+	_, err = w.CreatePart(h)
+	if err == nil {
+		head := int64(buf.Len())
+		err = w.Close()
+		if err == nil {
+			data := buf.Bytes()
+			tail := int64(len(data)) - head
+			form := &uploadForm{
+				Reader: io.MultiReader(
+					bytes.NewReader(data[:head]),
+					io.LimitReader(r, size),
+					&sizeCheck{r: r},
+					bytes.NewReader(data[head:]),
+				),
+				r: r,
+				length: head + size + tail,
+				size: size,
+				contentType: w.FormDataContentType(),
+			}
+			return form, nil
+		}
 	}
-	r, err := track.Reader()
-	if err != nil {
-		progUpdate.Err = err
-		ch <- progUpdate
-		return nil, err
+	r.Close()
+	return nil, err
+}
+
+// sizeCheck fails the upload if the track has more data than it claimed
+// to, rather than sending a truncated file.
+type sizeCheck struct {
+	r io.Reader
+}
+
+func (sc *sizeCheck) Read(p []byte) (int, error) {
+	var buf [1]byte
+	n, _ := sc.r.Read(buf[:])
+	if n > 0 {
+		return 0, errors.New("track is larger than its reported size")
 	}
+	return 0, io.EOF
+}
+
+// spool copies r to a temporary file to find out its size.  The file is
+// removed when the returned ReadCloser is closed.
+func spool(r io.ReadCloser) (io.ReadCloser, int64, error) {
 	defer r.Close()
-	size, err := io.Copy(part, r)
+	f, err := ioutil.TempFile("", "jooki-upload-")
 	if err != nil {
-		progUpdate.Err = err
-		ch <- progUpdate
-		return nil, err
+		return nil, 0, err
+	}
+	os.Remove(f.Name())
+	size, err := io.Copy(f, r)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
 	}
-	w.Close()
-
-	req, err := http.NewRequest(http.MethodPost, u.String(), body)
 	if err != nil {
-		progUpdate.Err = err
-		ch <- progUpdate
+		f.Close()
+		return nil, 0, err
+	}
+	return f, size, nil
+}
+
+func (c *Client) UploadToPlaylist(id string, track TrackUpload, ch chan ProgressUpdate) (*Track, error) {
+	return c.UploadToPlaylistContext(context.Background(), id, track, ch)
+}
+
+// UploadToPlaylistContext is UploadToPlaylist with a context.  If the
+// device doesn't store the upload under the file's checksum, a new track
+// with the same file name and size is taken to be the upload.
+func (c *Client) UploadToPlaylistContext(ctx context.Context, id string, track TrackUpload, ch chan ProgressUpdate) (*Track, error) {
+	return c.uploadToPlaylist(ctx, id, track, ch, true)
+}
+
+// uploadToPlaylist uploads a track and adds it to a playlist.  Without
+// the fallback, a new track with the same file name and size that isn't
+// stored under the file's checksum is reported as a damaged upload
+// instead of being returned.
+func (c *Client) uploadToPlaylist(ctx context.Context, id string, track TrackUpload, ch chan ProgressUpdate, fallback bool) (*Track, error) {
+	md5 := track.MD5()[:16]
+	c.hc.CloseIdleConnections()
+	uploadId := int(rand.Intn(1e7))
+	progUpdate := ProgressUpdate{FileName: track.FileName(), UploadID: uploadId}
+	// progress is reported from the HTTP transport's goroutine, which
+	// may still be reading the body when the response comes back, so
+	// guard the channel against being closed underneath it
+	chLocker := &sync.Mutex{}
+	chClosed := false
+	send := func(update ProgressUpdate) {
+		chLocker.Lock()
+		defer chLocker.Unlock()
+		if !chClosed {
+			ch <- update
+		}
+	}
+	defer func() {
+		chLocker.Lock()
+		chClosed = true
+		close(ch)
+		chLocker.Unlock()
+	}()
+	fail := func(err error) (*Track, error) {
+		update := progUpdate
+		update.Err = err
+		send(update)
 		return nil, err
 	}
-	req.ContentLength = int64(body.Len())
-	req.Header.Set("Content-Type", w.FormDataContentType())
+	send(progUpdate)
+	u := &url.URL{
+		Scheme: "http",
+		Host: c.Hostname(),
+		Path: "/upload",
+	}
+	form, err := newUploadForm(uploadId, track)
+	if err != nil {
+		return fail(&localError{err})
+	}
+	defer form.Close()
+	size := form.size
+	progUpdate.BytesTotal = size
+	// report at most once per percent
+	lastPct := int64(-1)
+	body := NewUploadBody(form, form.length, func(sent, total int64) {
+		pct := sent * 100 / total
+		if pct == lastPct {
+			return
+		}
+		lastPct = pct
+		update := progUpdate
+		update.UploadProgress = float64(sent) / float64(total)
+		update.BytesSent = size * sent / total
+		send(update)
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), body)
+	if err != nil {
+		return fail(err)
+	}
+	req.ContentLength = form.length
+	req.Header.Set("Content-Type", form.contentType)
 
 	prevTracks := map[string]*Track{}
 	state := c.GetState()
@@ -336,17 +585,17 @@ func (c *Client) UploadToPlaylist(id string, track TrackUpload, ch chan Progress
 	res, err := c.hc.Do(req)
 	if err != nil {
 		log.Printf("error uploading %d: %s", uploadId, err)
-		progUpdate.Err = err
-		ch <- progUpdate
-		return nil, err
+		return fail(err)
 	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
 	if res.StatusCode != http.StatusOK {
 		log.Printf("track upload failed with HTTP %d", res.StatusCode)
-		progUpdate.Err = err
-		ch <- progUpdate
-		return nil, fmt.Errorf("track upload failed with HTTP %d", res.StatusCode)
+		return fail(fmt.Errorf("track upload failed with HTTP %d", res.StatusCode))
 	}
 	log.Printf("track upload %d success", uploadId)
+	progUpdate.UploadProgress = 1
+	progUpdate.BytesSent = size
 	msg := &PlaylistAddUpload{
 		ID: id,
 		UploadID: uploadId,
@@ -354,44 +603,57 @@ func (c *Client) UploadToPlaylist(id string, track TrackUpload, ch chan Progress
 	}
 	a, err := c.AddAwaiter()
 	if err != nil {
-		progUpdate.Err = err
-		ch <- progUpdate
-		return nil, err
+		return fail(err)
 	}
 	defer a.Close()
 	log.Printf("send mqtt message: %#v", msg)
-	err = c.publish("/j/web/input/PLAYLIST_ADD_UPLOAD", msg)
+	err = c.publish(ctx, "/j/web/input/PLAYLIST_ADD_UPLOAD", msg)
 	if err != nil {
-		progUpdate.Err = err
-		ch <- progUpdate
-		return nil, err
+		return fail(err)
+	}
+	// don't wait forever for the device to ingest the upload if the
+	// caller didn't set a deadline
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Minute)
+		defer cancel()
 	}
-	timer := time.NewTimer(time.Minute)
 	for {
 		log.Println("looking for new track id")
-		update, ok := a.Read(timer)
+		update, ok := a.ReadContext(ctx)
 		if !ok {
 			log.Println("read failed, can't find newly uploaded track")
-			return nil, errors.New("can't find newly uploaded track")
+			return fail(fmt.Errorf("can't find newly uploaded track: %s", ctx.Err()))
 		}
 		if update.After.Library == nil || update.After.Library.Tracks == nil {
 			continue
 		}
 		v, ok := update.After.Library.Tracks[md5]
 		if ok {
+			// the state is shared with other awaiters
+			v = v.Clone()
 			v.ID = &md5
 			log.Printf("found uploaded track %s = %s", md5, v)
 			progUpdate.Track = v
-			ch <- progUpdate
+			send(progUpdate)
 			return v, nil
 		}
 		for k, v := range update.After.Library.Tracks {
 			if _, ok := prevTracks[k]; !ok {
+				if v.Location != nil && *v.Location != msg.Filename {
+					// some other upload
+					continue
+				}
 				if v.Size != nil && int64(*v.Size) == size {
+					if !fallback {
+						log.Printf("new track %s should be %s", k, md5)
+						return fail(&VerifyError{TrackID: k, Field: "md5", Expected: md5, Actual: k})
+					}
+					v = v.Clone()
 					v.ID = &k
 					log.Printf("found uploaded track %s = %s", k, v)
 					progUpdate.Track = v
-					ch <- progUpdate
+					send(progUpdate)
 					return v, nil
 				} else if v.Size != nil {
 					log.Printf("new track %s has wrong size (%d != %d): %s", k, *v.Size, size, v)
@@ -401,11 +663,15 @@ func (c *Client) UploadToPlaylist(id string, track TrackUpload, ch chan Progress
 			}
 		}
 	}
-	log.Println("failed to find newly uploaded track")
-	return nil, errors.New("can't find newly uploaded track")
 }
 
 func (c *Client) AddTrackToPlaylist(playlistId, trackId string) (*Playlist, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+	return c.AddTrackToPlaylistContext(ctx, playlistId, trackId)
+}
+
+func (c *Client) AddTrackToPlaylistContext(ctx context.Context, playlistId, trackId string) (*Playlist, error) {
 	msg := &PlaylistAddTrack{
 		ID: playlistId,
 		TrackID: trackId,
@@ -420,7 +686,7 @@ func (c *Client) AddTrackToPlaylist(playlistId, trackId string) (*Playlist, erro
 		}
 		return pl.Tracks[len(pl.Tracks) - 1] == trackId
 	}
-	state, err := c.publishAndWaitFor("/j/web/input/PLAYLIST_ADD_TRACK", msg, f, time.Second * 5)
+	state, err := c.publishAndWaitFor(ctx, "/j/web/input/PLAYLIST_ADD_TRACK", msg, f)
 	if err != nil {
 		return nil, err
 	}
@@ -428,19 +694,63 @@ func (c *Client) AddTrackToPlaylist(playlistId, trackId string) (*Playlist, erro
 }
 
 func (c *Client) DeletePlaylist(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+	return c.DeletePlaylistContext(ctx, id)
+}
+
+func (c *Client) DeletePlaylistContext(ctx context.Context, id string) error {
 	msg := &PlaylistDelete{ID: id}
 	f := func(state *JookiState) bool {
 		if state == nil || state.Library == nil {
 			return false
 		}
 		_, ok := state.Library.Playlists[id]
-		return ok
+		return !ok
 	}
-	_, err := c.publishAndWaitFor("/j/web/input/PLAYLIST_DELETE", msg, f, time.Second * 5)
+	_, err := c.publishAndWaitForState(ctx, "/j/web/input/PLAYLIST_DELETE", msg, f)
+	return err
+}
+
+// DeleteTrack removes a track from the device, freeing the space it
+// uses.  Playlists are left alone, so check the track isn't on any (see
+// Library.PlaylistsWithTrack) before deleting it.  TRACK_DELETE follows
+// the naming of PLAYLIST_DELETE; it only counts as done once the track
+// has gone from the device's state, so if the device doesn't take it
+// the call times out rather than reporting success.
+func (c *Client) DeleteTrack(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+	return c.DeleteTrackContext(ctx, id)
+}
+
+func (c *Client) DeleteTrackContext(ctx context.Context, id string) error {
+	state := c.GetState()
+	if state == nil || state.Library == nil {
+		return errors.New("jooki library not loaded")
+	}
+	if _, ok := state.Library.Tracks[id]; !ok {
+		return errors.New("no such track")
+	}
+	msg := &TrackDelete{TrackID: id}
+	f := func(state *JookiState) bool {
+		if state == nil || state.Library == nil {
+			return false
+		}
+		_, ok := state.Library.Tracks[id]
+		return !ok
+	}
+	_, err := c.publishAndWaitForState(ctx, "/j/web/input/TRACK_DELETE", msg, f)
 	return err
 }
 
 func (c *Client) Play() (*Audio, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+	return c.PlayContext(ctx)
+}
+
+func (c *Client) PlayContext(ctx context.Context) (*Audio, error) {
 	f := func(state *JookiState) bool {
 		if state == nil || state.Audio == nil {
 			return false
@@ -450,7 +760,7 @@ func (c *Client) Play() (*Audio, error) {
 		}
 		return state.Audio.Playback.State == PlaybackStatePlaying
 	}
-	state, err := c.publishAndWaitFor("/j/web/input/DO_PLAY", "{}", f, time.Second * 5)
+	state, err := c.publishAndWaitFor(ctx, "/j/web/input/DO_PLAY", "{}", f)
 	if err != nil {
 		return nil, err
 	}
@@ -458,6 +768,12 @@ func (c *Client) Play() (*Audio, error) {
 }
 
 func (c *Client) Pause() (*Audio, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+	return c.PauseContext(ctx)
+}
+
+func (c *Client) PauseContext(ctx context.Context) (*Audio, error) {
 	f := func(state *JookiState) bool {
 		if state == nil || state.Audio == nil {
 			return false
@@ -467,7 +783,7 @@ func (c *Client) Pause() (*Audio, error) {
 		}
 		return state.Audio.Playback.State == PlaybackStatePaused || state.Audio.Playback.State == PlaybackStateEnded
 	}
-	state, err := c.publishAndWaitFor("/j/web/input/DO_PAUSE", "{}", f, time.Second * 5)
+	state, err := c.publishAndWaitFor(ctx, "/j/web/input/DO_PAUSE", "{}", f)
 	if err != nil {
 		return nil, err
 	}
@@ -475,6 +791,12 @@ func (c *Client) Pause() (*Audio, error) {
 }
 
 func (c *Client) SetVolume(vol int) (*Audio, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+	return c.SetVolumeContext(ctx, vol)
+}
+
+func (c *Client) SetVolumeContext(ctx context.Context, vol int) (*Audio, error) {
 	msg := &SetVol{Volume: vol}
 	f := func(state *JookiState) bool {
 		if state == nil || state.Audio == nil {
@@ -485,14 +807,60 @@ func (c *Client) SetVolume(vol int) (*Audio, error) {
 		}
 		return state.Audio.Config.Volume == uint8(vol)
 	}
-	state, err := c.publishAndWaitFor("/j/web/input/SET_VOL", msg, f, time.Second * 5)
+	state, err := c.publishAndWaitFor(ctx, "/j/web/input/SET_VOL", msg, f)
 	if err != nil {
 		return nil, err
 	}
 	return state.Audio, nil
 }
 
+// SetQuietTime turns quiet time on or off and sets the time of day the
+// device shuts down when it's on.
+func (c *Client) SetQuietTime(active bool, shutdown TimeOfDay) (*QuietTime, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+	return c.SetQuietTimeContext(ctx, active, shutdown)
+}
+
+func (c *Client) SetQuietTimeContext(ctx context.Context, active bool, shutdown TimeOfDay) (*QuietTime, error) {
+	if !shutdown.Valid() {
+		return nil, fmt.Errorf("bad shutdown time %s", &shutdown)
+	}
+	msg := &SetSettings{QuietTime: &QuietTime{Active: active, Shutdown: &shutdown}}
+	f := func(state *JookiState) bool {
+		if state == nil || state.Settings == nil {
+			return false
+		}
+		qt := state.Settings.QuietTime
+		if qt == nil || qt.Shutdown == nil {
+			return false
+		}
+		return qt.Active == active && *qt.Shutdown == shutdown
+	}
+	state, err := c.publishAndWaitFor(ctx, "/j/web/input/SET_SETTINGS", msg, f)
+	if err != nil {
+		return nil, err
+	}
+	return state.Settings.QuietTime, nil
+}
+
+// TimeUntilShutdown reports how long it is until quiet time next shuts
+// the device down, and false if quiet time is off.
+func (c *Client) TimeUntilShutdown() (time.Duration, bool) {
+	state := c.GetState()
+	if state == nil || state.Settings == nil {
+		return 0, false
+	}
+	return state.Settings.QuietTime.Until(c.Clock().Now())
+}
+
 func (c *Client) SetShuffleMode(on bool) (*Audio, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+	return c.SetShuffleModeContext(ctx, on)
+}
+
+func (c *Client) SetShuffleModeContext(ctx context.Context, on bool) (*Audio, error) {
 	msg := &SetShuffle{ShuffleMode: on}
 	f := func(state *JookiState) bool {
 		if state == nil || state.Audio == nil {
@@ -503,7 +871,7 @@ func (c *Client) SetShuffleMode(on bool) (*Audio, error) {
 		}
 		return state.Audio.Config.ShuffleMode == on
 	}
-	state, err := c.publishAndWaitFor("/j/web/input/SET_CFG", msg, f, time.Second * 5)
+	state, err := c.publishAndWaitFor(ctx, "/j/web/input/SET_CFG", msg, f)
 	if err != nil {
 		return nil, err
 	}
@@ -511,6 +879,12 @@ func (c *Client) SetShuffleMode(on bool) (*Audio, error) {
 }
 
 func (c *Client) SetRepeatMode(mode RepeatMode) (*Audio, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+	return c.SetRepeatModeContext(ctx, mode)
+}
+
+func (c *Client) SetRepeatModeContext(ctx context.Context, mode RepeatMode) (*Audio, error) {
 	msg := &SetRepeat{RepeatMode: int(mode)}
 	f := func(state *JookiState) bool {
 		if state == nil || state.Audio == nil {
@@ -521,7 +895,7 @@ func (c *Client) SetRepeatMode(mode RepeatMode) (*Audio, error) {
 		}
 		return state.Audio.Config.RepeatMode == mode
 	}
-	state, err := c.publishAndWaitFor("/j/web/input/SET_CFG", msg, f, time.Second * 5)
+	state, err := c.publishAndWaitFor(ctx, "/j/web/input/SET_CFG", msg, f)
 	if err != nil {
 		return nil, err
 	}
@@ -529,19 +903,31 @@ func (c *Client) SetRepeatMode(mode RepeatMode) (*Audio, error) {
 }
 
 func (c *Client) SetPlayMode(mode int) (*Audio, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 10)
+	defer cancel()
+	return c.SetPlayModeContext(ctx, mode)
+}
+
+func (c *Client) SetPlayModeContext(ctx context.Context, mode int) (*Audio, error) {
 	shuffleOn := (mode & PlayModeShuffle) != 0
 	repeatMode := RepeatModeOff
 	if (mode & PlayModeRepeat) != 0 {
 		repeatMode = RepeatModeOnce
 	}
-	_, err := c.SetShuffleMode(shuffleOn)
+	_, err := c.SetShuffleModeContext(ctx, shuffleOn)
 	if err != nil {
 		return nil, err
 	}
-	return c.SetRepeatMode(repeatMode)
+	return c.SetRepeatModeContext(ctx, repeatMode)
 }
 
 func (c *Client) SkipNext() (*Audio, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+	return c.SkipNextContext(ctx)
+}
+
+func (c *Client) SkipNextContext(ctx context.Context) (*Audio, error) {
 	before := c.GetState()
 	f := func(state *JookiState) bool {
 		if state == nil || state.Audio == nil {
@@ -561,7 +947,7 @@ func (c *Client) SkipNext() (*Audio, error) {
 		}
 		return *before.Audio.NowPlaying.TrackID != *state.Audio.NowPlaying.TrackID
 	}
-	state, err := c.publishAndWaitFor("/j/web/input/DO_NEXT", "{}", f, time.Second * 5)
+	state, err := c.publishAndWaitFor(ctx, "/j/web/input/DO_NEXT", "{}", f)
 	if err != nil {
 		return nil, err
 	}
@@ -569,6 +955,12 @@ func (c *Client) SkipNext() (*Audio, error) {
 }
 
 func (c *Client) SkipPrev() (*Audio, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+	return c.SkipPrevContext(ctx)
+}
+
+func (c *Client) SkipPrevContext(ctx context.Context) (*Audio, error) {
 	before := c.GetState()
 	f := func(state *JookiState) bool {
 		if state == nil || state.Audio == nil {
@@ -588,7 +980,7 @@ func (c *Client) SkipPrev() (*Audio, error) {
 		}
 		return *before.Audio.NowPlaying.TrackID != *state.Audio.NowPlaying.TrackID
 	}
-	state, err := c.publishAndWaitFor("/j/web/input/DO_PREV", "{}", f, time.Second * 5)
+	state, err := c.publishAndWaitFor(ctx, "/j/web/input/DO_PREV", "{}", f)
 	if err != nil {
 		return nil, err
 	}
@@ -596,6 +988,12 @@ func (c *Client) SkipPrev() (*Audio, error) {
 }
 
 func (c *Client) Seek(ms int) (*Audio, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 2)
+	defer cancel()
+	return c.SeekContext(ctx, ms)
+}
+
+func (c *Client) SeekContext(ctx context.Context, ms int) (*Audio, error) {
 	f := func(state *JookiState) bool {
 		if state == nil || state.Audio == nil {
 			return false
@@ -605,7 +1003,7 @@ func (c *Client) Seek(ms int) (*Audio, error) {
 		}
 		return state.Audio.Playback.Position >= ms - 1000 && state.Audio.Playback.Position <= ms + 1000
 	}
-	state, err := c.publishAndWaitFor("/j/web/input/SEEK", &SetSeek{Position: ms}, f, time.Second * 2)
+	state, err := c.publishAndWaitFor(ctx, "/j/web/input/SEEK", &SetSeek{Position: ms}, f)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,1222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rclancey/jooki"
+)
+
+func runDiscover(a *app, args []string) error {
+	results, err := jooki.DiscoverAll()
+	if err != nil {
+		return err
+	}
+	type device struct {
+		ID string `json:"id"`
+		Hostname string `json:"hostname"`
+		IP string `json:"ip"`
+		Version string `json:"version,omitempty"`
+		LatencyMS float64 `json:"latency_ms"`
+		Error string `json:"error,omitempty"`
+	}
+	devices := make([]device, len(results))
+	for i, res := range results {
+		devices[i] = device{
+			ID: res.Device.ID,
+			Hostname: res.Device.Hostname,
+			IP: res.Device.IP,
+			LatencyMS: float64(res.Latency) / float64(time.Millisecond),
+		}
+		if res.Ping != nil {
+			devices[i].Version = res.Ping.Version
+		}
+		if res.Err != nil {
+			devices[i].Error = res.Err.Error()
+		}
+	}
+	return a.print(devices, func(w io.Writer) {
+		if len(devices) == 0 {
+			fmt.Fprintln(w, "no devices found")
+		}
+		for _, dev := range devices {
+			status := fmt.Sprintf("v%s %.0fms", dev.Version, dev.LatencyMS)
+			if dev.Error != "" {
+				status = "offline: " + dev.Error
+			}
+			fmt.Fprintf(w, "%-12s %-24s %-16s %s\n", dev.ID, dev.Hostname, dev.IP, status)
+		}
+	})
+}
+
+type status struct {
+	State string `json:"state"`
+	Playlist string `json:"playlist,omitempty"`
+	PlaylistID string `json:"playlistId,omitempty"`
+	Track string `json:"track,omitempty"`
+	Artist string `json:"artist,omitempty"`
+	Album string `json:"album,omitempty"`
+	TrackID string `json:"trackId,omitempty"`
+	PositionMS int `json:"position_ms"`
+	DurationMS int `json:"duration_ms,omitempty"`
+	Volume int `json:"volume"`
+	Shuffle bool `json:"shuffle"`
+	Repeat int `json:"repeat"`
+	Battery int `json:"battery"`
+	Charging bool `json:"charging"`
+}
+
+func getStatus(state *jooki.JookiState) *status {
+	st := &status{Battery: -1}
+	if state.Audio != nil {
+		if pb := state.Audio.Playback; pb != nil {
+			st.State = pb.State
+			st.PositionMS = pb.Position
+		}
+		if cfg := state.Audio.Config; cfg != nil {
+			st.Volume = int(cfg.Volume)
+			st.Shuffle = cfg.ShuffleMode
+			st.Repeat = int(cfg.RepeatMode)
+		}
+		if np := state.Audio.NowPlaying; np != nil {
+			st.Track = str(np.Title)
+			st.Artist = str(np.Artist)
+			st.Album = str(np.Album)
+			st.TrackID = str(np.TrackID)
+			st.PlaylistID = str(np.PlaylistID)
+			if np.Duration != nil {
+				st.DurationMS = int(*np.Duration)
+			}
+			if state.Library != nil && np.PlaylistID != nil {
+				if pl, ok := state.Library.Playlists[*np.PlaylistID]; ok {
+					st.Playlist = pl.Name
+				}
+			}
+		}
+	}
+	if state.Power != nil {
+		st.Charging = state.Power.Charging
+		if state.Power.Level != nil {
+			st.Battery = state.Power.Level.P
+		}
+	}
+	return st
+}
+
+func (st *status) print(w io.Writer) {
+	state := strings.ToLower(st.State)
+	if state == "" {
+		state = "idle"
+	}
+	if st.Track != "" {
+		fmt.Fprintf(w, "%s: %s", state, st.Track)
+		if st.Artist != "" {
+			fmt.Fprintf(w, " - %s", st.Artist)
+		}
+		fmt.Fprintf(w, " [%s", fmtMS(st.PositionMS))
+		if st.DurationMS > 0 {
+			fmt.Fprintf(w, " / %s", fmtMS(st.DurationMS))
+		}
+		fmt.Fprintln(w, "]")
+		if st.Playlist != "" {
+			fmt.Fprintf(w, "playlist: %s\n", st.Playlist)
+		}
+	} else {
+		fmt.Fprintln(w, state)
+	}
+	fmt.Fprintf(w, "volume: %d  shuffle: %t  repeat: %d\n", st.Volume, st.Shuffle, st.Repeat)
+	if st.Battery >= 0 {
+		fmt.Fprintf(w, "battery: %d%%", st.Battery)
+		if st.Charging {
+			fmt.Fprint(w, " (charging)")
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+func runStatus(a *app, args []string) error {
+	st := getStatus(a.client.GetState())
+	if pos, ok := a.client.NowPlayingPosition(); ok {
+		st.PositionMS = int(pos.Elapsed / time.Millisecond)
+	}
+	return a.print(st, st.print)
+}
+
+func (a *app) printAudio(audio *jooki.Audio) error {
+	st := getStatus(&jooki.JookiState{Audio: audio, Library: a.client.GetState().Library})
+	return a.print(st, st.print)
+}
+
+func runPlay(a *app, args []string) error {
+	ctx, cancel := a.context()
+	defer cancel()
+	if len(args) == 0 {
+		audio, err := a.client.PlayContext(ctx)
+		if err != nil {
+			return err
+		}
+		return a.printAudio(audio)
+	}
+	if len(args) > 2 {
+		return errUsage("play")
+	}
+	pl, err := a.findPlaylist(args[0])
+	if err != nil {
+		return err
+	}
+	idx := 0
+	if len(args) > 1 {
+		idx, err = strconv.Atoi(args[1])
+		if err != nil || idx < 1 {
+			return fmt.Errorf("bad track number %q", args[1])
+		}
+		idx -= 1
+	}
+	audio, err := a.client.PlayPlaylistContext(ctx, *pl.ID, idx)
+	if err != nil {
+		return err
+	}
+	return a.printAudio(audio)
+}
+
+func runPause(a *app, args []string) error {
+	ctx, cancel := a.context()
+	defer cancel()
+	audio, err := a.client.PauseContext(ctx)
+	if err != nil {
+		return err
+	}
+	return a.printAudio(audio)
+}
+
+func runNext(a *app, args []string) error {
+	ctx, cancel := a.context()
+	defer cancel()
+	audio, err := a.client.SkipNextContext(ctx)
+	if err != nil {
+		return err
+	}
+	return a.printAudio(audio)
+}
+
+func runPrev(a *app, args []string) error {
+	ctx, cancel := a.context()
+	defer cancel()
+	audio, err := a.client.SkipPrevContext(ctx)
+	if err != nil {
+		return err
+	}
+	return a.printAudio(audio)
+}
+
+func runSeek(a *app, args []string) error {
+	if len(args) != 1 {
+		return errUsage("seek")
+	}
+	ms, err := parsePosition(args[0])
+	if err != nil {
+		return err
+	}
+	ctx, cancel := a.context()
+	defer cancel()
+	audio, err := a.client.SeekContext(ctx, ms)
+	if err != nil {
+		return err
+	}
+	return a.printAudio(audio)
+}
+
+func runVolume(a *app, args []string) error {
+	if len(args) == 0 {
+		return runStatus(a, args)
+	}
+	if len(args) != 1 {
+		return errUsage("volume")
+	}
+	vol, err := strconv.Atoi(args[0])
+	if err != nil || vol < 0 || vol > 100 {
+		return fmt.Errorf("bad volume %q", args[0])
+	}
+	ctx, cancel := a.context()
+	defer cancel()
+	audio, err := a.client.SetVolumeContext(ctx, vol)
+	if err != nil {
+		return err
+	}
+	return a.printAudio(audio)
+}
+
+func runFade(a *app, args []string) error {
+	opts := &jooki.FadeOptions{}
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		switch args[0] {
+		case "-p":
+			opts.Pause = true
+		case "-r":
+			opts.Restore = true
+		default:
+			return errUsage("fade")
+		}
+		args = args[1:]
+	}
+	if len(args) != 2 {
+		return errUsage("fade")
+	}
+	vol, err := strconv.Atoi(args[0])
+	if err != nil || vol < 0 || vol > 100 {
+		return fmt.Errorf("bad volume %q", args[0])
+	}
+	d, err := time.ParseDuration(args[1])
+	if err != nil {
+		return fmt.Errorf("bad duration %q", args[1])
+	}
+	audio, err := a.client.FadeVolumeContext(context.Background(), vol, d, opts)
+	if err != nil {
+		return err
+	}
+	return a.printAudio(audio)
+}
+
+func runSleep(a *app, args []string) error {
+	var t *jooki.SleepTimer
+	var err error
+	switch {
+	case len(args) == 1 && args[0] == "end":
+		t, err = a.client.SleepAtEndOfTrack()
+	case len(args) == 2 && args[0] == "tracks":
+		n, cerr := strconv.Atoi(args[1])
+		if cerr != nil {
+			return fmt.Errorf("bad track count %q", args[1])
+		}
+		t, err = a.client.SleepAfterTracks(n)
+	case len(args) == 1:
+		d, derr := time.ParseDuration(args[0])
+		if derr != nil {
+			return fmt.Errorf("bad duration %q", args[0])
+		}
+		t, err = a.client.SleepAfter(d)
+	default:
+		return errUsage("sleep")
+	}
+	if err != nil {
+		return err
+	}
+	<-t.Done()
+	if err = t.Err(); err != nil {
+		return err
+	}
+	return runStatus(a, nil)
+}
+
+func runShuffle(a *app, args []string) error {
+	if len(args) != 1 {
+		return errUsage("shuffle")
+	}
+	on, err := onOff(args[0])
+	if err != nil {
+		return err
+	}
+	ctx, cancel := a.context()
+	defer cancel()
+	audio, err := a.client.SetShuffleModeContext(ctx, on)
+	if err != nil {
+		return err
+	}
+	return a.printAudio(audio)
+}
+
+func runRepeat(a *app, args []string) error {
+	if len(args) != 1 {
+		return errUsage("repeat")
+	}
+	var mode jooki.RepeatMode
+	switch strings.ToLower(args[0]) {
+	case "off":
+		mode = jooki.RepeatModeOff
+	case "on":
+		mode = jooki.RepeatModeOn
+	case "once":
+		mode = jooki.RepeatModeOnce
+	default:
+		return errUsage("repeat")
+	}
+	ctx, cancel := a.context()
+	defer cancel()
+	audio, err := a.client.SetRepeatModeContext(ctx, mode)
+	if err != nil {
+		return err
+	}
+	return a.printAudio(audio)
+}
+
+func runQuiet(a *app, args []string) error {
+	if len(args) > 2 {
+		return errUsage("quiet")
+	}
+	if len(args) > 0 {
+		active, err := onOff(args[0])
+		if err != nil {
+			return errUsage("quiet")
+		}
+		var shutdown jooki.TimeOfDay
+		if len(args) == 2 {
+			shutdown, err = jooki.ParseTimeOfDay(args[1])
+			if err != nil {
+				return err
+			}
+		} else {
+			settings := a.client.GetState().Settings
+			if settings == nil || settings.QuietTime == nil || settings.QuietTime.Shutdown == nil {
+				return errors.New("no shutdown time set; usage: jooki " + commands["quiet"].usage)
+			}
+			shutdown = *settings.QuietTime.Shutdown
+		}
+		ctx, cancel := a.context()
+		defer cancel()
+		_, err = a.client.SetQuietTimeContext(ctx, active, shutdown)
+		if err != nil {
+			return err
+		}
+	}
+	type quiet struct {
+		Active bool `json:"active"`
+		Shutdown string `json:"shutdown,omitempty"`
+		Remaining string `json:"remaining,omitempty"`
+	}
+	q := &quiet{}
+	if settings := a.client.GetState().Settings; settings != nil && settings.QuietTime != nil {
+		q.Active = settings.QuietTime.Active
+		if settings.QuietTime.Shutdown != nil {
+			q.Shutdown = settings.QuietTime.Shutdown.String()
+		}
+	}
+	if d, ok := a.client.TimeUntilShutdown(); ok {
+		q.Remaining = d.Round(time.Minute).String()
+	}
+	return a.print(q, func(w io.Writer) {
+		if !q.Active {
+			fmt.Fprintln(w, "quiet time off")
+			return
+		}
+		fmt.Fprintf(w, "quiet time at %s, in %s\n", q.Shutdown, q.Remaining)
+	})
+}
+
+// findPlaylist looks up a playlist by ID, or failing that by title.
+func (a *app) findPlaylist(idOrTitle string) (*jooki.Playlist, error) {
+	state := a.client.GetState()
+	if state.Library == nil {
+		return nil, errors.New("no library")
+	}
+	if pl, ok := state.Library.Playlists[idOrTitle]; ok {
+		return pl, nil
+	}
+	var found *jooki.Playlist
+	for _, pl := range state.Library.Playlists {
+		if strings.EqualFold(pl.Name, idOrTitle) {
+			if found != nil {
+				return nil, fmt.Errorf("more than one playlist is called %q", idOrTitle)
+			}
+			found = pl
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no playlist %q", idOrTitle)
+	}
+	return found, nil
+}
+
+func printTracks(w io.Writer, tracks []*jooki.Track) {
+	for i, tr := range tracks {
+		fmt.Fprintf(w, "%3d. %s  %s", i + 1, str(tr.ID), str(tr.Name))
+		if tr.Artist != nil && *tr.Artist != "" {
+			fmt.Fprintf(w, " - %s", *tr.Artist)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+func runSearch(a *app, args []string) error {
+	if len(args) == 0 {
+		return errUsage("search")
+	}
+	tracks := a.client.GetState().Library.SearchTracks(strings.Join(args, " "))
+	return a.print(tracks, func(w io.Writer) { printTracks(w, tracks) })
+}
+
+type playlistInfo struct {
+	ID string `json:"id"`
+	Title string `json:"title"`
+	Token string `json:"star,omitempty"`
+	Tracks []string `json:"tracks"`
+}
+
+func newPlaylistInfo(pl *jooki.Playlist) *playlistInfo {
+	return &playlistInfo{
+		ID: str(pl.ID),
+		Title: pl.Name,
+		Token: str(pl.Token),
+		Tracks: pl.Tracks,
+	}
+}
+
+func runPlaylist(a *app, args []string) error {
+	if len(args) == 0 {
+		return errUsage("playlist")
+	}
+	ctx, cancel := a.context()
+	defer cancel()
+	switch args[0] {
+	case "ls", "list":
+		infos := []*playlistInfo{}
+		for _, pl := range a.client.GetState().Library.SortedPlaylists() {
+			infos = append(infos, newPlaylistInfo(pl))
+		}
+		return a.print(infos, func(w io.Writer) {
+			for _, info := range infos {
+				fmt.Fprintf(w, "%s  %-30s %3d tracks", info.ID, info.Title, len(info.Tracks))
+				if info.Token != "" {
+					fmt.Fprintf(w, "  [%s]", info.Token)
+				}
+				fmt.Fprintln(w)
+			}
+		})
+	case "show":
+		if len(args) != 2 {
+			return errors.New("usage: jooki playlist show playlist")
+		}
+		pl, err := a.findPlaylist(args[1])
+		if err != nil {
+			return err
+		}
+		lib := a.client.GetState().Library
+		tracks := lib.PlaylistTracks(str(pl.ID))
+		stats := lib.PlaylistStats(str(pl.ID))
+		return a.print(tracks, func(w io.Writer) {
+			fmt.Fprintln(w, pl.Name)
+			printTracks(w, tracks)
+			fmt.Fprintf(w, "%d tracks, %s, %.1f MB\n", stats.Tracks, stats.Duration.Round(time.Second), float64(stats.Size) / 1e6)
+			if stats.Missing > 0 {
+				fmt.Fprintf(w, "%d tracks missing from the library\n", stats.Missing)
+			}
+		})
+	case "create":
+		if len(args) != 2 {
+			return errors.New("usage: jooki playlist create title")
+		}
+		pl, err := a.client.CreatePlaylistContext(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		info := newPlaylistInfo(pl)
+		return a.print(info, func(w io.Writer) { fmt.Fprintln(w, info.ID) })
+	case "rename":
+		if len(args) != 3 {
+			return errors.New("usage: jooki playlist rename playlist title")
+		}
+		pl, err := a.findPlaylist(args[1])
+		if err != nil {
+			return err
+		}
+		pl, err = a.client.RenamePlaylistContext(ctx, *pl.ID, args[2])
+		if err != nil {
+			return err
+		}
+		info := newPlaylistInfo(pl)
+		return a.print(info, func(w io.Writer) {})
+	case "delete", "rm":
+		if len(args) != 2 {
+			return errors.New("usage: jooki playlist delete playlist")
+		}
+		pl, err := a.findPlaylist(args[1])
+		if err != nil {
+			return err
+		}
+		return a.client.DeletePlaylistContext(ctx, *pl.ID)
+	case "add":
+		if len(args) < 3 {
+			return errors.New("usage: jooki playlist add playlist track-id...")
+		}
+		pl, err := a.findPlaylist(args[1])
+		if err != nil {
+			return err
+		}
+		for _, trackId := range args[2:] {
+			pl, err = a.client.AddTrackToPlaylistContext(ctx, *pl.ID, trackId)
+			if err != nil {
+				return err
+			}
+		}
+		info := newPlaylistInfo(pl)
+		return a.print(info, func(w io.Writer) {})
+	}
+	return errUsage("playlist")
+}
+
+func runUpload(a *app, args []string) error {
+	if len(args) < 2 {
+		return errUsage("upload")
+	}
+	pl, err := a.findPlaylist(args[0])
+	if err != nil {
+		return err
+	}
+	files := []string{}
+	for _, fn := range args[1:] {
+		st, err := os.Stat(fn)
+		if err != nil {
+			return err
+		}
+		if st.IsDir() || isM3U(fn) {
+			list, err := jooki.LocalPlaylist(fn)
+			if err != nil {
+				return err
+			}
+			files = append(files, list...)
+		} else {
+			files = append(files, fn)
+		}
+	}
+	ch := make(chan jooki.BulkProgress, 100)
+	done := make(chan bool)
+	go func() {
+		for prog := range ch {
+			if !a.json {
+				fmt.Fprintf(os.Stderr, "\r%d/%d files  %3.0f%%", prog.Completed, prog.Files, prog.Fraction() * 100)
+			}
+		}
+		close(done)
+	}()
+	results, err := a.client.UploadFiles(*pl.ID, files, &jooki.BulkUploadOptions{Progress: ch})
+	<-done
+	if !a.json {
+		fmt.Fprintln(os.Stderr)
+	}
+	if err != nil {
+		return err
+	}
+	type result struct {
+		Path string `json:"path"`
+		TrackID string `json:"trackId,omitempty"`
+		Existing bool `json:"existing"`
+		Attempts int `json:"attempts"`
+		Verified bool `json:"verified"`
+		Orphaned []string `json:"orphaned,omitempty"`
+		Error string `json:"error,omitempty"`
+	}
+	out := make([]result, len(results))
+	failed := 0
+	for i, res := range results {
+		out[i] = result{
+			Path: res.Path,
+			Existing: res.Existing,
+			Attempts: res.Attempts,
+			Verified: res.Verified,
+			Orphaned: res.Orphaned,
+		}
+		if res.Track != nil {
+			out[i].TrackID = str(res.Track.ID)
+		}
+		if res.Err != nil {
+			out[i].Error = res.Err.Error()
+			failed += 1
+		}
+	}
+	err = a.print(out, func(w io.Writer) {
+		for _, res := range out {
+			switch {
+			case res.Error != "":
+				fmt.Fprintf(w, "%s: %s\n", res.Path, res.Error)
+			case res.Existing:
+				fmt.Fprintf(w, "%s: already uploaded as %s\n", res.Path, res.TrackID)
+			default:
+				fmt.Fprintf(w, "%s: uploaded as %s\n", res.Path, res.TrackID)
+			}
+			if len(res.Orphaned) > 0 {
+				fmt.Fprintf(w, "  failed attempts left tracks %s in the library\n", strings.Join(res.Orphaned, ", "))
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d uploads failed", failed, len(out))
+	}
+	return nil
+}
+
+func runSync(a *app, args []string) error {
+	dryRun := false
+	if len(args) > 0 && args[0] == "-n" {
+		dryRun = true
+		args = args[1:]
+	}
+	if len(args) != 2 {
+		return errUsage("sync")
+	}
+	pl, err := a.findPlaylist(args[0])
+	if err != nil {
+		if dryRun {
+			return err
+		}
+		ctx, cancel := a.context()
+		defer cancel()
+		pl, err = a.client.CreatePlaylistContext(ctx, args[0])
+		if err != nil {
+			return err
+		}
+	}
+	plan, err := a.client.PlanSync(*pl.ID, args[1])
+	if err != nil {
+		return err
+	}
+	type step struct {
+		Action string `json:"action"`
+		Path string `json:"path,omitempty"`
+		TrackID string `json:"trackId,omitempty"`
+	}
+	steps := make([]step, len(plan.Steps))
+	for i, st := range plan.Steps {
+		steps[i] = step{Action: st.Action.String(), Path: st.Path, TrackID: st.TrackID}
+	}
+	if dryRun || plan.InSync() {
+		return a.print(steps, func(w io.Writer) { fmt.Fprintln(w, plan) })
+	}
+	if !a.json {
+		fmt.Fprintln(a.out, plan)
+	}
+	ch := make(chan jooki.BulkProgress, 100)
+	done := make(chan bool)
+	go func() {
+		for prog := range ch {
+			if !a.json {
+				fmt.Fprintf(os.Stderr, "\r%d/%d files  %3.0f%%", prog.Completed, prog.Files, prog.Fraction() * 100)
+			}
+		}
+		close(done)
+	}()
+	res, err := a.client.ApplySync(plan, &jooki.BulkUploadOptions{Progress: ch})
+	<-done
+	if !a.json {
+		fmt.Fprintln(os.Stderr)
+	}
+	if res != nil {
+		for _, ur := range res.Uploads {
+			if ur.Err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", ur.Path, ur.Err)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return a.print(newPlaylistInfo(res.Playlist), func(w io.Writer) {})
+}
+
+func runToken(a *app, args []string) error {
+	if len(args) == 0 {
+		return errUsage("token")
+	}
+	ctx, cancel := a.context()
+	defer cancel()
+	switch args[0] {
+	case "ls", "list":
+		type token struct {
+			Star string `json:"star"`
+			Token string `json:"token,omitempty"`
+			Seen *time.Time `json:"seen,omitempty"`
+			Playlist string `json:"playlistId,omitempty"`
+			Title string `json:"title,omitempty"`
+		}
+		tokens := []*token{}
+		for _, ta := range a.client.GetState().Library.TokenAssignments() {
+			t := &token{Star: ta.StarID}
+			if ta.Token != nil {
+				t.Token = str(ta.Token.ID)
+				if seen := ta.Token.SeenTime(); !seen.IsZero() {
+					t.Seen = &seen
+				}
+			}
+			if ta.Playlist != nil {
+				t.Playlist = str(ta.Playlist.ID)
+				t.Title = ta.Playlist.Name
+			}
+			tokens = append(tokens, t)
+		}
+		return a.print(tokens, func(w io.Writer) {
+			for _, t := range tokens {
+				seen := "never seen"
+				if t.Seen != nil {
+					seen = "seen " + t.Seen.Local().Format("2006-01-02 15:04")
+				}
+				title := "(unassigned)"
+				if t.Playlist != "" {
+					title = t.Title
+				}
+				fmt.Fprintf(w, "%-12s %-30s %s\n", t.Star, title, seen)
+			}
+		})
+	case "assign":
+		if len(args) != 3 {
+			return errors.New("usage: jooki token assign star playlist")
+		}
+		pl, err := a.findPlaylist(args[2])
+		if err != nil {
+			return err
+		}
+		pl, err = a.client.AssignTokenContext(ctx, args[1], *pl.ID)
+		if err != nil {
+			return err
+		}
+		return a.print(newPlaylistInfo(pl), func(w io.Writer) {})
+	case "unassign":
+		if len(args) != 2 {
+			return errors.New("usage: jooki token unassign star")
+		}
+		return a.client.UnassignTokenContext(ctx, args[1])
+	case "swap":
+		if len(args) != 3 {
+			return errors.New("usage: jooki token swap playlist playlist")
+		}
+		pa, err := a.findPlaylist(args[1])
+		if err != nil {
+			return err
+		}
+		pb, err := a.findPlaylist(args[2])
+		if err != nil {
+			return err
+		}
+		return a.client.SwapTokensContext(ctx, *pa.ID, *pb.ID)
+	}
+	return errUsage("token")
+}
+
+func runGC(a *app, args []string) error {
+	dryRun := false
+	if len(args) > 0 && args[0] == "-n" {
+		dryRun = true
+		args = args[1:]
+	}
+	if len(args) != 0 {
+		return errUsage("gc")
+	}
+	plan, err := a.client.PlanGC()
+	if err != nil {
+		return err
+	}
+	if dryRun || len(plan.Tracks) == 0 {
+		return a.print(plan.Tracks, func(w io.Writer) { fmt.Fprintln(w, plan) })
+	}
+	res, err := a.client.ApplyGC(plan)
+	if res != nil {
+		type result struct {
+			Deleted []string `json:"deleted"`
+			Kept []string `json:"kept"`
+			Freed int64 `json:"freed"`
+		}
+		perr := a.print(&result{res.Deleted, res.Kept, res.Freed}, func(w io.Writer) {
+			fmt.Fprintf(w, "deleted %d tracks, freeing %.1f MB\n", len(res.Deleted), float64(res.Freed) / 1e6)
+			if len(res.Kept) > 0 {
+				fmt.Fprintf(w, "kept %d tracks added to playlists since\n", len(res.Kept))
+			}
+		})
+		if err == nil {
+			err = perr
+		}
+	}
+	return err
+}
+
+func runBackup(a *app, args []string) error {
+	if len(args) < 1 {
+		return errUsage("backup")
+	}
+	res, err := a.client.Backup(args[0], args[1:]...)
+	if res != nil {
+		ids := make([]string, 0, len(res.Errors))
+		for id := range res.Errors {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			name := ""
+			if tr := res.Manifest.Library.Tracks[id]; tr != nil {
+				name = str(tr.Name)
+			}
+			fmt.Fprintf(os.Stderr, "%s (%s): %s\n", name, id, res.Errors[id])
+		}
+		type result struct {
+			Downloaded []string `json:"downloaded"`
+			Copied []string `json:"copied"`
+			Existing []string `json:"existing"`
+			Missing []string `json:"missing"`
+		}
+		perr := a.print(&result{res.Downloaded, res.Copied, res.Existing, res.Missing}, func(w io.Writer) {
+			fmt.Fprintf(w, "downloaded %d tracks, copied %d from local files, %d already backed up, %d failed\n", len(res.Downloaded), len(res.Copied), len(res.Existing), len(res.Errors))
+		})
+		if err == nil {
+			err = perr
+		}
+	}
+	return err
+}
+
+func runRestore(a *app, args []string) error {
+	if len(args) != 1 {
+		return errUsage("restore")
+	}
+	res, err := a.client.Restore(args[0])
+	if res != nil {
+		infos := []*playlistInfo{}
+		results := res.Playlists
+		if res.Orphans != nil {
+			results = append(results, res.Orphans)
+		}
+		for _, sr := range results {
+			for _, ur := range sr.Uploads {
+				if ur.Err != nil {
+					fmt.Fprintf(os.Stderr, "%s: %s\n", ur.Path, ur.Err)
+				}
+			}
+			for _, fn := range sr.Plan.Missing {
+				fmt.Fprintf(os.Stderr, "%s: missing from backup\n", fn)
+			}
+			if sr.Playlist != nil {
+				infos = append(infos, newPlaylistInfo(sr.Playlist))
+			}
+		}
+		perr := a.print(infos, func(w io.Writer) {
+			for _, info := range infos {
+				fmt.Fprintf(w, "%s  %-30s %3d tracks\n", info.ID, info.Title, len(info.Tracks))
+			}
+		})
+		if err == nil {
+			err = perr
+		}
+	}
+	return err
+}
+
+func runITunes(a *app, args []string) error {
+	dryRun := false
+	if len(args) > 0 && args[0] == "-n" {
+		dryRun = true
+		args = args[1:]
+	}
+	if len(args) < 1 {
+		return errUsage("itunes")
+	}
+	lib, err := jooki.LoadITunesLibrary(args[0])
+	if err != nil {
+		return err
+	}
+	if len(args) == 1 {
+		type playlist struct {
+			ID string `json:"id"`
+			Name string `json:"name"`
+			Tracks int `json:"tracks"`
+		}
+		pls := []playlist{}
+		for _, pl := range lib.Playlists {
+			if pl.Master || pl.Folder || pl.Distinguished {
+				continue
+			}
+			pls = append(pls, playlist{ID: pl.PersistentID, Name: pl.Name, Tracks: len(pl.Tracks)})
+		}
+		return a.print(pls, func(w io.Writer) {
+			for _, pl := range pls {
+				fmt.Fprintf(w, "%s  %-30s %3d tracks\n", pl.ID, pl.Name, pl.Tracks)
+			}
+		})
+	}
+	for _, name := range args[1:] {
+		pl := lib.Playlist(name)
+		if pl == nil {
+			return fmt.Errorf("no itunes playlist %q", name)
+		}
+		if dryRun {
+			state := a.client.GetState()
+			jpl, err := a.findPlaylist(pl.Name)
+			id := ""
+			if err == nil {
+				id = *jpl.ID
+			} else {
+				// plan against an empty playlist
+				id = "new"
+				state.Library.Playlists[id] = &jooki.Playlist{Name: pl.Name}
+				fmt.Fprintf(a.out, "create playlist %s\n", pl.Name)
+			}
+			plan, err := jooki.NewITunesSyncPlan(state.Library, id, pl)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(a.out, plan)
+			continue
+		}
+		ch := make(chan jooki.BulkProgress, 100)
+		done := make(chan bool)
+		go func() {
+			for prog := range ch {
+				if !a.json {
+					fmt.Fprintf(os.Stderr, "\r%s: %d/%d files  %3.0f%%", pl.Name, prog.Completed, prog.Files, prog.Fraction() * 100)
+				}
+			}
+			close(done)
+		}()
+		res, err := a.client.ImportITunesPlaylist(pl, &jooki.BulkUploadOptions{Progress: ch})
+		<-done
+		if !a.json {
+			fmt.Fprintln(os.Stderr)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", pl.Name, err)
+		}
+		for _, fn := range res.Plan.Missing {
+			fmt.Fprintf(os.Stderr, "%s: skipped %s, which isn't available locally\n", pl.Name, fn)
+		}
+		err = a.print(newPlaylistInfo(res.Playlist), func(w io.Writer) {
+			fmt.Fprintf(w, "%s: %d tracks\n", pl.Name, len(res.Playlist.Tracks))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isM3U(fn string) bool {
+	ext := strings.ToLower(filepath.Ext(fn))
+	return ext == ".m3u" || ext == ".m3u8"
+}
+
+func runWatch(a *app, args []string) error {
+	sub, err := a.client.Subscribe(&jooki.SubscribeOptions{Overflow: jooki.OverflowDropOldest})
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+	for ev := range sub.Events() {
+		line := map[string]interface{}{
+			"time": time.Now().Format(time.RFC3339),
+			"event": ev.Type().String(),
+		}
+		text := ""
+		switch e := ev.(type) {
+		case *jooki.TrackChangedEvent:
+			if e.After != nil {
+				line["track"] = str(e.After.Title)
+				line["trackId"] = str(e.After.TrackID)
+				text = str(e.After.Title)
+			}
+		case *jooki.PlaybackStateEvent:
+			line["state"] = e.After
+			text = e.After
+		case *jooki.VolumeEvent:
+			line["volume"] = e.After
+			text = strconv.Itoa(e.After)
+		case *jooki.BatteryEvent:
+			if e.After != nil && e.After.Level != nil {
+				line["battery"] = e.After.Level.P
+				line["charging"] = e.After.Charging
+				text = fmt.Sprintf("%d%%", e.After.Level.P)
+			}
+		case *jooki.TokenEvent:
+			line["nfc"] = e.NFC
+			line["star"] = e.StarID()
+			text = e.StarID()
+			if e.Playlist != nil {
+				line["playlistId"] = str(e.Playlist.ID)
+				text += " " + e.Playlist.Name
+			}
+		case *jooki.ConnectionEvent:
+			line["status"] = e.Status.String()
+			text = e.Status.String()
+			if e.Err != nil {
+				line["error"] = e.Err.Error()
+				text += ": " + e.Err.Error()
+			}
+		}
+		err = a.print(line, func(w io.Writer) {
+			fmt.Fprintf(w, "%s %s %s\n", line["time"], line["event"], text)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parsePosition(s string) (int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("bad position %q", s)
+	}
+	secs := 0.0
+	for _, part := range parts {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil || v < 0 {
+			return 0, fmt.Errorf("bad position %q", s)
+		}
+		secs = secs * 60 + v
+	}
+	return int(secs * 1000), nil
+}
+
+func fmtMS(ms int) string {
+	secs := ms / 1000
+	if secs >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", secs / 3600, (secs / 60) % 60, secs % 60)
+	}
+	return fmt.Sprintf("%d:%02d", secs / 60, secs % 60)
+}
+
+func str(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func runSchedule(a *app, args []string) error {
+	fn := ""
+	if len(args) > 1 && args[0] == "-f" {
+		fn = args[1]
+		args = args[2:]
+	}
+	if len(args) == 0 {
+		return errUsage("schedule")
+	}
+	if fn == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return err
+		}
+		fn = filepath.Join(dir, "jooki", "schedule.json")
+	}
+	opts := &jooki.SchedulerOptions{File: fn}
+	if args[0] == "run" {
+		opts.OnRun = func(run *jooki.JobRun) {
+			line := map[string]interface{}{
+				"time": run.Started.Format(time.RFC3339),
+				"job": run.Job.ID,
+			}
+			text := "ok"
+			if run.Err != nil {
+				line["error"] = run.Err.Error()
+				text = run.Err.Error()
+			}
+			a.print(line, func(w io.Writer) {
+				fmt.Fprintf(w, "%s %s %s\n", line["time"], run.Job, text)
+			})
+		}
+	}
+	sched, err := jooki.NewScheduler(a.client, opts)
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "ls", "list":
+		jobs := sched.Jobs()
+		return a.print(jobs, func(w io.Writer) {
+			if len(jobs) == 0 {
+				fmt.Fprintln(w, "nothing scheduled")
+			}
+			for _, job := range jobs {
+				fmt.Fprintln(w, job)
+			}
+		})
+	case "add":
+		if len(args) < 3 {
+			return errors.New("usage: jooki schedule add HH:MM|'min hour dom mon dow' step... (steps are play=playlist, volume=N, fade=N/duration, fadeout=duration, shuffle=on|off, pause)")
+		}
+		job := &jooki.Job{}
+		if tod, err := jooki.ParseTimeOfDay(args[1]); err == nil {
+			job.At = &tod
+		} else {
+			job.Cron = args[1]
+		}
+		for _, arg := range args[2:] {
+			st, err := parseJobStep(arg)
+			if err != nil {
+				return err
+			}
+			job.Steps = append(job.Steps, st)
+		}
+		err = os.MkdirAll(filepath.Dir(fn), 0755)
+		if err != nil {
+			return err
+		}
+		job, err = sched.Add(job)
+		if err != nil {
+			return err
+		}
+		return a.print(job, func(w io.Writer) { fmt.Fprintln(w, job) })
+	case "rm", "remove":
+		if len(args) != 2 {
+			return errors.New("usage: jooki schedule rm id")
+		}
+		return sched.Remove(args[1])
+	case "run":
+		sched.Start()
+		defer sched.Stop()
+		select {}
+	}
+	return errUsage("schedule")
+}
+
+func parseJobStep(s string) (*jooki.JobStep, error) {
+	parts := strings.SplitN(s, "=", 2)
+	st := &jooki.JobStep{Action: jooki.ScheduleAction(strings.ToLower(parts[0]))}
+	arg := ""
+	if len(parts) == 2 {
+		arg = parts[1]
+	}
+	switch st.Action {
+	case jooki.SchedulePlay:
+		st.Playlist = arg
+	case jooki.ScheduleVolume:
+		vol, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil, fmt.Errorf("bad volume %q", arg)
+		}
+		st.Volume = &vol
+	case jooki.ScheduleShuffle:
+		on, err := onOff(arg)
+		if err != nil {
+			return nil, err
+		}
+		st.Shuffle = &on
+	case jooki.ScheduleFade, "fadeout":
+		// fade=volume/duration, or fadeout=duration to fade to 0, pause
+		// and put the volume back
+		vol, dur := 0, arg
+		if st.Action == jooki.ScheduleFade {
+			parts := strings.SplitN(arg, "/", 2)
+			v, err := strconv.Atoi(parts[0])
+			if err != nil || len(parts) != 2 {
+				return nil, fmt.Errorf("bad fade %q; want volume/duration", arg)
+			}
+			vol, dur = v, parts[1]
+		} else {
+			st.Action = jooki.ScheduleFade
+			st.Pause = true
+			st.Restore = true
+		}
+		d, err := time.ParseDuration(dur)
+		if err != nil {
+			return nil, fmt.Errorf("bad duration %q", dur)
+		}
+		st.Volume = &vol
+		st.Seconds = int(d / time.Second)
+	}
+	return st, nil
+}
@@ -0,0 +1,194 @@
+// Command jooki controls a jooki speaker from the command line.
+//
+// Usage:
+//
+//	jooki [-host addr] [-json] [-timeout d] command [args...]
+//
+// Run "jooki help" for the list of commands.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rclancey/jooki"
+)
+
+type command struct {
+	usage string
+	help string
+	connect bool
+	run func(app *app, args []string) error
+}
+
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"discover": &command{"discover", "list jooki devices on the network", false, runDiscover},
+		"status": &command{"status", "show what the device is doing", true, runStatus},
+		"play": &command{"play [playlist [track]]", "resume playback, or play a playlist from the given track number", true, runPlay},
+		"pause": &command{"pause", "pause playback", true, runPause},
+		"next": &command{"next", "skip to the next track", true, runNext},
+		"prev": &command{"prev", "skip to the previous track", true, runPrev},
+		"seek": &command{"seek position", "seek to a position in the current track (seconds or m:ss)", true, runSeek},
+		"volume": &command{"volume [level]", "show or set the volume (0-100)", true, runVolume},
+		"fade": &command{"fade [-p] [-r] level duration", "fade the volume gradually, e.g. fade 0 30m; -p pauses after, -r then restores the volume", true, runFade},
+		"sleep": &command{"sleep duration|end|tracks n", "pause after a while, at the end of the current track, or after n tracks; waits until then", true, runSleep},
+		"shuffle": &command{"shuffle on|off", "turn shuffle on or off", true, runShuffle},
+		"repeat": &command{"repeat off|on|once", "set the repeat mode", true, runRepeat},
+		"quiet": &command{"quiet [on|off [HH:MM]]", "show or set when quiet time shuts the jooki down", true, runQuiet},
+		"playlist": &command{"playlist ls|show|create|rename|delete|add ...", "manage playlists", true, runPlaylist},
+		"token": &command{"token ls|assign|unassign|swap ...", "manage which figurine plays which playlist", true, runToken},
+		"search": &command{"search words...", "find tracks by title, artist or album", true, runSearch},
+		"sync": &command{"sync [-n] playlist dir|m3u", "make a playlist match a local playlist; -n shows what would change", true, runSync},
+		"itunes": &command{"itunes [-n] library.xml [playlist...]", "list the playlists in an iTunes library export, or copy them to the jooki", true, runITunes},
+		"upload": &command{"upload playlist file|dir|m3u...", "upload audio files to a playlist, skipping any already on the device", true, runUpload},
+		"gc": &command{"gc [-n]", "delete tracks that aren't on any playlist; -n lists them", true, runGC},
+		"backup": &command{"backup dir [source...]", "save the tracks, playlists and token assignments to a directory; audio found in the local sources isn't downloaded", true, runBackup},
+		"restore": &command{"restore dir", "recreate the playlists and token assignments in a backup", true, runRestore},
+		"schedule": &command{"schedule [-f file] ls|add|rm|run ...", "manage timed jobs, e.g. schedule add 19:30 play=Lullabies volume=20; run carries them out", true, runSchedule},
+		"watch": &command{"watch", "print events as they happen", true, runWatch},
+	}
+}
+
+type app struct {
+	client *jooki.Client
+	json bool
+	timeout time.Duration
+	out io.Writer
+}
+
+func (a *app) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), a.timeout)
+}
+
+// waitForState waits for the device's response to the GET_STATE request
+// sent when the client connected.
+func (a *app) waitForState() error {
+	aw, err := a.client.AddAwaiter()
+	if err != nil {
+		return err
+	}
+	defer aw.Close()
+	ctx, cancel := a.context()
+	defer cancel()
+	_, err = aw.WaitForContext(ctx, func(state *jooki.JookiState) bool {
+		return state != nil && state.Library != nil && state.Audio != nil
+	})
+	if err != nil {
+		return fmt.Errorf("no state received from jooki: %s", err)
+	}
+	return nil
+}
+
+// print writes v as JSON in -json mode, or calls text to write it for
+// humans otherwise.
+func (a *app) print(v interface{}, text func(w io.Writer)) error {
+	if a.json {
+		enc := json.NewEncoder(a.out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	text(a.out)
+	return nil
+}
+
+func usage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "usage: %s [flags] command [args...]\n\nflags:\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintf(w, "\ncommands:\n")
+	for _, name := range sortedCommands() {
+		cmd := commands[name]
+		fmt.Fprintf(w, "  %-45s %s\n", cmd.usage, cmd.help)
+	}
+}
+
+func sortedCommands() []string {
+	return []string{"discover", "status", "play", "pause", "next", "prev", "seek", "volume", "fade", "sleep", "shuffle", "repeat", "quiet", "playlist", "token", "search", "upload", "sync", "itunes", "gc", "backup", "restore", "schedule", "watch"}
+}
+
+func main() {
+	host := flag.String("host", "", "connect to the jooki at this address instead of discovering it")
+	device := flag.String("device", "", "discover the jooki with this ID or hostname")
+	jsonOut := flag.Bool("json", false, "write output as JSON")
+	timeout := flag.Duration("timeout", time.Second * 10, "how long to wait for each command")
+	verbose := flag.Bool("v", false, "log protocol chatter")
+	flag.Usage = usage
+	flag.Parse()
+	if !*verbose {
+		log.SetOutput(ioutil.Discard)
+	}
+	args := flag.Args()
+	if len(args) == 0 || args[0] == "help" {
+		usage()
+		if len(args) == 0 {
+			os.Exit(2)
+		}
+		return
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		usage()
+		os.Exit(2)
+	}
+	a := &app{json: *jsonOut, timeout: *timeout, out: os.Stdout}
+	err := run(a, cmd, *host, *device, args[1:])
+	if err != nil {
+		fatal(err)
+	}
+}
+
+// run connects to the device if the command needs it, runs the command
+// and disconnects again, so that nothing exits with the session open.
+func run(a *app, cmd *command, host, device string, args []string) error {
+	if cmd.connect {
+		var err error
+		switch {
+		case host != "":
+			a.client, err = jooki.Connect(host)
+		case device != "":
+			a.client, err = jooki.DiscoverDevice(device)
+		default:
+			a.client, err = jooki.Discover()
+		}
+		if err != nil {
+			return err
+		}
+		defer a.client.Disconnect()
+		err = a.waitForState()
+		if err != nil {
+			return err
+		}
+	}
+	return cmd.run(a, args)
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "jooki:", err)
+	os.Exit(1)
+}
+
+func errUsage(name string) error {
+	return fmt.Errorf("usage: jooki %s", commands[name].usage)
+}
+
+func onOff(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "on", "true", "yes", "1":
+		return true, nil
+	case "off", "false", "no", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("expected on or off, got %q", s)
+}
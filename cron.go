@@ -0,0 +1,157 @@
+package jooki
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule is a standard five field cron schedule: minute, hour, day
+// of month, month and day of week.  Each field is "*", a number, a range
+// such as "1-5", or a comma separated list of them, optionally with a
+// step such as "*/15".  Months and days of the week may also be given by
+// their three letter names, and Sunday is 0 or 7.  As in cron, a day
+// matches if either the day of the month or the day of the week does,
+// when both are restricted.
+type CronSchedule struct {
+	spec string
+	minute uint64
+	hour uint64
+	dom uint64
+	month uint64
+	dow uint64
+	domStar bool
+	dowStar bool
+}
+
+var cronMonths = []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+var cronDays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func ParseCron(spec string) (*CronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("bad cron schedule %q: want 5 fields", spec)
+	}
+	s := &CronSchedule{spec: strings.Join(fields, " ")}
+	var err error
+	if s.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("bad cron schedule %q: minute %s", spec, err)
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("bad cron schedule %q: hour %s", spec, err)
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("bad cron schedule %q: day of month %s", spec, err)
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12, cronMonths); err != nil {
+		return nil, fmt.Errorf("bad cron schedule %q: month %s", spec, err)
+	}
+	if s.dow, err = parseCronField(fields[4], 0, 7, cronDays); err != nil {
+		return nil, fmt.Errorf("bad cron schedule %q: day of week %s", spec, err)
+	}
+	if s.dow & (1 << 7) != 0 {
+		s.dow |= 1
+	}
+	s.domStar = strings.HasPrefix(fields[2], "*")
+	s.dowStar = strings.HasPrefix(fields[4], "*")
+	return s, nil
+}
+
+func parseCronField(field string, min, max int, names []string) (uint64, error) {
+	var bits uint64
+	value := func(s string) (int, error) {
+		for i, name := range names {
+			if name != "" && strings.EqualFold(s, name) {
+				return i, nil
+			}
+		}
+		v, err := strconv.Atoi(s)
+		if err != nil || v < min || v > max {
+			return 0, fmt.Errorf("%q out of range", s)
+		}
+		return v, nil
+	}
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			rng = part[:i]
+			v, err := strconv.Atoi(part[i+1:])
+			if err != nil || v < 1 {
+				return 0, fmt.Errorf("bad step %q", part)
+			}
+			step = v
+		}
+		lo, hi := min, max
+		switch {
+		case rng == "*":
+		case strings.Contains(rng, "-"):
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if lo, err = value(bounds[0]); err != nil {
+				return 0, err
+			}
+			if hi, err = value(bounds[1]); err != nil {
+				return 0, err
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("bad range %q", rng)
+			}
+		default:
+			v, err := value(rng)
+			if err != nil {
+				return 0, err
+			}
+			lo = v
+			if step == 1 {
+				hi = v
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (s *CronSchedule) String() string {
+	return s.spec
+}
+
+func (s *CronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom & (1 << uint(t.Day())) != 0
+	dow := s.dow & (1 << uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the first time after t that matches the schedule, or the
+// zero time if there isn't one in the next five years (e.g. for the 30th
+// of February).
+func (s *CronSchedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.month & (1 << uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month() + 1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day() + 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if s.hour & (1 << uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour() + 1, 0, 0, 0, loc)
+			continue
+		}
+		if s.minute & (1 << uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
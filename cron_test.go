@@ -0,0 +1,62 @@
+package jooki
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type CronSuite struct {}
+var _ = Suite(&CronSuite{})
+
+func (s *CronSuite) TestParseCron(c *C) {
+	for _, spec := range []string{"* * * * *", "30 19 * * *", "*/15 6-9 1,15 jan-mar mon-fri", "0 0 * * 7", "0 0 29 feb *"} {
+		_, err := ParseCron(spec)
+		c.Check(err, IsNil, Commentf("%s", spec))
+	}
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "5-1 * * * *", "*/0 * * * *", "* * * foo *"} {
+		_, err := ParseCron(spec)
+		c.Check(err, NotNil, Commentf("%q", spec))
+	}
+}
+
+func (s *CronSuite) TestNext(c *C) {
+	// a Wednesday
+	base := time.Date(2020, 1, 1, 19, 30, 0, 0, time.UTC)
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", base.Add(time.Minute)},
+		{"30 19 * * *", base.AddDate(0, 0, 1)},
+		{"45 19 * * *", base.Add(time.Minute * 15)},
+		{"*/20 * * * *", base.Add(time.Minute * 10)},
+		{"0 7 * * sat,sun", time.Date(2020, 1, 4, 7, 0, 0, 0, time.UTC)},
+		{"0 7 * * 0", time.Date(2020, 1, 5, 7, 0, 0, 0, time.UTC)},
+		{"0 7 * * 7", time.Date(2020, 1, 5, 7, 0, 0, 0, time.UTC)},
+		{"0 0 1 mar *", time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// either the 10th or a Friday
+		{"0 0 10 * fri", time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 feb *", time.Time{}},
+	}
+	for _, test := range tests {
+		cron, err := ParseCron(test.spec)
+		c.Assert(err, IsNil)
+		c.Check(cron.Next(base), Equals, test.want, Commentf("%s", test.spec))
+	}
+	cron, _ := ParseCron("30 19 * * *")
+	c.Check(cron.Next(base.Add(-time.Second)), Equals, base)
+}
+
+func (s *CronSuite) TestJobNext(c *C) {
+	base := time.Date(2020, 1, 1, 19, 30, 0, 0, time.UTC)
+	job := &Job{At: &TimeOfDay{Hour: 19, Minute: 30}, Steps: []*JobStep{{Action: SchedulePause}}}
+	c.Assert(job.validate(), IsNil)
+	c.Check(job.Next(base.Add(-time.Second)), Equals, base)
+	c.Check(job.Next(base), Equals, base.AddDate(0, 0, 1))
+	job = &Job{Cron: "30 19 * * *", At: &TimeOfDay{Hour: 19, Minute: 30}, Steps: []*JobStep{{Action: SchedulePause}}}
+	c.Check(job.validate(), ErrorMatches, "job has both .*")
+	job = &Job{At: &TimeOfDay{Hour: 19, Minute: 30}, Steps: []*JobStep{{Action: ScheduleVolume}}}
+	c.Check(job.validate(), ErrorMatches, "step 1: volume needs .*")
+}
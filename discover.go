@@ -0,0 +1,429 @@
+package jooki
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type DiscoveryInfo struct {
+	Hostname string `json:"Hostname"`
+	ID string `json:"Id"`
+	IP string `json:"Ip"`
+	State string `json:"State"`
+}
+
+type DiscoveryPingInfo struct {
+	Version string `json:"version"`
+}
+
+type JookiIP struct {
+	Address string `json:"address"`
+	Ping string `json:"ping"`
+}
+
+type JookiInfo struct {
+	Label string `json:"label"`
+	IP *JookiIP `json:"ip"`
+	Live string `json:"live"`
+	Version string `json:"version"`
+}
+
+type ConnectPayload struct {
+	Jooki *JookiInfo `json:"jooki"`
+}
+
+var (
+	// how long to wait for each host to answer /ping during a local scan
+	LocalPingTimeout = time.Millisecond * 750
+	// how many hosts to probe at once during a local scan
+	LocalScanConcurrency = 64
+	// smallest subnet (as a prefix length) that will be scanned; larger
+	// networks are narrowed to this size around the local address
+	LocalScanMinPrefix = 22
+)
+
+// Discover asks the my.jooki.rocks discovery service for devices on the
+// local network and connects to the first one that responds.  If the
+// discovery service can't be reached or none of the devices it reports
+// respond, the local network is scanned instead.
+func Discover() (*Client, error) {
+	results, err := DiscoverAll()
+	if err != nil {
+		return nil, err
+	}
+	return connectFirst(results)
+}
+
+// DiscoverCloud finds a device using only the my.jooki.rocks discovery
+// service.
+func DiscoverCloud() (*Client, error) {
+	results, err := DiscoverCloudAll()
+	if err != nil {
+		return nil, err
+	}
+	return connectFirst(results)
+}
+
+// DiscoverLocal finds a device without any internet access by probing
+// every host on the locally attached IPv4 subnets for a jooki /ping
+// endpoint.
+func DiscoverLocal() (*Client, error) {
+	results, err := ScanLocalNetwork()
+	if err != nil {
+		return nil, err
+	}
+	return connectFirst(results)
+}
+
+// DiscoverDevice connects to the device whose ID, hostname or IP
+// address matches idOrHost.  The local network is scanned if the
+// my.jooki.rocks discovery service doesn't know of it, or it doesn't
+// respond at the address the service gives.
+func DiscoverDevice(idOrHost string) (*Client, error) {
+	results, cloudErr := DiscoverCloudAll()
+	res := FindDevice(results, idOrHost)
+	if res == nil || !res.Online() {
+		if cloudErr != nil {
+			log.Println("jooki cloud discovery failed, scanning local network:", cloudErr)
+		}
+		local, err := ScanLocalNetwork()
+		if err == nil {
+			if found := FindDevice(local, idOrHost); found != nil {
+				res = found
+			}
+		} else if res == nil {
+			if cloudErr != nil {
+				return nil, cloudErr
+			}
+			return nil, err
+		}
+	}
+	if res == nil {
+		return nil, fmt.Errorf("jooki device %s not found", idOrHost)
+	}
+	if res.Err != nil {
+		return nil, res.Err
+	}
+	return res.Connect()
+}
+
+// Connect skips discovery entirely and connects to the device at the
+// given hostname or IP address.
+func Connect(host string) (*Client, error) {
+	res := pingResult(&http.Client{Timeout: time.Second * 5}, &DiscoveryInfo{
+		Hostname: host,
+		IP: host,
+		State: "LIVE",
+	})
+	if res.Err != nil {
+		return nil, res.Err
+	}
+	return res.Connect()
+}
+
+type DiscoveryResult struct {
+	Device *DiscoveryInfo
+	Ping *DiscoveryPingInfo
+	Latency time.Duration
+	Err error
+}
+
+func (r *DiscoveryResult) Online() bool {
+	return r.Err == nil && r.Ping != nil
+}
+
+func (r *DiscoveryResult) Connect() (*Client, error) {
+	if !r.Online() {
+		return nil, fmt.Errorf("jooki device %s is not online", r.Device.IP)
+	}
+	return NewClient(r.Device, r.Ping)
+}
+
+// FindDevice picks the result whose device ID, hostname or IP address
+// matches idOrHost.  Hostnames are compared case-insensitively and with
+// or without a domain suffix.
+func FindDevice(results []*DiscoveryResult, idOrHost string) *DiscoveryResult {
+	want := strings.ToLower(strings.TrimSuffix(idOrHost, "."))
+	for _, res := range results {
+		dev := res.Device
+		if dev.ID != "" && dev.ID == idOrHost {
+			return res
+		}
+		if dev.IP == idOrHost {
+			return res
+		}
+		host := strings.ToLower(dev.Hostname)
+		if host == want || strings.SplitN(host, ".", 2)[0] == want {
+			return res
+		}
+	}
+	return nil
+}
+
+// DiscoverAll reports every device known to the my.jooki.rocks discovery
+// service along with the outcome of pinging it.  When the service is
+// unavailable or none of its devices respond, the results of a local
+// network scan are included as well.
+func DiscoverAll() ([]*DiscoveryResult, error) {
+	results, cloudErr := DiscoverCloudAll()
+	for _, res := range results {
+		if res.Online() {
+			return results, nil
+		}
+	}
+	if cloudErr != nil {
+		log.Println("jooki cloud discovery failed, scanning local network:", cloudErr)
+	}
+	local, err := ScanLocalNetwork()
+	if err != nil {
+		if cloudErr != nil {
+			return nil, cloudErr
+		}
+		return results, nil
+	}
+	return mergeResults(results, local), nil
+}
+
+// mergeResults adds the local scan results for devices the cloud results
+// don't already include.
+func mergeResults(results, local []*DiscoveryResult) []*DiscoveryResult {
+	seen := map[string]bool{}
+	for _, res := range results {
+		seen[res.Device.IP] = true
+	}
+	for _, res := range local {
+		if !seen[res.Device.IP] {
+			results = append(results, res)
+		}
+	}
+	return results
+}
+
+// DiscoverCloudAll reports every device known to the my.jooki.rocks
+// discovery service along with the outcome of pinging it.
+func DiscoverCloudAll() ([]*DiscoveryResult, error) {
+	hc := &http.Client{Timeout: time.Second * 10}
+	devices, err := discoverCloud(hc)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*DiscoveryResult, len(devices))
+	wg := &sync.WaitGroup{}
+	for i, device := range devices {
+		wg.Add(1)
+		go func(i int, device *DiscoveryInfo) {
+			defer wg.Done()
+			results[i] = pingResult(hc, device)
+		}(i, device)
+	}
+	wg.Wait()
+	return results, nil
+}
+
+func connectFirst(results []*DiscoveryResult) (*Client, error) {
+	if len(results) == 0 {
+		return nil, errors.New("no jooki devices found")
+	}
+	for _, res := range results {
+		if res.Online() {
+			return res.Connect()
+		}
+	}
+	return nil, errors.New("no jooki devices online")
+}
+
+func pingResult(hc *http.Client, device *DiscoveryInfo) *DiscoveryResult {
+	t := time.Now()
+	dpi, err := pingDevice(hc, device.IP)
+	return &DiscoveryResult{
+		Device: device,
+		Ping: dpi,
+		Latency: time.Since(t),
+		Err: err,
+	}
+}
+
+func discoverCloud(hc *http.Client) ([]*DiscoveryInfo, error) {
+	u := &url.URL{
+		Scheme: "https",
+		Host: "my.jooki.rocks",
+		Path: "/api/discover/v2/local_jooki",
+		RawQuery: strconv.FormatFloat(rand.Float64(), 'f', -1, 64),
+	}
+	res, err := hc.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d error in jooki device discovery", res.StatusCode)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	devices := []*DiscoveryInfo{}
+	err = json.Unmarshal(body, &devices)
+	if err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+func pingDevice(hc *http.Client, host string) (*DiscoveryPingInfo, error) {
+	u := &url.URL{
+		Scheme: "http",
+		Host: host,
+		Path: "/ping",
+		RawQuery: strconv.FormatFloat(rand.Float64(), 'f', -1, 64),
+	}
+	res, err := hc.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d error pinging jooki at %s", res.StatusCode, host)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	dpi := &DiscoveryPingInfo{}
+	err = json.Unmarshal(body, dpi)
+	if err != nil {
+		return nil, fmt.Errorf("bad jooki ping response from %s: %s", host, err)
+	}
+	return dpi, nil
+}
+
+// ScanLocalNetwork probes the locally attached IPv4 subnets for hosts
+// answering /ping with a jooki version string.  Only hosts that respond
+// are returned, in address order.
+func ScanLocalNetwork() ([]*DiscoveryResult, error) {
+	hosts, err := localScanHosts()
+	if err != nil {
+		return nil, err
+	}
+	return scanHosts(hosts), nil
+}
+
+func scanHosts(hosts []net.IP) []*DiscoveryResult {
+	hc := &http.Client{Timeout: LocalPingTimeout}
+	found := make([]*DiscoveryResult, len(hosts))
+	jobs := make(chan int)
+	wg := &sync.WaitGroup{}
+	workers := LocalScanConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				ip := hosts[idx].String()
+				res := pingResult(hc, &DiscoveryInfo{IP: ip, State: "LIVE"})
+				if !res.Online() || res.Ping.Version == "" {
+					continue
+				}
+				res.Device.Hostname = lookupHostname(ip)
+				found[idx] = res
+			}
+		}()
+	}
+	for i := range hosts {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	results := []*DiscoveryResult{}
+	for _, res := range found {
+		if res != nil {
+			results = append(results, res)
+		}
+	}
+	return results
+}
+
+func lookupHostname(ip string) string {
+	names, err := net.LookupAddr(ip)
+	if err != nil || len(names) == 0 {
+		return ip
+	}
+	return strings.TrimSuffix(names[0], ".")
+}
+
+func localScanHosts() ([]net.IP, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	hosts := []net.IP{}
+	for _, iface := range ifaces {
+		if iface.Flags & net.FlagUp == 0 || iface.Flags & net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			for _, ip := range subnetHosts(ipnet, LocalScanMinPrefix) {
+				key := ip.String()
+				if !seen[key] {
+					seen[key] = true
+					hosts = append(hosts, ip)
+				}
+			}
+		}
+	}
+	return hosts, nil
+}
+
+// subnetHosts lists the usable host addresses on an IPv4 network,
+// excluding the local address itself.  Networks wider than minPrefix
+// are narrowed to a minPrefix network containing the local address.
+func subnetHosts(ipnet *net.IPNet, minPrefix int) []net.IP {
+	ip4 := ipnet.IP.To4()
+	if ip4 == nil {
+		return nil
+	}
+	ones, bits := ipnet.Mask.Size()
+	if bits != 32 || ones >= 31 {
+		return nil
+	}
+	if ones < minPrefix {
+		ones = minPrefix
+	}
+	mask := net.CIDRMask(ones, 32)
+	base := ip4.Mask(mask)
+	start := uint32(base[0]) << 24 | uint32(base[1]) << 16 | uint32(base[2]) << 8 | uint32(base[3])
+	count := uint32(1) << uint(32 - ones)
+	hosts := make([]net.IP, 0, count - 2)
+	for i := uint32(1); i < count - 1; i++ {
+		n := start + i
+		ip := net.IPv4(byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)).To4()
+		if ip.Equal(ip4) {
+			continue
+		}
+		hosts = append(hosts, ip)
+	}
+	return hosts
+}
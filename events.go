@@ -0,0 +1,447 @@
+package jooki
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+)
+
+type EventType int
+
+const (
+	EventTrackChanged = EventType(iota)
+	EventPlaybackStateChanged
+	EventVolumeChanged
+	EventBatteryChanged
+	EventTokenPlaced
+	EventTokenRemoved
+	EventLibraryChanged
+	EventConnectionLost
+	EventConnectionRestored
+	EventUnknownTokenPlaced
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventTrackChanged:
+		return "track changed"
+	case EventPlaybackStateChanged:
+		return "playback state changed"
+	case EventVolumeChanged:
+		return "volume changed"
+	case EventBatteryChanged:
+		return "battery changed"
+	case EventTokenPlaced:
+		return "token placed"
+	case EventTokenRemoved:
+		return "token removed"
+	case EventLibraryChanged:
+		return "library changed"
+	case EventConnectionLost:
+		return "connection lost"
+	case EventConnectionRestored:
+		return "connection restored"
+	case EventUnknownTokenPlaced:
+		return "unknown token placed"
+	}
+	return "unknown"
+}
+
+// Event is implemented by each of the *Event types below.  Use a type
+// switch to get at the details.
+type Event interface {
+	Type() EventType
+}
+
+type TrackChangedEvent struct {
+	Before *NowPlaying
+	After *NowPlaying
+}
+
+func (e *TrackChangedEvent) Type() EventType {
+	return EventTrackChanged
+}
+
+type PlaybackStateEvent struct {
+	Before string
+	After string
+	Playback *Playback
+}
+
+func (e *PlaybackStateEvent) Type() EventType {
+	return EventPlaybackStateChanged
+}
+
+type VolumeEvent struct {
+	Before int
+	After int
+}
+
+func (e *VolumeEvent) Type() EventType {
+	return EventVolumeChanged
+}
+
+type BatteryEvent struct {
+	Before *Power
+	After *Power
+}
+
+func (e *BatteryEvent) Type() EventType {
+	return EventBatteryChanged
+}
+
+// TokenEvent reports a token being placed on or removed from the device.
+// A placed token is unknown if no playlist is assigned to its star, for
+// instance a new figurine, which an application might offer to assign.
+type TokenEvent struct {
+	Placed bool
+	// the token placed, or the one removed
+	NFC *NFC
+	// the token's entry in the library, if any
+	Token *Token
+	// the playlist assigned to the token's star, if any
+	Playlist *Playlist
+}
+
+func (e *TokenEvent) Type() EventType {
+	if !e.Placed {
+		return EventTokenRemoved
+	}
+	if e.Playlist == nil {
+		return EventUnknownTokenPlaced
+	}
+	return EventTokenPlaced
+}
+
+// StarID is the star of the token placed or removed, if it's known.
+func (e *TokenEvent) StarID() string {
+	if e.NFC != nil && e.NFC.StarID != "" {
+		return e.NFC.StarID
+	}
+	if e.Token != nil {
+		return e.Token.StarID
+	}
+	return ""
+}
+
+type LibraryChangedEvent struct {
+	Before *Library
+	After *Library
+}
+
+func (e *LibraryChangedEvent) Type() EventType {
+	return EventLibraryChanged
+}
+
+type ConnectionEvent struct {
+	Status ConnectionStatus
+	Err error
+}
+
+func (e *ConnectionEvent) Type() EventType {
+	if e.Status == StatusConnected {
+		return EventConnectionRestored
+	}
+	return EventConnectionLost
+}
+
+// StateEvents works out which events a state update represents by
+// comparing the state before and after it was applied.
+func StateEvents(update *StateUpdate) []Event {
+	return stateEvents(update, true)
+}
+
+// touchesLibrary reports whether a state delta includes the library, so
+// that the much more common deltas that don't can skip comparing it.
+func touchesLibrary(payload []byte) bool {
+	delta := &struct {
+		Library json.RawMessage `json:"db"`
+	}{}
+	json.Unmarshal(payload, delta)
+	return len(delta.Library) > 0
+}
+
+func stateEvents(update *StateUpdate, library bool) []Event {
+	before := update.Before
+	after := update.After
+	if before == nil {
+		before = &JookiState{}
+	}
+	if after == nil {
+		after = &JookiState{}
+	}
+	events := []Event{}
+	var npBefore, npAfter *NowPlaying
+	var pbBefore, pbAfter *Playback
+	var cfgBefore, cfgAfter *AudioConfig
+	if before.Audio != nil {
+		npBefore = before.Audio.NowPlaying
+		pbBefore = before.Audio.Playback
+		cfgBefore = before.Audio.Config
+	}
+	if after.Audio != nil {
+		npAfter = after.Audio.NowPlaying
+		pbAfter = after.Audio.Playback
+		cfgAfter = after.Audio.Config
+	}
+	if trackKey(npBefore) != trackKey(npAfter) {
+		events = append(events, &TrackChangedEvent{Before: npBefore, After: npAfter})
+	}
+	stBefore, stAfter := "", ""
+	if pbBefore != nil {
+		stBefore = pbBefore.State
+	}
+	if pbAfter != nil {
+		stAfter = pbAfter.State
+	}
+	if stBefore != stAfter {
+		events = append(events, &PlaybackStateEvent{Before: stBefore, After: stAfter, Playback: pbAfter})
+	}
+	if cfgAfter != nil && (cfgBefore == nil || cfgBefore.Volume != cfgAfter.Volume) {
+		vol := 0
+		if cfgBefore != nil {
+			vol = int(cfgBefore.Volume)
+		}
+		events = append(events, &VolumeEvent{Before: vol, After: int(cfgAfter.Volume)})
+	}
+	if batteryKey(before.Power) != batteryKey(after.Power) {
+		events = append(events, &BatteryEvent{Before: before.Power, After: after.Power})
+	}
+	if nfcKey(before.NFC) != nfcKey(after.NFC) {
+		if !before.NFC.Empty() {
+			events = append(events, newTokenEvent(false, before.NFC, after.Library))
+		}
+		if !after.NFC.Empty() {
+			events = append(events, newTokenEvent(true, after.NFC, after.Library))
+		}
+	}
+	if library && !reflect.DeepEqual(before.Library, after.Library) {
+		events = append(events, &LibraryChangedEvent{Before: before.Library, After: after.Library})
+	}
+	return events
+}
+
+func trackKey(np *NowPlaying) string {
+	if np == nil {
+		return ""
+	}
+	key := ""
+	if np.PlaylistID != nil {
+		key = *np.PlaylistID
+	}
+	key += "/"
+	if np.TrackID != nil {
+		key += *np.TrackID
+	} else if np.URI != nil {
+		key += *np.URI
+	}
+	return key
+}
+
+type batteryState struct {
+	percent int
+	charging bool
+	connected bool
+}
+
+func batteryKey(p *Power) batteryState {
+	if p == nil {
+		return batteryState{percent: -1}
+	}
+	key := batteryState{percent: -1, charging: p.Charging, connected: p.Connected}
+	if p.Level != nil {
+		key.percent = p.Level.P
+	}
+	return key
+}
+
+func nfcKey(nfc *NFC) NFC {
+	if nfc == nil {
+		return NFC{}
+	}
+	return *nfc
+}
+
+func newTokenEvent(placed bool, nfc *NFC, lib *Library) *TokenEvent {
+	e := &TokenEvent{Placed: placed, NFC: nfc}
+	if lib != nil {
+		e.Token = lib.Tokens[nfc.TokenID]
+		e.Playlist = lib.StarPlaylist(e.StarID())
+	}
+	return e
+}
+
+type OverflowPolicy int
+
+const (
+	// discard events that arrive while the buffer is full
+	OverflowDropNewest = OverflowPolicy(iota)
+	// discard the oldest buffered event to make room
+	OverflowDropOldest
+	// wait for the subscriber to make room.  This stalls delivery of
+	// state updates to the whole client, so subscribers using it must
+	// keep up.
+	OverflowBlock
+)
+
+type SubscribeOptions struct {
+	// event types to deliver; all types if empty
+	Types []EventType
+	// channel capacity; defaults to 100
+	BufferSize int
+	Overflow OverflowPolicy
+}
+
+type Subscription struct {
+	c *Client
+	id int
+	ch chan Event
+	done chan bool
+	types map[EventType]bool
+	overflow OverflowPolicy
+	locker *sync.Mutex
+	dropped int
+	closed bool
+	inflight *sync.WaitGroup
+}
+
+func (c *Client) Subscribe(opts *SubscribeOptions) (*Subscription, error) {
+	if opts == nil {
+		opts = &SubscribeOptions{}
+	}
+	if c.Closed() {
+		return nil, errors.New("jooki client is closed")
+	}
+	size := opts.BufferSize
+	if size <= 0 {
+		size = 100
+	}
+	s := &Subscription{
+		c: c,
+		ch: make(chan Event, size),
+		done: make(chan bool),
+		overflow: opts.Overflow,
+		locker: &sync.Mutex{},
+		inflight: &sync.WaitGroup{},
+	}
+	if len(opts.Types) > 0 {
+		s.types = map[EventType]bool{}
+		for _, t := range opts.Types {
+			s.types[t] = true
+		}
+	}
+	c.subLocker.Lock()
+	defer c.subLocker.Unlock()
+	id := len(c.subscribers)
+	for {
+		_, ok := c.subscribers[id]
+		if !ok {
+			break
+		}
+		id += 1
+	}
+	s.id = id
+	c.subscribers[id] = s
+	return s, nil
+}
+
+func (s *Subscription) Events() <-chan Event {
+	return s.ch
+}
+
+// Dropped reports how many events have been discarded because the
+// subscriber wasn't keeping up.
+func (s *Subscription) Dropped() int {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	return s.dropped
+}
+
+func (s *Subscription) Close() {
+	s.c.subLocker.Lock()
+	delete(s.c.subscribers, s.id)
+	s.c.subLocker.Unlock()
+	s.locker.Lock()
+	if s.closed {
+		s.locker.Unlock()
+		return
+	}
+	s.closed = true
+	// wake up any blocked delivery before closing the channel
+	close(s.done)
+	s.locker.Unlock()
+	s.inflight.Wait()
+	close(s.ch)
+}
+
+func (s *Subscription) deliver(ev Event) {
+	if s.types != nil && !s.types[ev.Type()] {
+		return
+	}
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.ch <- ev:
+		return
+	default:
+	}
+	switch s.overflow {
+	case OverflowDropOldest:
+		select {
+		case <-s.ch:
+			s.dropped += 1
+		default:
+		}
+		select {
+		case s.ch <- ev:
+		default:
+			s.dropped += 1
+		}
+	case OverflowBlock:
+		s.inflight.Add(1)
+		s.locker.Unlock()
+		select {
+		case s.ch <- ev:
+			s.locker.Lock()
+		case <-s.done:
+			s.locker.Lock()
+			s.dropped += 1
+		}
+		s.inflight.Done()
+	default:
+		s.dropped += 1
+	}
+}
+
+func (c *Client) dispatchEvents(events []Event) {
+	if len(events) == 0 {
+		return
+	}
+	c.subLocker.RLock()
+	subs := make([]*Subscription, 0, len(c.subscribers))
+	for _, s := range c.subscribers {
+		subs = append(subs, s)
+	}
+	c.subLocker.RUnlock()
+	for _, s := range subs {
+		for _, ev := range events {
+			s.deliver(ev)
+		}
+	}
+}
+
+func (c *Client) cleanupSubscribers() {
+	c.subLocker.RLock()
+	subs := make([]*Subscription, 0, len(c.subscribers))
+	for _, s := range c.subscribers {
+		subs = append(subs, s)
+	}
+	c.subLocker.RUnlock()
+	for _, s := range subs {
+		s.Close()
+	}
+}
@@ -0,0 +1,172 @@
+package jooki
+
+import (
+	"encoding/json"
+	"sync"
+
+	. "gopkg.in/check.v1"
+)
+
+type EventsSuite struct {}
+var _ = Suite(&EventsSuite{})
+
+func strp(s string) *string {
+	return &s
+}
+
+func (s *EventsSuite) TestStateEvents(c *C) {
+	before := &JookiState{
+		Audio: &Audio{
+			Config: &AudioConfig{Volume: 30},
+			NowPlaying: &NowPlaying{PlaylistID: strp("pl1"), TrackID: strp("tr1")},
+			Playback: &Playback{State: PlaybackStatePaused},
+		},
+		Power: &Power{Level: &PowerLevel{P: 80}},
+	}
+	after := before.Clone()
+	after.Audio.Config.Volume = 40
+	after.Audio.NowPlaying.TrackID = strp("tr2")
+	after.Audio.Playback.State = PlaybackStatePlaying
+	events := StateEvents(&StateUpdate{Before: before, After: after})
+	c.Assert(events, HasLen, 3)
+	c.Check(events[0].Type(), Equals, EventTrackChanged)
+	c.Check(*events[0].(*TrackChangedEvent).After.TrackID, Equals, "tr2")
+	c.Check(events[1].(*PlaybackStateEvent).After, Equals, PlaybackStatePlaying)
+	c.Check(events[2].(*VolumeEvent).Before, Equals, 30)
+	c.Check(events[2].(*VolumeEvent).After, Equals, 40)
+
+	after = before.Clone()
+	after.Power.Level.P = 79
+	after.Library = &Library{Playlists: map[string]*Playlist{"pl1": &Playlist{Name: "x"}}}
+	events = StateEvents(&StateUpdate{Before: before, After: after})
+	c.Assert(events, HasLen, 2)
+	c.Check(events[0].Type(), Equals, EventBatteryChanged)
+	c.Check(events[1].Type(), Equals, EventLibraryChanged)
+
+	c.Check(StateEvents(&StateUpdate{Before: before, After: before.Clone()}), HasLen, 0)
+	// the library is only compared when the delta touched it
+	other := after.Clone()
+	other.Library.Playlists["pl1"].Name = "y"
+	c.Check(stateEvents(&StateUpdate{Before: after, After: other}, false), HasLen, 0)
+	c.Check(stateEvents(&StateUpdate{Before: after, After: other}, true), HasLen, 1)
+}
+
+func (s *EventsSuite) TestTouchesLibrary(c *C) {
+	c.Check(touchesLibrary([]byte(`{"db":{"playlists":{"pl1":null}}}`)), Equals, true)
+	c.Check(touchesLibrary([]byte(`{"db":null}`)), Equals, true)
+	c.Check(touchesLibrary([]byte(`{"audio":{"playback":{"position_ms":1000}}}`)), Equals, false)
+	c.Check(touchesLibrary([]byte(`{"audio":`)), Equals, false)
+}
+
+func (s *EventsSuite) TestTokenEvents(c *C) {
+	star := "STAR_1"
+	lib := &Library{
+		Playlists: map[string]*Playlist{"pl1": &Playlist{ID: strp("pl1"), Name: "Bedtime", Token: &star, Tracks: []string{}}},
+		Tokens: map[string]*Token{"tag1": &Token{ID: strp("tag1"), Seen: 1612137600, StarID: star}},
+	}
+	before := &JookiState{Library: lib, NFC: &NFC{}}
+	after := before.Clone()
+	after.NFC = &NFC{TokenID: "tag1", StarID: star}
+	events := StateEvents(&StateUpdate{Before: before, After: after})
+	c.Assert(events, HasLen, 1)
+	c.Check(events[0].Type(), Equals, EventTokenPlaced)
+	e := events[0].(*TokenEvent)
+	c.Check(e.StarID(), Equals, star)
+	c.Check(*e.Token.ID, Equals, "tag1")
+	c.Check(e.Playlist.Name, Equals, "Bedtime")
+
+	// straight from one token to another
+	other := after.Clone()
+	other.NFC = &NFC{TokenID: "tag2", StarID: "STAR_2"}
+	events = StateEvents(&StateUpdate{Before: after, After: other})
+	c.Assert(events, HasLen, 2)
+	c.Check(events[0].Type(), Equals, EventTokenRemoved)
+	c.Check(events[0].(*TokenEvent).NFC.TokenID, Equals, "tag1")
+	c.Check(events[1].Type(), Equals, EventUnknownTokenPlaced)
+	c.Check(events[1].(*TokenEvent).Token, IsNil)
+
+	events = StateEvents(&StateUpdate{Before: other, After: before})
+	c.Assert(events, HasLen, 1)
+	c.Check(events[0].Type(), Equals, EventTokenRemoved)
+	c.Check(events[0].(*TokenEvent).StarID(), Equals, "STAR_2")
+
+	// no nfc and an empty one are the same
+	after = before.Clone()
+	after.NFC = nil
+	c.Check(StateEvents(&StateUpdate{Before: before, After: after}), HasLen, 0)
+}
+
+func (s *EventsSuite) TestNFCJSON(c *C) {
+	for data, nfc := range map[string]NFC{
+		`[]`: NFC{},
+		`{}`: NFC{},
+		`{"token":"tag1","starId":"STAR_1"}`: NFC{TokenID: "tag1", StarID: "STAR_1"},
+		`{"token":"tag1"}`: NFC{TokenID: "tag1"},
+	} {
+		v := &NFC{}
+		c.Check(json.Unmarshal([]byte(data), v), IsNil)
+		c.Check(*v, Equals, nfc)
+	}
+	c.Check(json.Unmarshal([]byte(`3`), &NFC{}), NotNil)
+	c.Check(json.Unmarshal([]byte(`"tag1"`), &NFC{}), NotNil)
+	data, err := json.Marshal(&NFC{})
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, `[]`)
+	data, err = json.Marshal(&NFC{TokenID: "tag1", StarID: "STAR_1"})
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, `{"token":"tag1","starId":"STAR_1"}`)
+}
+
+func newTestClient() *Client {
+	return &Client{
+		connLocker: &sync.RWMutex{},
+		subLocker: &sync.RWMutex{},
+		subscribers: map[int]*Subscription{},
+	}
+}
+
+func (s *EventsSuite) TestOverflow(c *C) {
+	client := newTestClient()
+	newest, err := client.Subscribe(&SubscribeOptions{BufferSize: 2})
+	c.Assert(err, IsNil)
+	oldest, err := client.Subscribe(&SubscribeOptions{BufferSize: 2, Overflow: OverflowDropOldest})
+	c.Assert(err, IsNil)
+	vols, err := client.Subscribe(&SubscribeOptions{Types: []EventType{EventVolumeChanged}})
+	c.Assert(err, IsNil)
+	for i := 1; i <= 3; i++ {
+		client.dispatchEvents([]Event{&VolumeEvent{After: i}})
+	}
+	client.dispatchEvents([]Event{&ConnectionEvent{Status: StatusReconnecting}})
+	c.Check(newest.Dropped(), Equals, 2)
+	c.Check((<-newest.Events()).(*VolumeEvent).After, Equals, 1)
+	c.Check((<-newest.Events()).(*VolumeEvent).After, Equals, 2)
+	c.Check(oldest.Dropped(), Equals, 2)
+	c.Check((<-oldest.Events()).(*VolumeEvent).After, Equals, 3)
+	c.Check((<-oldest.Events()).Type(), Equals, EventConnectionLost)
+	c.Check(vols.Dropped(), Equals, 0)
+	c.Check(len(vols.Events()), Equals, 3)
+	vols.Close()
+	c.Check(client.subscribers, HasLen, 2)
+	client.cleanupSubscribers()
+	_, ok := <-newest.Events()
+	c.Check(ok, Equals, false)
+	c.Check(client.subscribers, HasLen, 0)
+}
+
+func (s *EventsSuite) TestBlockingClose(c *C) {
+	client := newTestClient()
+	sub, err := client.Subscribe(&SubscribeOptions{BufferSize: 1, Overflow: OverflowBlock})
+	c.Assert(err, IsNil)
+	client.dispatchEvents([]Event{&VolumeEvent{After: 1}})
+	done := make(chan bool)
+	go func() {
+		client.dispatchEvents([]Event{&VolumeEvent{After: 2}})
+		close(done)
+	}()
+	sub.Close()
+	<-done
+	_, ok := <-sub.Events()
+	c.Check(ok, Equals, true)
+	_, ok = <-sub.Events()
+	c.Check(ok, Equals, false)
+}
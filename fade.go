@@ -0,0 +1,148 @@
+package jooki
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// FadeInterval is the least time between volume changes in a fade.
+var FadeInterval = time.Millisecond * 200
+
+// ErrFadeInterrupted is returned when the volume is changed by something
+// else, e.g. the knob on the device, part way through a fade.
+var ErrFadeInterrupted = errors.New("volume changed during fade")
+
+type FadeOptions struct {
+	// pause when the fade is done
+	Pause bool
+	// set the volume back to where it started when the fade is done,
+	// after pausing, so that whatever plays next isn't silent
+	Restore bool
+	// the volume to restore, if not the one the fade started from
+	RestoreVolume *int
+	// least time between volume changes; defaults to FadeInterval
+	Interval time.Duration
+}
+
+// FadeVolume changes the volume to target gradually over d.
+func (c *Client) FadeVolume(target int, d time.Duration) (*Audio, error) {
+	return c.FadeVolumeContext(context.Background(), target, d, nil)
+}
+
+// FadeOut fades the volume to 0 over d and then pauses, optionally
+// restoring the volume afterwards.
+func (c *Client) FadeOut(d time.Duration, restore bool) (*Audio, error) {
+	return c.FadeOutContext(context.Background(), d, restore)
+}
+
+func (c *Client) FadeOutContext(ctx context.Context, d time.Duration, restore bool) (*Audio, error) {
+	return c.FadeVolumeContext(ctx, 0, d, &FadeOptions{Pause: true, Restore: restore})
+}
+
+// FadeVolumeContext changes the volume to target gradually over d, one
+// step at a time.  Each step waits for the device to confirm it before
+// the next is sent, so if the device is slow, steps are skipped rather
+// than queued up.  Cancelling ctx stops the fade where it is, without
+// pausing or restoring the volume.
+func (c *Client) FadeVolumeContext(ctx context.Context, target int, d time.Duration, opts *FadeOptions) (*Audio, error) {
+	if target < 0 || target > 100 {
+		return nil, fmt.Errorf("bad volume %d", target)
+	}
+	if opts == nil {
+		opts = &FadeOptions{}
+	}
+	interval := opts.Interval
+	if interval <= 0 {
+		interval = FadeInterval
+	}
+	from, ok := c.volume()
+	if !ok {
+		return nil, errors.New("jooki audio state not loaded")
+	}
+	clock := c.Clock()
+	start := clock.Now()
+	stepped := start
+	delta := target - from
+	steps := delta
+	if steps < 0 {
+		steps = -steps
+	}
+	last := from
+	var audio *Audio
+	var err error
+	for last != target {
+		vol := target
+		if elapsed := clock.Now().Sub(start); elapsed < d {
+			vol = from + int(int64(delta) * int64(elapsed) / int64(d))
+		}
+		if vol != last {
+			if cur, ok := c.volume(); ok && cur != last {
+				return nil, ErrFadeInterrupted
+			}
+			audio, err = c.setVolumeStep(ctx, vol)
+			if err != nil {
+				return nil, err
+			}
+			last = vol
+			if last == target {
+				break
+			}
+			stepped = clock.Now()
+		}
+		// wait until the volume is next due to change by a whole step
+		k := last - from
+		if k < 0 {
+			k = -k
+		}
+		next := start.Add(time.Duration(int64(d) * int64(k + 1) / int64(steps)))
+		if min := stepped.Add(interval); next.Before(min) {
+			next = min
+		}
+		timer := clock.NewTimer(next.Sub(clock.Now()))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C():
+		}
+	}
+	if opts.Pause {
+		pctx, cancel := context.WithTimeout(ctx, time.Second * 5)
+		audio, err = c.PauseContext(pctx)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+	}
+	restore := from
+	if opts.RestoreVolume != nil {
+		restore = *opts.RestoreVolume
+	}
+	if opts.Restore && restore != last {
+		audio, err = c.setVolumeStep(ctx, restore)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if audio == nil {
+		audio = c.GetState().Audio
+	}
+	return audio, nil
+}
+
+func (c *Client) setVolumeStep(ctx context.Context, vol int) (*Audio, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second * 5)
+	defer cancel()
+	return c.SetVolumeContext(ctx, vol)
+}
+
+// volume returns the current volume, and false if it isn't known.
+func (c *Client) volume() (int, bool) {
+	state := c.GetState()
+	if state == nil || state.Audio == nil || state.Audio.Config == nil {
+		return 0, false
+	}
+	return int(state.Audio.Config.Volume), true
+}
@@ -0,0 +1,91 @@
+package jooki
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// audioContentTypes covers the formats a jooki will play, since
+// mime.TypeByExtension depends on what's installed on the host.
+var audioContentTypes = map[string]string{
+	".mp3": "audio/mpeg",
+	".m4a": "audio/mp4",
+	".m4b": "audio/mp4",
+	".aac": "audio/aac",
+	".ogg": "audio/ogg",
+	".oga": "audio/ogg",
+	".opus": "audio/ogg",
+	".flac": "audio/flac",
+	".wav": "audio/wav",
+}
+
+// FileTrack is a TrackUpload backed by a file on disk.
+type FileTrack struct {
+	Path string
+	// how long the track is, if known, for checking the upload
+	Length time.Duration
+	md5 string
+	size int64
+}
+
+// NewFileTrack reads the file at path to compute its checksum.  The file
+// is read again when it's uploaded, so it shouldn't change in between.
+func NewFileTrack(path string) (*FileTrack, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := md5.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return nil, err
+	}
+	return &FileTrack{
+		Path: path,
+		md5: hex.EncodeToString(h.Sum(nil)),
+		size: size,
+	}, nil
+}
+
+func (t *FileTrack) ContentType() string {
+	ext := strings.ToLower(filepath.Ext(t.Path))
+	if ct, ok := audioContentTypes[ext]; ok {
+		return ct
+	}
+	if ct := mime.TypeByExtension(ext); ct != "" {
+		return ct
+	}
+	return "application/octet-stream"
+}
+
+func (t *FileTrack) FileName() string {
+	return filepath.Base(t.Path)
+}
+
+func (t *FileTrack) MD5() string {
+	return t.md5
+}
+
+// ID returns the ID the jooki will give the track once it's uploaded.
+func (t *FileTrack) ID() string {
+	return t.md5[:16]
+}
+
+func (t *FileTrack) Size() int64 {
+	return t.size
+}
+
+func (t *FileTrack) Duration() time.Duration {
+	return t.Length
+}
+
+func (t *FileTrack) Reader() (io.ReadCloser, error) {
+	return os.Open(t.Path)
+}
@@ -0,0 +1,126 @@
+package jooki
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// GCPlan lists the tracks on the device that no playlist refers to.
+// Deleting a playlist leaves its tracks behind, still taking up space,
+// so these are candidates for deletion.  Nothing is deleted until the
+// plan is applied.
+type GCPlan struct {
+	// sorted by title
+	Tracks []*Track
+	// bytes used by the tracks
+	Size int64
+}
+
+func NewGCPlan(lib *Library) (*GCPlan, error) {
+	if lib == nil {
+		return nil, errors.New("jooki library not loaded")
+	}
+	plan := &GCPlan{Tracks: lib.OrphanedTracks()}
+	for _, tr := range plan.Tracks {
+		if tr.Size != nil {
+			plan.Size += int64(*tr.Size)
+		}
+	}
+	return plan, nil
+}
+
+func (p *GCPlan) String() string {
+	if len(p.Tracks) == 0 {
+		return "no orphaned tracks"
+	}
+	lines := []string{}
+	for _, tr := range p.Tracks {
+		name := ""
+		if tr.Name != nil {
+			name = *tr.Name
+		}
+		lines = append(lines, fmt.Sprintf("delete %s (%s)", name, strOf(tr.ID)))
+	}
+	lines = append(lines, fmt.Sprintf("%d tracks, %d bytes", len(p.Tracks), p.Size))
+	return strings.Join(lines, "\n")
+}
+
+func (c *Client) PlanGC() (*GCPlan, error) {
+	return NewGCPlan(c.GetState().Library)
+}
+
+type GCResult struct {
+	Plan *GCPlan
+	// IDs of the tracks deleted
+	Deleted []string
+	// IDs of tracks that have been added to a playlist since the plan
+	// was made, which are left alone
+	Kept []string
+	// bytes freed by the deleted tracks
+	Freed int64
+}
+
+// CollectGarbage deletes the tracks that aren't on any playlist.
+func (c *Client) CollectGarbage() (*GCResult, error) {
+	return c.CollectGarbageContext(context.Background())
+}
+
+func (c *Client) CollectGarbageContext(ctx context.Context) (*GCResult, error) {
+	plan, err := c.PlanGC()
+	if err != nil {
+		return nil, err
+	}
+	return c.ApplyGCContext(ctx, plan)
+}
+
+// ApplyGC deletes the tracks in a GC plan one at a time, waiting for the
+// device to confirm each.  Each track is checked again just before it's
+// deleted, and kept if it's been added to a playlist in the meantime.
+// If some deletes fail the rest are still attempted, and an error is
+// returned along with the result.
+func (c *Client) ApplyGC(plan *GCPlan) (*GCResult, error) {
+	return c.ApplyGCContext(context.Background(), plan)
+}
+
+func (c *Client) ApplyGCContext(ctx context.Context, plan *GCPlan) (*GCResult, error) {
+	res := &GCResult{Plan: plan, Deleted: []string{}, Kept: []string{}}
+	failed := 0
+	var lastErr error
+	for _, tr := range plan.Tracks {
+		if tr.ID == nil {
+			continue
+		}
+		id := *tr.ID
+		lib := c.GetState().Library
+		if _, ok := lib.Tracks[id]; !ok {
+			// already gone
+			continue
+		}
+		if len(lib.PlaylistsWithTrack(id)) > 0 {
+			res.Kept = append(res.Kept, id)
+			continue
+		}
+		deleteCtx, cancel := context.WithTimeout(ctx, time.Second * 5)
+		err := c.DeleteTrackContext(deleteCtx, id)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return res, ctx.Err()
+			}
+			failed += 1
+			lastErr = err
+			continue
+		}
+		res.Deleted = append(res.Deleted, id)
+		if tr.Size != nil {
+			res.Freed += int64(*tr.Size)
+		}
+	}
+	if failed > 0 {
+		return res, fmt.Errorf("%d of %d deletes failed: %s", failed, len(plan.Tracks), lastErr)
+	}
+	return res, nil
+}
@@ -4,5 +4,6 @@ go 1.13
 
 require (
 	github.com/eclipse/paho.mqtt.golang v1.3.4
+	github.com/gorilla/websocket v1.4.2
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c
 )
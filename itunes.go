@@ -0,0 +1,269 @@
+package jooki
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"time"
+)
+
+// ITunesTrack is a track from an iTunes or Music.app library export.
+type ITunesTrack struct {
+	ID int
+	PersistentID string
+	Name string
+	Artist string
+	Album string
+	Kind string
+	// in bytes
+	Size uint64
+	// in milliseconds
+	TotalTime uint
+	// the file's path on the machine the library was exported from;
+	// empty for tracks that aren't stored locally, like Apple Music
+	// streams
+	Path string
+}
+
+// Search returns a TrackSearch for finding the track in a jooki library.
+func (t *ITunesTrack) Search() TrackSearch {
+	search := TrackSearch{}
+	if t.Name != "" {
+		search.Name = &t.Name
+	}
+	if t.Artist != "" {
+		search.Artist = &t.Artist
+	}
+	if t.Album != "" {
+		search.Album = &t.Album
+	}
+	if t.Size > 0 {
+		search.Size = &t.Size
+	}
+	if t.TotalTime > 0 {
+		search.TotalTime = &t.TotalTime
+	}
+	return search
+}
+
+// Upload returns a TrackUpload for the track's file.
+func (t *ITunesTrack) Upload() (*FileTrack, error) {
+	if t.Path == "" {
+		return nil, &os.PathError{Op: "open", Path: t.Name, Err: os.ErrNotExist}
+	}
+	track, err := NewFileTrack(t.Path)
+	if err != nil {
+		return nil, err
+	}
+	track.Length = time.Duration(t.TotalTime) * time.Millisecond
+	return track, nil
+}
+
+type ITunesPlaylist struct {
+	ID int
+	PersistentID string
+	ParentPersistentID string
+	Name string
+	// the playlist of the whole library
+	Master bool
+	// built-in playlists like Music, Movies and Podcasts
+	Distinguished bool
+	Folder bool
+	Smart bool
+	Tracks []*ITunesTrack
+}
+
+type ITunesLibrary struct {
+	MusicFolder string
+	Tracks map[int]*ITunesTrack
+	Playlists []*ITunesPlaylist
+}
+
+// LoadITunesLibrary reads an iTunes or Music.app library export (File >
+// Library > Export Library in Music.app, or the "iTunes Library.xml"
+// iTunes keeps alongside its database).
+func LoadITunesLibrary(fn string) (*ITunesLibrary, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadITunesLibrary(f)
+}
+
+func ReadITunesLibrary(r io.Reader) (*ITunesLibrary, error) {
+	pl, err := readPlist(r)
+	if err != nil {
+		return nil, err
+	}
+	doc, ok := pl.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("not an itunes library")
+	}
+	lib := &ITunesLibrary{
+		MusicFolder: locationPath(plistString(doc, "Music Folder")),
+		Tracks: map[int]*ITunesTrack{},
+		Playlists: []*ITunesPlaylist{},
+	}
+	tracks, _ := doc["Tracks"].(map[string]interface{})
+	for _, v := range tracks {
+		t, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		tr := &ITunesTrack{
+			ID: int(plistInt(t, "Track ID")),
+			PersistentID: plistString(t, "Persistent ID"),
+			Name: plistString(t, "Name"),
+			Artist: plistString(t, "Artist"),
+			Album: plistString(t, "Album"),
+			Kind: plistString(t, "Kind"),
+			Size: uint64(plistInt(t, "Size")),
+			TotalTime: uint(plistInt(t, "Total Time")),
+			Path: locationPath(plistString(t, "Location")),
+		}
+		lib.Tracks[tr.ID] = tr
+	}
+	playlists, _ := doc["Playlists"].([]interface{})
+	for _, v := range playlists {
+		p, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		pl := &ITunesPlaylist{
+			ID: int(plistInt(p, "Playlist ID")),
+			PersistentID: plistString(p, "Playlist Persistent ID"),
+			ParentPersistentID: plistString(p, "Parent Persistent ID"),
+			Name: plistString(p, "Name"),
+			Master: plistBool(p, "Master"),
+			Distinguished: plistInt(p, "Distinguished Kind") != 0,
+			Folder: plistBool(p, "Folder"),
+			Smart: p["Smart Info"] != nil,
+			Tracks: []*ITunesTrack{},
+		}
+		items, _ := p["Playlist Items"].([]interface{})
+		for _, item := range items {
+			m, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if tr, ok := lib.Tracks[int(plistInt(m, "Track ID"))]; ok {
+				pl.Tracks = append(pl.Tracks, tr)
+			}
+		}
+		lib.Playlists = append(lib.Playlists, pl)
+	}
+	return lib, nil
+}
+
+// Playlist finds a playlist by name or persistent ID.  Folders and the
+// master library playlist are ignored.
+func (l *ITunesLibrary) Playlist(nameOrId string) *ITunesPlaylist {
+	for _, pl := range l.Playlists {
+		if pl.Master || pl.Folder {
+			continue
+		}
+		if pl.PersistentID == nameOrId || pl.Name == nameOrId {
+			return pl
+		}
+	}
+	return nil
+}
+
+func plistString(dict map[string]interface{}, key string) string {
+	s, _ := dict[key].(string)
+	return s
+}
+
+func plistInt(dict map[string]interface{}, key string) int64 {
+	i, _ := dict[key].(int64)
+	return i
+}
+
+func plistBool(dict map[string]interface{}, key string) bool {
+	b, _ := dict[key].(bool)
+	return b
+}
+
+var windowsDrive = regexp.MustCompile(`^/[A-Za-z]:/`)
+
+// locationPath converts the file:// URLs iTunes uses for locations into
+// paths.
+func locationPath(loc string) string {
+	if loc == "" {
+		return ""
+	}
+	u, err := url.Parse(loc)
+	if err != nil || u.Scheme != "file" {
+		return ""
+	}
+	if windowsDrive.MatchString(u.Path) {
+		return u.Path[1:]
+	}
+	return u.Path
+}
+
+// NewITunesSyncPlan works out how to make a playlist in lib match an
+// iTunes playlist.  Tracks are looked up by checksum first, so tracks
+// already on the device are reused even if they were uploaded from
+// somewhere else, and failing that matched with FindTrack using their
+// iTunes metadata.
+func NewITunesSyncPlan(lib *Library, playlistId string, pl *ITunesPlaylist) (*SyncPlan, error) {
+	files := make([]string, len(pl.Tracks))
+	for i, tr := range pl.Tracks {
+		files[i] = tr.Path
+		if files[i] == "" {
+			files[i] = tr.Name
+		}
+	}
+	return newSyncPlan(lib, playlistId, pl.Name, files, func(i int, lib *Library) (*Track, string, error) {
+		tr := pl.Tracks[i]
+		upload, err := tr.Upload()
+		if err != nil {
+			// not available locally, but it may be on the device already
+			if jtr := lib.FindTrack(tr.Search()); jtr != nil {
+				return jtr, *jtr.ID, nil
+			}
+			return nil, "", err
+		}
+		id := upload.ID()
+		if jtr, ok := lib.Tracks[id]; ok {
+			jtr = jtr.Clone()
+			jtr.ID = &id
+			return jtr, id, nil
+		}
+		if jtr := lib.FindTrack(tr.Search()); jtr != nil {
+			return jtr, *jtr.ID, nil
+		}
+		return nil, id, nil
+	})
+}
+
+// ImportITunesPlaylist copies an iTunes playlist to the jooki, creating a
+// jooki playlist with the same name if there isn't one already, and
+// returns the result of syncing it.  Tracks that aren't available
+// locally are skipped and listed in the plan's Missing files.
+func (c *Client) ImportITunesPlaylist(pl *ITunesPlaylist, opts *BulkUploadOptions) (*SyncResult, error) {
+	return c.ImportITunesPlaylistContext(context.Background(), pl, opts)
+}
+
+func (c *Client) ImportITunesPlaylistContext(ctx context.Context, pl *ITunesPlaylist, opts *BulkUploadOptions) (*SyncResult, error) {
+	fail := func(err error) (*SyncResult, error) {
+		if opts != nil && opts.Progress != nil {
+			close(opts.Progress)
+		}
+		return nil, err
+	}
+	playlistId, err := c.findOrCreatePlaylist(ctx, pl.Name)
+	if err != nil {
+		return fail(err)
+	}
+	plan, err := NewITunesSyncPlan(c.GetState().Library, playlistId, pl)
+	if err != nil {
+		return fail(err)
+	}
+	return c.ApplySyncContext(ctx, plan, opts)
+}
@@ -0,0 +1,82 @@
+package jooki
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+type ITunesSuite struct {}
+var _ = Suite(&ITunesSuite{})
+
+func (s *ITunesSuite) TestLoadLibrary(c *C) {
+	lib, err := LoadITunesLibrary("testdata/itunes/Library.xml")
+	c.Assert(err, IsNil)
+	c.Check(lib.MusicFolder, Equals, "/Users/kid/Music/Music/Media.localized/")
+	c.Assert(lib.Tracks, HasLen, 3)
+	tr := lib.Tracks[1021]
+	c.Check(tr.Name, Equals, "Let It Go")
+	c.Check(tr.Artist, Equals, "Idina Menzel")
+	c.Check(tr.Album, Equals, "Frozen (Original Motion Picture Soundtrack)")
+	c.Check(tr.Size, Equals, uint64(4839120))
+	c.Check(tr.TotalTime, Equals, uint(201560))
+	c.Check(tr.Path, Equals, "/Users/kid/Music/Music/Media.localized/Music/Various Artists/Frozen/03 Let It Go.mp3")
+	c.Check(lib.Tracks[1022].Path, Equals, "C:/Users/Kid/Music/iTunes/iTunes Media/Music/Pinkfong/Baby Shark.m4a")
+	c.Check(lib.Tracks[1023].Path, Equals, "")
+
+	c.Assert(lib.Playlists, HasLen, 4)
+	c.Check(lib.Playlists[0].Master, Equals, true)
+	c.Check(lib.Playlists[1].Distinguished, Equals, true)
+	c.Check(lib.Playlists[1].Smart, Equals, true)
+	c.Check(lib.Playlists[2].Folder, Equals, true)
+	c.Check(lib.Playlist("Library"), IsNil)
+	c.Check(lib.Playlist("Kids"), IsNil)
+	pl := lib.Playlist("Car Songs")
+	c.Assert(pl, NotNil)
+	c.Check(pl, Equals, lib.Playlist("8B8B8B8B8B8B8B8B"))
+	c.Check(pl.ParentPersistentID, Equals, "7A7A7A7A7A7A7A7A")
+	c.Assert(pl.Tracks, HasLen, 3)
+	c.Check(pl.Tracks[0], Equals, lib.Tracks[1022])
+	c.Check(pl.Tracks[2], Equals, lib.Tracks[1021])
+
+	search := tr.Search()
+	c.Check(*search.Name, Equals, "Let It Go")
+	c.Check(*search.Size, Equals, uint64(4839120))
+	c.Check(*search.TotalTime, Equals, uint(201560))
+	c.Check(search.JookiID, IsNil)
+	c.Check(lib.Tracks[1023].Search().Size, IsNil)
+}
+
+func (s *ITunesSuite) TestNotAPlist(c *C) {
+	_, err := ReadITunesLibrary(strings.NewReader("<html><body/></html>"))
+	c.Check(err, ErrorMatches, "not a plist.*")
+}
+
+func (s *ITunesSuite) TestSyncPlanPrefersChecksum(c *C) {
+	fn := filepath.Join(c.MkDir(), "Let It Go.mp3")
+	c.Assert(ioutil.WriteFile(fn, []byte("the cold never bothered me"), 0644), IsNil)
+	local, err := NewFileTrack(fn)
+	c.Assert(err, IsNil)
+	name, artist := "Let It Go", "Idina Menzel"
+	other := "Some Upload"
+	lib := &Library{
+		Playlists: map[string]*Playlist{"pl1": &Playlist{Tracks: []string{}}},
+		Tracks: map[string]*Track{
+			// the same title and artist, but not the same file
+			"0123456789abcdef": &Track{Name: &name, Artist: &artist},
+			local.ID(): &Track{Name: &other},
+		},
+	}
+	tr := &ITunesTrack{Name: name, Artist: artist, Path: fn}
+	plan, err := NewITunesSyncPlan(lib, "pl1", &ITunesPlaylist{Name: "Frozen", Tracks: []*ITunesTrack{tr}})
+	c.Assert(err, IsNil)
+	c.Check(plan.After, DeepEquals, []string{local.ID()})
+
+	// without a local copy, the metadata match is all there is
+	tr = &ITunesTrack{Name: name, Artist: artist}
+	plan, err = NewITunesSyncPlan(lib, "pl1", &ITunesPlaylist{Name: "Frozen", Tracks: []*ITunesTrack{tr}})
+	c.Assert(err, IsNil)
+	c.Check(plan.After, DeepEquals, []string{"0123456789abcdef"})
+}
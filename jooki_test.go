@@ -1,6 +1,7 @@
 package jooki
 
 import (
+	"net"
 	"testing"
 
 	. "gopkg.in/check.v1"
@@ -13,3 +14,29 @@ var _ = Suite(&JookiSuite{})
 func (a *JookiSuite) TestX(c *C) {
 	c.Check(true, Equals, true)
 }
+
+func (a *JookiSuite) TestSubnetHosts(c *C) {
+	_, ipnet, _ := net.ParseCIDR("192.168.1.0/24")
+	ipnet.IP = net.ParseIP("192.168.1.20")
+	hosts := subnetHosts(ipnet, 22)
+	c.Check(hosts, HasLen, 253)
+	c.Check(hosts[0].String(), Equals, "192.168.1.1")
+	c.Check(hosts[252].String(), Equals, "192.168.1.254")
+	_, ipnet, _ = net.ParseCIDR("10.0.0.0/8")
+	ipnet.IP = net.ParseIP("10.1.2.3")
+	hosts = subnetHosts(ipnet, 22)
+	c.Check(hosts, HasLen, 1021)
+	c.Check(hosts[0].String(), Equals, "10.1.0.1")
+}
+
+func (a *JookiSuite) TestFindDevice(c *C) {
+	results := []*DiscoveryResult{
+		&DiscoveryResult{Device: &DiscoveryInfo{Hostname: "jooki-kitchen.local", ID: "abc", IP: "10.0.0.5"}},
+		&DiscoveryResult{Device: &DiscoveryInfo{Hostname: "Jooki-Bedroom", ID: "def", IP: "10.0.0.6"}},
+	}
+	c.Check(FindDevice(results, "def"), Equals, results[1])
+	c.Check(FindDevice(results, "10.0.0.5"), Equals, results[0])
+	c.Check(FindDevice(results, "jooki-kitchen"), Equals, results[0])
+	c.Check(FindDevice(results, "jooki-bedroom"), Equals, results[1])
+	c.Check(FindDevice(results, "nope"), IsNil)
+}
@@ -0,0 +1,209 @@
+package jookitest
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/gorilla/websocket"
+)
+
+// broker is just enough of an MQTT 3.1.1 broker to stand in for the one
+// on a jooki: QoS 0 only, no retained messages and no persistent
+// sessions.
+type broker struct {
+	upgrader *websocket.Upgrader
+	locker *sync.Mutex
+	sessions map[*session]bool
+	onPublish func(topic string, payload []byte)
+}
+
+func newBroker(onPublish func(topic string, payload []byte)) *broker {
+	return &broker{
+		upgrader: &websocket.Upgrader{
+			Subprotocols: []string{"mqtt"},
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+		locker: &sync.Mutex{},
+		sessions: map[*session]bool{},
+		onPublish: onPublish,
+	}
+}
+
+func (b *broker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ws, err := b.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	s := &session{
+		ws: ws,
+		writeLocker: &sync.Mutex{},
+		subLocker: &sync.Mutex{},
+		subscriptions: map[string]bool{},
+	}
+	b.locker.Lock()
+	b.sessions[s] = true
+	b.locker.Unlock()
+	defer func() {
+		b.locker.Lock()
+		delete(b.sessions, s)
+		b.locker.Unlock()
+		ws.Close()
+	}()
+	b.serve(s)
+}
+
+func (b *broker) serve(s *session) {
+	r := &wsReader{ws: s.ws}
+	for {
+		cp, err := packets.ReadPacket(r)
+		if err != nil {
+			return
+		}
+		switch p := cp.(type) {
+		case *packets.ConnectPacket:
+			ack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+			ack.ReturnCode = packets.Accepted
+			s.write(ack)
+		case *packets.SubscribePacket:
+			ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			ack.MessageID = p.MessageID
+			s.subLocker.Lock()
+			for _, topic := range p.Topics {
+				s.subscriptions[topic] = true
+				ack.ReturnCodes = append(ack.ReturnCodes, 0)
+			}
+			s.subLocker.Unlock()
+			s.write(ack)
+		case *packets.UnsubscribePacket:
+			ack := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			ack.MessageID = p.MessageID
+			s.subLocker.Lock()
+			for _, topic := range p.Topics {
+				delete(s.subscriptions, topic)
+			}
+			s.subLocker.Unlock()
+			s.write(ack)
+		case *packets.PublishPacket:
+			if p.Qos == 1 {
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				s.write(ack)
+			}
+			b.publish(p.TopicName, p.Payload)
+			if b.onPublish != nil {
+				b.onPublish(p.TopicName, p.Payload)
+			}
+		case *packets.PingreqPacket:
+			s.write(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+func (b *broker) publish(topic string, payload []byte) {
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = topic
+	p.Payload = payload
+	b.locker.Lock()
+	sessions := make([]*session, 0, len(b.sessions))
+	for s := range b.sessions {
+		sessions = append(sessions, s)
+	}
+	b.locker.Unlock()
+	for _, s := range sessions {
+		if s.subscribed(topic) {
+			s.write(p)
+		}
+	}
+}
+
+// dropAll closes every client connection without an MQTT DISCONNECT, as
+// though the network had gone away.
+func (b *broker) dropAll() {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+	for s := range b.sessions {
+		s.ws.Close()
+	}
+}
+
+type session struct {
+	ws *websocket.Conn
+	writeLocker *sync.Mutex
+	subLocker *sync.Mutex
+	subscriptions map[string]bool
+}
+
+func (s *session) write(p packets.ControlPacket) {
+	buf := &bytes.Buffer{}
+	err := p.Write(buf)
+	if err != nil {
+		log.Println("can't encode mqtt packet:", err)
+		return
+	}
+	s.writeLocker.Lock()
+	defer s.writeLocker.Unlock()
+	s.ws.WriteMessage(websocket.BinaryMessage, buf.Bytes())
+}
+
+func (s *session) subscribed(topic string) bool {
+	s.subLocker.Lock()
+	defer s.subLocker.Unlock()
+	for filter := range s.subscriptions {
+		if topicMatch(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func topicMatch(filter, topic string) bool {
+	fparts := strings.Split(filter, "/")
+	tparts := strings.Split(topic, "/")
+	for i, f := range fparts {
+		if f == "#" {
+			return true
+		}
+		if i >= len(tparts) {
+			return false
+		}
+		if f != "+" && f != tparts[i] {
+			return false
+		}
+	}
+	return len(fparts) == len(tparts)
+}
+
+// wsReader presents the binary messages on a websocket as a continuous
+// stream, since MQTT packets may span message boundaries.
+type wsReader struct {
+	ws *websocket.Conn
+	r io.Reader
+}
+
+func (w *wsReader) Read(p []byte) (int, error) {
+	for {
+		if w.r == nil {
+			_, r, err := w.ws.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			w.r = r
+		}
+		n, err := w.r.Read(p)
+		if err == io.EOF {
+			w.r = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
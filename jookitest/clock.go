@@ -0,0 +1,123 @@
+package jookitest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rclancey/jooki"
+)
+
+// Clock is a jooki.Clock that only moves when told to, so that tests of
+// timed behaviour don't have to wait.
+type Clock struct {
+	locker *sync.Mutex
+	now time.Time
+	timers []*clockTimer
+	// closed and replaced whenever a timer is created
+	timerAdded chan bool
+}
+
+func NewClock(now time.Time) *Clock {
+	return &Clock{
+		locker: &sync.Mutex{},
+		now: now,
+		timers: []*clockTimer{},
+		timerAdded: make(chan bool),
+	}
+}
+
+func (c *Clock) Now() time.Time {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	return c.now
+}
+
+func (c *Clock) NewTimer(d time.Duration) jooki.Timer {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	t := &clockTimer{clock: c, when: c.now.Add(d), ch: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.ch <- c.now
+		t.fired = true
+	} else {
+		c.timers = append(c.timers, t)
+	}
+	close(c.timerAdded)
+	c.timerAdded = make(chan bool)
+	return t
+}
+
+// Advance moves the clock forward, firing any timers that come due on
+// the way, in order.
+func (c *Clock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+// Set moves the clock to a given time, firing any timers that come due.
+func (c *Clock) Set(now time.Time) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	sort.SliceStable(c.timers, func(i, j int) bool { return c.timers[i].when.Before(c.timers[j].when) })
+	pending := []*clockTimer{}
+	for _, t := range c.timers {
+		if t.when.After(now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.fired = true
+		t.ch <- t.when
+	}
+	c.timers = pending
+	c.now = now
+}
+
+// WaitForTimers waits until at least n timers are pending, so that a test
+// can be sure the code under test is waiting before it advances the
+// clock.  It reports false if that doesn't happen within the timeout.
+func (c *Clock) WaitForTimers(n int, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		c.locker.Lock()
+		count := len(c.timers)
+		added := c.timerAdded
+		c.locker.Unlock()
+		if count >= n {
+			return true
+		}
+		select {
+		case <-added:
+		case <-time.After(time.Millisecond * 10):
+			// timers can also be stopped
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+type clockTimer struct {
+	clock *Clock
+	when time.Time
+	ch chan time.Time
+	fired bool
+}
+
+func (t *clockTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *clockTimer) Stop() bool {
+	t.clock.locker.Lock()
+	defer t.clock.locker.Unlock()
+	if t.fired {
+		return false
+	}
+	for i, other := range t.clock.timers {
+		if other == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			break
+		}
+	}
+	t.fired = true
+	return true
+}
@@ -0,0 +1,900 @@
+// Package jookitest provides a simulated jooki for testing code that uses
+// the jooki package without real hardware.
+//
+// A Device serves the same endpoints as a real speaker (/ping, /upload
+// and an MQTT-over-websocket broker at /mqtt), accepts the commands the
+// jooki.Client sends on /j/web/input/* and publishes state changes on
+// /j/web/output/state.  Everything is served on a single port, so the
+// DiscoveryInfo it reports includes the port in its IP address.
+package jookitest
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rclancey/jooki"
+)
+
+const Version = "1.4.3-fake"
+
+type upload struct {
+	filename string
+	contentType string
+	data []byte
+	md5 string
+	// the duration in seconds the device reports, if any
+	duration *jooki.FloatStr
+}
+
+// UploadFault describes how the device mishandles an upload, for
+// testing how clients cope.
+type UploadFault int
+
+const (
+	// the upload succeeds
+	UploadOK = UploadFault(iota)
+	// the upload fails with an HTTP error and nothing is kept
+	UploadFail
+	// the device ingests the first half of the file into the library,
+	// then the upload fails with an HTTP error
+	UploadPartial
+	// the upload appears to succeed, but the data is damaged in transit
+	UploadCorrupt
+	// the upload succeeds, but the device only manages to read a second
+	// of the audio and reports the track as a second long
+	UploadShort
+)
+
+type Device struct {
+	server *httptest.Server
+	broker *broker
+	locker *sync.Mutex
+	state *jooki.JookiState
+	uploads map[int]*upload
+	faults []UploadFault
+	files map[string][]byte
+	images map[string][]byte
+	commands []string
+	ignore map[string]int
+}
+
+// NewDevice starts a simulated jooki listening on a random port on the
+// loopback interface.  Call Close when done with it.
+func NewDevice() *Device {
+	d := newDevice()
+	d.server = httptest.NewServer(d.Handler())
+	return d
+}
+
+// NewUnstartedDevice creates a simulated jooki without starting a server
+// for it, for callers who want to serve Handler themselves, e.g. on
+// ":8000" so that an unmodified client can find it.
+func NewUnstartedDevice() *Device {
+	return newDevice()
+}
+
+func newDevice() *Device {
+	d := &Device{
+		locker: &sync.Mutex{},
+		state: initialState(),
+		uploads: map[int]*upload{},
+		files: map[string][]byte{},
+		images: map[string][]byte{},
+		commands: []string{},
+		ignore: map[string]int{},
+	}
+	d.broker = newBroker(d.onPublish)
+	return d
+}
+
+func initialState() *jooki.JookiState {
+	return &jooki.JookiState{
+		Audio: &jooki.Audio{
+			Config: &jooki.AudioConfig{
+				RepeatMode: jooki.RepeatModeOff,
+				ShuffleMode: false,
+				Volume: 50,
+			},
+			Playback: &jooki.Playback{
+				Position: 0,
+				State: jooki.PlaybackStatePaused,
+			},
+		},
+		Bluetooth: "off",
+		Library: &jooki.Library{
+			Playlists: map[string]*jooki.Playlist{},
+			Tokens: map[string]*jooki.Token{},
+			Tracks: map[string]*jooki.Track{},
+		},
+		Device: &jooki.Device{
+			DiskUsage: &jooki.DiskUsage{
+				Available: 7 * 1024 * 1024 * 1024,
+				Total: 7 * 1024 * 1024 * 1024,
+			},
+			Firmware: Version,
+			Hostname: "jooki-fake",
+			ID: "fake0001",
+			IP: "127.0.0.1",
+			Machine: "jooki",
+		},
+		Power: &jooki.Power{
+			Charging: false,
+			Connected: true,
+			Level: &jooki.PowerLevel{MV: 4100, P: 90, T: 30},
+		},
+		Spotify: &jooki.Spotify{},
+		WiFi: &jooki.WiFi{Signal: -50, SSID: "fake"},
+	}
+}
+
+func (d *Device) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", d.servePing)
+	mux.HandleFunc("/upload", d.serveUpload)
+	mux.HandleFunc("/tracks/", d.serveTrack)
+	mux.Handle("/mqtt", d.broker)
+	return mux
+}
+
+func (d *Device) Close() {
+	d.broker.dropAll()
+	if d.server != nil {
+		d.server.Close()
+	}
+}
+
+// Addr is the host:port the device is listening on.
+func (d *Device) Addr() string {
+	if d.server == nil {
+		return ""
+	}
+	return d.server.Listener.Addr().String()
+}
+
+func (d *Device) DiscoveryInfo() *jooki.DiscoveryInfo {
+	return &jooki.DiscoveryInfo{
+		Hostname: d.Addr(),
+		ID: d.State().Device.ID,
+		IP: d.Addr(),
+		State: "LIVE",
+	}
+}
+
+func (d *Device) PingInfo() *jooki.DiscoveryPingInfo {
+	return &jooki.DiscoveryPingInfo{Version: Version}
+}
+
+// Connect returns a jooki.Client connected to the device.
+func (d *Device) Connect() (*jooki.Client, error) {
+	return jooki.NewClient(d.DiscoveryInfo(), d.PingInfo())
+}
+
+// DropConnections cuts off every connected client as though the network
+// had failed.
+func (d *Device) DropConnections() {
+	d.broker.dropAll()
+}
+
+// State returns a copy of the device's current state.
+func (d *Device) State() *jooki.JookiState {
+	d.locker.Lock()
+	defer d.locker.Unlock()
+	return d.state.Clone()
+}
+
+// Update modifies the device state, e.g. to simulate a battery draining,
+// and publishes the changes to connected clients as a partial state
+// document.
+func (d *Device) Update(f func(state *jooki.JookiState)) {
+	d.locker.Lock()
+	defer d.locker.Unlock()
+	before, err := stateDocument(d.state)
+	if err != nil {
+		log.Println("can't encode fake jooki state:", err)
+		return
+	}
+	f(d.state)
+	after, err := stateDocument(d.state)
+	if err != nil {
+		log.Println("can't encode fake jooki state:", err)
+		return
+	}
+	delta, ok := diffPatch(before, after).(map[string]interface{})
+	if ok && len(delta) > 0 {
+		d.publishDelta(delta)
+	}
+}
+
+// Commands lists the input topics received so far, without the
+// /j/web/input/ prefix, in the order they arrived.
+func (d *Device) Commands() []string {
+	d.locker.Lock()
+	defer d.locker.Unlock()
+	cmds := make([]string, len(d.commands))
+	copy(cmds, d.commands)
+	return cmds
+}
+
+// AddTrack puts a track directly into the library, as though it had been
+// uploaded, and returns its ID.  The ID is derived from the data the same
+// way the real device derives it from the uploaded file.
+func (d *Device) AddTrack(filename string, data []byte) string {
+	d.locker.Lock()
+	defer d.locker.Unlock()
+	id := d.addTrack(&upload{filename: filename, data: data, md5: md5hex(data)})
+	d.publishDelta(d.libraryDelta(nil, []string{id}))
+	return id
+}
+
+// AddPlaylist creates a playlist containing the given tracks and returns
+// its ID.
+func (d *Device) AddPlaylist(title string, trackIds ...string) string {
+	d.locker.Lock()
+	defer d.locker.Unlock()
+	id := d.addPlaylist(title, false)
+	d.state.Library.Playlists[id].Tracks = append([]string{}, trackIds...)
+	d.publishDelta(d.libraryDelta([]string{id}, nil))
+	return id
+}
+
+// PlaceToken simulates a token being put on the device.  If starId isn't
+// empty the device knows the token: it's recorded in the library as seen
+// now, and the playlist assigned to its star, if any, starts playing.
+func (d *Device) PlaceToken(tokenId, starId string) {
+	d.locker.Lock()
+	defer d.locker.Unlock()
+	d.state.NFC = &jooki.NFC{TokenID: tokenId, StarID: starId}
+	delta := map[string]interface{}{"nfc": d.state.NFC}
+	if starId != "" {
+		id := tokenId
+		token := &jooki.Token{ID: &id, Seen: time.Now().Unix(), StarID: starId}
+		d.state.Library.Tokens[tokenId] = token
+		delta["db"] = map[string]interface{}{
+			"tokens": map[string]interface{}{tokenId: token},
+		}
+	}
+	d.publishDelta(delta)
+	if starId == "" {
+		return
+	}
+	for _, id := range sortedKeys(d.state.Library.Playlists) {
+		pl := d.state.Library.Playlists[id]
+		if pl.Token != nil && *pl.Token == starId && len(pl.Tracks) > 0 {
+			if d.play(id, 0) == nil {
+				d.publishDelta(d.audioDelta("nowPlaying", "playback"))
+			}
+			return
+		}
+	}
+}
+
+// RemoveToken simulates the token being taken off the device.
+func (d *Device) RemoveToken() {
+	d.locker.Lock()
+	defer d.locker.Unlock()
+	d.state.NFC = &jooki.NFC{}
+	d.publishDelta(map[string]interface{}{"nfc": d.state.NFC})
+}
+
+// SetTrackImage gives a track artwork, as though the device had found it
+// in the uploaded file.
+func (d *Device) SetTrackImage(trackId string, data []byte) {
+	d.locker.Lock()
+	defer d.locker.Unlock()
+	tr, ok := d.state.Library.Tracks[trackId]
+	if !ok {
+		return
+	}
+	d.images[trackId] = data
+	tr.HasImage = true
+	d.publishDelta(d.libraryDelta(nil, []string{trackId}))
+}
+
+// InjectUploadFaults queues up faults to apply to the next uploads, one
+// fault per upload.
+func (d *Device) InjectUploadFaults(faults ...UploadFault) {
+	d.locker.Lock()
+	defer d.locker.Unlock()
+	d.faults = append(d.faults, faults...)
+}
+
+// IgnoreCommand makes the device drop the n'th next command with the
+// given name, counting from 1, as though it had been lost on the way.
+func (d *Device) IgnoreCommand(cmd string, n int) {
+	d.locker.Lock()
+	defer d.locker.Unlock()
+	d.ignore[cmd] = n
+}
+
+// serveTrack serves a track's audio at /tracks/<id> and its artwork at
+// /tracks/<id>/image.
+func (d *Device) serveTrack(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/tracks/"), "/")
+	d.locker.Lock()
+	var data []byte
+	var ok bool
+	switch {
+	case len(parts) == 1:
+		data, ok = d.files[parts[0]]
+	case len(parts) == 2 && parts[1] == "image":
+		data, ok = d.images[parts[0]]
+	}
+	d.locker.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", http.DetectContentType(data))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+func (d *Device) servePing(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d.PingInfo())
+}
+
+func (d *Device) serveUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		uploadId, err := strconv.Atoi(part.FormName())
+		if err != nil {
+			http.Error(w, "bad upload id", http.StatusBadRequest)
+			return
+		}
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		d.locker.Lock()
+		fault := UploadOK
+		if len(d.faults) > 0 {
+			fault = d.faults[0]
+			d.faults = d.faults[1:]
+		}
+		switch fault {
+		case UploadFail:
+			d.locker.Unlock()
+			http.Error(w, "upload failed", http.StatusInternalServerError)
+			return
+		case UploadPartial:
+			data = data[:len(data) / 2]
+			id := d.addTrack(&upload{filename: part.FileName(), data: data, md5: md5hex(data)})
+			d.publishDelta(d.libraryDelta(nil, []string{id}))
+			d.locker.Unlock()
+			http.Error(w, "upload interrupted", http.StatusInternalServerError)
+			return
+		case UploadCorrupt:
+			if len(data) > 0 {
+				data = append([]byte{}, data...)
+				data[0] ^= 0xff
+			}
+		}
+		up := &upload{
+			filename: part.FileName(),
+			contentType: part.Header.Get("Content-Type"),
+			data: data,
+			md5: md5hex(data),
+		}
+		if fault == UploadShort {
+			dur := jooki.FloatStr(1)
+			up.duration = &dur
+		}
+		d.uploads[uploadId] = up
+		d.locker.Unlock()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"ok":true}`))
+}
+
+func (d *Device) onPublish(topic string, payload []byte) {
+	if topic == "/j/debug/input/ping" {
+		d.broker.publish("/j/debug/output/pong", payload)
+		return
+	}
+	if !strings.HasPrefix(topic, "/j/web/input/") {
+		return
+	}
+	cmd := strings.TrimPrefix(topic, "/j/web/input/")
+	d.locker.Lock()
+	defer d.locker.Unlock()
+	d.commands = append(d.commands, cmd)
+	if n, ok := d.ignore[cmd]; ok {
+		if n <= 1 {
+			delete(d.ignore, cmd)
+			return
+		}
+		d.ignore[cmd] = n - 1
+	}
+	err := d.handle(cmd, payload)
+	if err != nil {
+		d.broker.publish("/j/web/output/error", []byte(err.Error()))
+	}
+}
+
+func (d *Device) handle(cmd string, payload []byte) error {
+	switch cmd {
+	case "CONNECT":
+		return nil
+	case "GET_STATE":
+		d.publishState()
+		return nil
+	case "PLAYLIST_NEW":
+		msg := &jooki.PlaylistCreate{}
+		err := json.Unmarshal(payload, msg)
+		if err != nil {
+			return err
+		}
+		title := ""
+		if msg.Title != nil {
+			title = *msg.Title
+		}
+		id := d.addPlaylist(title, msg.Audiobook)
+		d.publishDelta(d.libraryDelta([]string{id}, nil))
+		return nil
+	case "PLAYLIST_UPDATE":
+		msg := &jooki.PlaylistUpdateWrapper{}
+		err := json.Unmarshal(payload, msg)
+		if err != nil {
+			return err
+		}
+		if msg.Playlist == nil {
+			return fmt.Errorf("missing playlist")
+		}
+		pl, err := d.playlist(msg.Playlist.ID)
+		if err != nil {
+			return err
+		}
+		if msg.Playlist.Tracks != nil {
+			pl.Tracks = append([]string{}, msg.Playlist.Tracks...)
+		}
+		if msg.Playlist.Title != nil {
+			pl.Name = *msg.Playlist.Title
+		}
+		if msg.Playlist.Token != nil {
+			if *msg.Playlist.Token == "" {
+				pl.Token = nil
+			} else {
+				star := *msg.Playlist.Token
+				pl.Token = &star
+			}
+		}
+		d.publishDelta(d.libraryDelta([]string{msg.Playlist.ID}, nil))
+		return nil
+	case "PLAYLIST_ADD_TRACK":
+		msg := &jooki.PlaylistAddTrack{}
+		err := json.Unmarshal(payload, msg)
+		if err != nil {
+			return err
+		}
+		pl, err := d.playlist(msg.ID)
+		if err != nil {
+			return err
+		}
+		if _, ok := d.state.Library.Tracks[msg.TrackID]; !ok {
+			return fmt.Errorf("no such track %s", msg.TrackID)
+		}
+		pl.Tracks = append(pl.Tracks, msg.TrackID)
+		d.publishDelta(d.libraryDelta([]string{msg.ID}, nil))
+		return nil
+	case "PLAYLIST_ADD_UPLOAD":
+		msg := &jooki.PlaylistAddUpload{}
+		err := json.Unmarshal(payload, msg)
+		if err != nil {
+			return err
+		}
+		pl, err := d.playlist(msg.ID)
+		if err != nil {
+			return err
+		}
+		up, ok := d.uploads[msg.UploadID]
+		if !ok {
+			return fmt.Errorf("no such upload %d", msg.UploadID)
+		}
+		delete(d.uploads, msg.UploadID)
+		trackId := d.addTrack(up)
+		pl.Tracks = append(pl.Tracks, trackId)
+		d.publishDelta(d.libraryDelta([]string{msg.ID}, []string{trackId}))
+		return nil
+	case "PLAYLIST_DELETE":
+		msg := &jooki.PlaylistDelete{}
+		err := json.Unmarshal(payload, msg)
+		if err != nil {
+			return err
+		}
+		_, err = d.playlist(msg.ID)
+		if err != nil {
+			return err
+		}
+		delete(d.state.Library.Playlists, msg.ID)
+		d.publishDelta(d.libraryDelta([]string{msg.ID}, nil))
+		np := d.state.Audio.NowPlaying
+		if np != nil && np.PlaylistID != nil && *np.PlaylistID == msg.ID {
+			d.state.Audio.NowPlaying = nil
+			d.state.Audio.Playback.State = jooki.PlaybackStateEnded
+			d.publishDelta(d.audioDelta("nowPlaying", "playback"))
+		}
+		return nil
+	case "TRACK_DELETE":
+		msg := &jooki.TrackDelete{}
+		err := json.Unmarshal(payload, msg)
+		if err != nil {
+			return err
+		}
+		if _, ok := d.state.Library.Tracks[msg.TrackID]; !ok {
+			return fmt.Errorf("no such track %s", msg.TrackID)
+		}
+		delete(d.state.Library.Tracks, msg.TrackID)
+		delete(d.files, msg.TrackID)
+		delete(d.images, msg.TrackID)
+		d.publishDelta(d.libraryDelta(nil, []string{msg.TrackID}))
+		return nil
+	case "PLAYLIST_PLAY":
+		msg := &jooki.PlaylistPlay{}
+		err := json.Unmarshal(payload, msg)
+		if err != nil {
+			return err
+		}
+		err = d.play(msg.ID, msg.TrackIndex - 1)
+		if err != nil {
+			return err
+		}
+		d.publishDelta(d.audioDelta("nowPlaying", "playback"))
+		return nil
+	case "DO_PLAY":
+		if d.state.Audio.NowPlaying == nil {
+			ids := sortedKeys(d.state.Library.Playlists)
+			if len(ids) == 0 {
+				return fmt.Errorf("nothing to play")
+			}
+			return d.handleAndPublish(d.play(ids[0], 0))
+		}
+		d.state.Audio.Playback.State = jooki.PlaybackStatePlaying
+		d.publishDelta(d.audioDelta("playback"))
+		return nil
+	case "DO_PAUSE":
+		d.state.Audio.Playback.State = jooki.PlaybackStatePaused
+		d.publishDelta(d.audioDelta("playback"))
+		return nil
+	case "DO_NEXT":
+		return d.handleAndPublish(d.skip(1))
+	case "DO_PREV":
+		return d.handleAndPublish(d.skip(-1))
+	case "SEEK":
+		msg := &jooki.SetSeek{}
+		err := json.Unmarshal(payload, msg)
+		if err != nil {
+			return err
+		}
+		d.state.Audio.Playback.Position = msg.Position
+		d.publishDelta(d.audioDelta("playback"))
+		return nil
+	case "SET_VOL":
+		msg := &jooki.SetVol{}
+		err := json.Unmarshal(payload, msg)
+		if err != nil {
+			return err
+		}
+		if msg.Volume < 0 || msg.Volume > 100 {
+			return fmt.Errorf("bad volume %d", msg.Volume)
+		}
+		d.state.Audio.Config.Volume = uint8(msg.Volume)
+		d.publishDelta(d.audioDelta("config"))
+		return nil
+	case "SET_CFG":
+		msg := map[string]json.RawMessage{}
+		err := json.Unmarshal(payload, &msg)
+		if err != nil {
+			return err
+		}
+		if raw, ok := msg["shuffle_mode"]; ok {
+			err = json.Unmarshal(raw, &d.state.Audio.Config.ShuffleMode)
+			if err != nil {
+				return err
+			}
+		}
+		if raw, ok := msg["repeat_mode"]; ok {
+			err = json.Unmarshal(raw, &d.state.Audio.Config.RepeatMode)
+			if err != nil {
+				return err
+			}
+		}
+		d.publishDelta(d.audioDelta("config"))
+		return nil
+	case "SET_SETTINGS":
+		msg := &jooki.JookiSettings{}
+		err := json.Unmarshal(payload, msg)
+		if err != nil {
+			return err
+		}
+		if d.state.Settings == nil {
+			d.state.Settings = &jooki.JookiSettings{}
+		}
+		if msg.QuietTime != nil {
+			d.state.Settings.QuietTime = msg.QuietTime
+		}
+		d.publishDelta(map[string]interface{}{"settings": d.state.Settings})
+		return nil
+	}
+	return fmt.Errorf("unknown command %s", cmd)
+}
+
+func (d *Device) handleAndPublish(err error) error {
+	if err != nil {
+		return err
+	}
+	d.publishDelta(d.audioDelta("nowPlaying", "playback"))
+	return nil
+}
+
+func (d *Device) playlist(id string) (*jooki.Playlist, error) {
+	pl, ok := d.state.Library.Playlists[id]
+	if !ok || pl == nil {
+		return nil, fmt.Errorf("no such playlist %s", id)
+	}
+	return pl, nil
+}
+
+func (d *Device) addPlaylist(title string, audiobook bool) string {
+	id := randomID(12)
+	d.state.Library.Playlists[id] = &jooki.Playlist{
+		Audiobook: &audiobook,
+		Name: title,
+		Tracks: []string{},
+	}
+	return id
+}
+
+func (d *Device) addTrack(up *upload) string {
+	id := up.md5[:16]
+	if _, ok := d.state.Library.Tracks[id]; ok {
+		return id
+	}
+	name := filepath.Base(up.filename)
+	ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(name)), ".")
+	title := strings.TrimSuffix(name, filepath.Ext(name))
+	size := jooki.IntStr(len(up.data))
+	d.state.Library.Tracks[id] = &jooki.Track{
+		Codec: &ext,
+		Location: &name,
+		Format: &ext,
+		Size: &size,
+		Name: &title,
+		Duration: up.duration,
+	}
+	d.files[id] = up.data
+	return id
+}
+
+func (d *Device) play(playlistId string, idx int) error {
+	pl, err := d.playlist(playlistId)
+	if err != nil {
+		return err
+	}
+	if idx < 0 || idx >= len(pl.Tracks) {
+		return fmt.Errorf("no track %d in playlist %s", idx + 1, playlistId)
+	}
+	trackId := pl.Tracks[idx]
+	np := &jooki.NowPlaying{
+		Audiobook: pl.Audiobook != nil && *pl.Audiobook,
+		HasNext: idx < len(pl.Tracks) - 1,
+		HasPrev: idx > 0,
+		PlaylistID: &playlistId,
+		TrackID: &trackId,
+		TrackIndex: &idx,
+	}
+	source := "local"
+	np.Source = &source
+	if tr, ok := d.state.Library.Tracks[trackId]; ok && tr != nil {
+		np.Album = tr.Album
+		np.Artist = tr.Artist
+		np.Title = tr.Name
+		if tr.Duration != nil {
+			ms := float64(*tr.Duration) * 1000
+			np.Duration = &ms
+		}
+	}
+	d.state.Audio.NowPlaying = np
+	d.state.Audio.Playback = &jooki.Playback{
+		Position: 0,
+		State: jooki.PlaybackStatePlaying,
+	}
+	return nil
+}
+
+func (d *Device) skip(delta int) error {
+	np := d.state.Audio.NowPlaying
+	if np == nil || np.PlaylistID == nil || np.TrackIndex == nil {
+		return fmt.Errorf("nothing playing")
+	}
+	pl, err := d.playlist(*np.PlaylistID)
+	if err != nil {
+		return err
+	}
+	idx := *np.TrackIndex + delta
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(pl.Tracks) {
+		d.state.Audio.Playback.State = jooki.PlaybackStateEnded
+		return nil
+	}
+	return d.play(*np.PlaylistID, idx)
+}
+
+// publishState sends the whole state to subscribed clients, as in
+// response to GET_STATE.
+func (d *Device) publishState() {
+	data, err := json.Marshal(d.state)
+	if err != nil {
+		log.Println("can't encode fake jooki state:", err)
+		return
+	}
+	d.broker.publish("/j/web/output/state", data)
+}
+
+// stateDocument converts the state to generic JSON values for diffing.
+func stateDocument(state *jooki.JookiState) (interface{}, error) {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	err = json.Unmarshal(data, &doc)
+	return doc, err
+}
+
+// diffPatch builds the JSON merge patch that turns before into after,
+// with null for deleted keys.  It's the inverse of jooki.MergePatch.
+func diffPatch(before, after interface{}) interface{} {
+	b, bok := before.(map[string]interface{})
+	a, aok := after.(map[string]interface{})
+	if !bok || !aok {
+		if reflect.DeepEqual(before, after) {
+			return map[string]interface{}{}
+		}
+		return after
+	}
+	patch := map[string]interface{}{}
+	for k, v := range a {
+		old, ok := b[k]
+		if !ok {
+			patch[k] = v
+			continue
+		}
+		if reflect.DeepEqual(old, v) {
+			continue
+		}
+		_, oldObj := old.(map[string]interface{})
+		_, newObj := v.(map[string]interface{})
+		if oldObj && newObj {
+			patch[k] = diffPatch(old, v)
+		} else {
+			patch[k] = v
+		}
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			patch[k] = nil
+		}
+	}
+	return patch
+}
+
+// publishDelta sends a partial state document to subscribed clients.
+// Like the real device, it only includes what has changed, with null
+// for deleted entries.
+func (d *Device) publishDelta(delta map[string]interface{}) {
+	data, err := json.Marshal(delta)
+	if err != nil {
+		log.Println("can't encode fake jooki state delta:", err)
+		return
+	}
+	d.broker.publish("/j/web/output/state", data)
+}
+
+func (d *Device) libraryDelta(playlistIds, trackIds []string) map[string]interface{} {
+	db := map[string]interface{}{}
+	if len(playlistIds) > 0 {
+		playlists := map[string]interface{}{}
+		for _, id := range playlistIds {
+			pl, ok := d.state.Library.Playlists[id]
+			if ok {
+				playlists[id] = pl
+			} else {
+				playlists[id] = nil
+			}
+		}
+		db["playlists"] = playlists
+	}
+	if len(trackIds) > 0 {
+		tracks := map[string]interface{}{}
+		for _, id := range trackIds {
+			tr, ok := d.state.Library.Tracks[id]
+			if ok {
+				tracks[id] = tr
+			} else {
+				tracks[id] = nil
+			}
+		}
+		db["tracks"] = tracks
+	}
+	return map[string]interface{}{"db": db}
+}
+
+// audioDelta picks out parts of the audio state.  An absent nowPlaying is
+// sent as an empty array, as the real device does.
+func (d *Device) audioDelta(keys ...string) map[string]interface{} {
+	audio := map[string]interface{}{}
+	for _, k := range keys {
+		switch k {
+		case "config":
+			audio[k] = d.state.Audio.Config
+		case "nowPlaying":
+			if d.state.Audio.NowPlaying == nil {
+				audio[k] = []interface{}{}
+			} else {
+				audio[k] = d.state.Audio.NowPlaying
+			}
+		case "playback":
+			audio[k] = d.state.Audio.Playback
+		}
+	}
+	return map[string]interface{}{"audio": audio}
+}
+
+func sortedKeys(m map[string]*jooki.Playlist) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func randomID(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func md5hex(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -3,14 +3,13 @@ package jooki
 import (
 	"encoding/json"
 	"fmt"
-	"math"
 	"strconv"
 	"strings"
 )
 
 type Playlist struct {
 	ID *string `json:"-"`
-	Audiobook *bool `json:audiobook"`
+	Audiobook *bool `json:"audiobook"`
 	Token *string `json:"star"`
 	Name string `json:"title"`
 	Tracks []string `json:"tracks"`
@@ -41,7 +40,14 @@ func (p *Playlist) String() string {
 }
 
 func (p *Playlist) Clone() *Playlist {
+	if p == nil {
+		return nil
+	}
 	clone := &Playlist{}
+	if p.ID != nil {
+		v := *p.ID
+		clone.ID = &v
+	}
 	if p.Audiobook != nil {
 		v := *p.Audiobook
 		clone.Audiobook = &v
@@ -55,6 +61,10 @@ func (p *Playlist) Clone() *Playlist {
 	for i, v := range p.Tracks {
 		clone.Tracks[i] = v
 	}
+	if p.URL != nil {
+		v := *p.URL
+		clone.URL = &v
+	}
 	return clone
 }
 
@@ -69,6 +79,10 @@ func (t *Token) Clone() *Token {
 		return nil
 	}
 	clone := *t
+	if t.ID != nil {
+		v := *t.ID
+		clone.ID = &v
+	}
 	return &clone
 }
 
@@ -174,8 +188,45 @@ func (t *Track) Clone() *Track {
 	if t == nil {
 		return nil
 	}
-	clone := *t
-	return &clone
+	clone := &Track{}
+	if t.ID != nil {
+		v := *t.ID
+		clone.ID = &v
+	}
+	if t.Album != nil {
+		v := *t.Album
+		clone.Album = &v
+	}
+	if t.Artist != nil {
+		v := *t.Artist
+		clone.Artist = &v
+	}
+	if t.Codec != nil {
+		v := *t.Codec
+		clone.Codec = &v
+	}
+	if t.Duration != nil {
+		v := *t.Duration
+		clone.Duration = &v
+	}
+	if t.Location != nil {
+		v := *t.Location
+		clone.Location = &v
+	}
+	clone.HasImage = t.HasImage
+	if t.Format != nil {
+		v := *t.Format
+		clone.Format = &v
+	}
+	if t.Size != nil {
+		v := *t.Size
+		clone.Size = &v
+	}
+	if t.Name != nil {
+		v := *t.Name
+		clone.Name = &v
+	}
+	return clone
 }
 
 type Library struct {
@@ -216,6 +267,30 @@ func (l *Library) UnmarshalJSON(data []byte) error {
 			return err
 		}
 	}
+	for k, v := range l.Playlists {
+		if v == nil {
+			delete(l.Playlists, k)
+			continue
+		}
+		id := k
+		v.ID = &id
+	}
+	for k, v := range l.Tokens {
+		if v == nil {
+			delete(l.Tokens, k)
+			continue
+		}
+		id := k
+		v.ID = &id
+	}
+	for k, v := range l.Tracks {
+		if v == nil {
+			delete(l.Tracks, k)
+			continue
+		}
+		id := k
+		v.ID = &id
+	}
 	return nil
 }
 
@@ -245,64 +320,15 @@ func (l *Library) Clone() *Library {
 	return clone
 }
 
+// TrackSearch describes a track to look for with FindTrack or
+// MatchTracks.  Fields left nil aren't compared.
 type TrackSearch struct {
 	JookiID *string
 	Name *string
 	Album *string
 	Artist *string
+	// in bytes
 	Size *uint64
+	// in milliseconds
 	TotalTime *uint
 }
-
-func (l *Library) FindTrack(tr TrackSearch) *Track {
-	if tr.JookiID != nil {
-		id := *tr.JookiID
-		jtr, ok := l.Tracks[id]
-		if ok {
-			jtr.ID = &id
-			return jtr
-		}
-	}
-	for id, jtr := range l.Tracks {
-		if tr.Name == nil || *tr.Name == "" {
-			if jtr.Name != nil && *jtr.Name != "" {
-				continue
-			}
-		} else {
-			if jtr.Name == nil || *jtr.Name != *tr.Name {
-				continue
-			}
-		}
-		if tr.Album != nil || *tr.Album == "" {
-			if jtr.Album != nil && *jtr.Album != "" {
-				continue
-			}
-		} else {
-			if jtr.Album == nil || *jtr.Album != *tr.Album {
-				continue
-			}
-		}
-		if tr.Artist == nil || *tr.Artist == "" {
-			if jtr.Artist != nil && *jtr.Artist != "" {
-				continue
-			}
-		} else {
-			if jtr.Artist == nil || *jtr.Artist != *tr.Artist {
-				continue
-			}
-		}
-		if tr.Size != nil && jtr.Size != nil {
-			if int64(*tr.Size) != int64(*jtr.Size) {
-				continue
-			}
-		}
-		if tr.TotalTime != nil && jtr.Duration != nil {
-			if math.Abs(float64(*tr.TotalTime) - float64(*jtr.Duration) * 1000) > 1000 {
-				continue
-			}
-		}
-		jtr.ID = &id
-		return jtr
-	}
-	return nil
-}
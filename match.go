@@ -0,0 +1,236 @@
+package jooki
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// MatchThreshold is the lowest score at which FindTrack considers a
+// track a match.
+var MatchThreshold = 0.75
+
+// how much each field counts towards a match score
+const (
+	matchWeightName = 3.0
+	matchWeightArtist = 2.0
+	matchWeightAlbum = 1.0
+	matchWeightSize = 2.0
+	matchWeightDuration = 2.0
+	// the least similarity for titles where the words of one are all in
+	// the other; it's below MatchThreshold, so that a title like "let it
+	// go" only matches "let it go from frozen" if something else agrees
+	matchSubsetSimilarity = 0.7
+)
+
+type TrackMatch struct {
+	// a copy of the track in the library, with its ID set
+	Track *Track
+	// from 0 to 1
+	Score float64
+	// the track was found by TrackSearch.JookiID
+	ByID bool
+}
+
+// MatchTracks scores every track in the library against a search and
+// returns those with any similarity, best first.  A track found by
+// JookiID scores 1.  Otherwise, each field that both the search and the
+// track have contributes to the score: titles, artists and albums are
+// compared after normalising case, whitespace, punctuation, diacritics
+// and "feat." credits; sizes must match exactly; and durations within a
+// second count as a match.  Ties are broken by track ID, so the results
+// are the same for the same library.  The library isn't modified.
+func (l *Library) MatchTracks(search TrackSearch) []*TrackMatch {
+	matches := []*TrackMatch{}
+	if l == nil {
+		return matches
+	}
+	for id, jtr := range l.Tracks {
+		if jtr == nil {
+			continue
+		}
+		m := &TrackMatch{}
+		if search.JookiID != nil && *search.JookiID == id {
+			m.Score = 1
+			m.ByID = true
+		} else {
+			m.Score = matchScore(search, jtr)
+		}
+		if m.Score <= 0 {
+			continue
+		}
+		m.Track = jtr.Clone()
+		trackId := id
+		m.Track.ID = &trackId
+		matches = append(matches, m)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.ByID != b.ByID {
+			return a.ByID
+		}
+		return *a.Track.ID < *b.Track.ID
+	})
+	return matches
+}
+
+// FindTrack returns the best match for a search scoring at least
+// MatchThreshold, or nil if there isn't one.  The track returned is a
+// copy with its ID set.
+func (l *Library) FindTrack(tr TrackSearch) *Track {
+	matches := l.MatchTracks(tr)
+	if len(matches) == 0 || matches[0].Score < MatchThreshold {
+		return nil
+	}
+	return matches[0].Track
+}
+
+func matchScore(search TrackSearch, jtr *Track) float64 {
+	total := 0.0
+	weights := 0.0
+	text := func(a, b *string, weight float64) {
+		if a == nil || b == nil {
+			return
+		}
+		na, nb := normalizeTitle(*a), normalizeTitle(*b)
+		if na == "" || nb == "" {
+			return
+		}
+		total += weight * textSimilarity(na, nb)
+		weights += weight
+	}
+	text(search.Name, jtr.Name, matchWeightName)
+	text(search.Artist, jtr.Artist, matchWeightArtist)
+	text(search.Album, jtr.Album, matchWeightAlbum)
+	if search.Size != nil && jtr.Size != nil {
+		if int64(*search.Size) == int64(*jtr.Size) {
+			total += matchWeightSize
+		}
+		weights += matchWeightSize
+	}
+	if search.TotalTime != nil && jtr.Duration != nil && *jtr.Duration > 0 {
+		diff := math.Abs(float64(*search.TotalTime) / 1000 - float64(*jtr.Duration))
+		switch {
+		case diff <= 1:
+			total += matchWeightDuration
+		case diff <= 3:
+			total += matchWeightDuration / 2
+		}
+		weights += matchWeightDuration
+	}
+	if weights == 0 {
+		return 0
+	}
+	return total / weights
+}
+
+// textSimilarity compares two normalised strings: 1 if they're the same,
+// at least matchSubsetSimilarity if the words of one are all in the
+// other (e.g. "let it go" and "let it go from frozen"), and otherwise the
+// proportion of words they have in common.
+func textSimilarity(a, b string) float64 {
+	if a == b {
+		return 1
+	}
+	wa := strings.Fields(a)
+	wb := strings.Fields(b)
+	set := map[string]bool{}
+	for _, w := range wa {
+		set[w] = true
+	}
+	common := 0
+	seen := map[string]bool{}
+	for _, w := range wb {
+		if set[w] && !seen[w] {
+			common += 1
+		}
+		seen[w] = true
+	}
+	union := len(set) + len(seen) - common
+	if union == 0 {
+		return 0
+	}
+	sim := float64(common) / float64(union)
+	if common == len(set) || common == len(seen) {
+		sim = math.Max(sim, matchSubsetSimilarity)
+	}
+	return sim
+}
+
+// "feat" without a dot is only a credit in brackets, so that titles
+// like "Feat of Strength" are left alone
+var featRe = regexp.MustCompile(`(?i)\s*([\(\[]\s*(feat\.?|ft\.?|featuring)|\b(feat\.|ft\.|featuring))\s.*$`)
+
+// normalizeTitle lowercases s, drops any "feat." credit, strips accents
+// and replaces punctuation with spaces, so that e.g. "Café Del Mar
+// (feat. Someone)" and "cafe del  mar" compare equal.
+func normalizeTitle(s string) string {
+	s = featRe.ReplaceAllString(s, "")
+	s = strings.Replace(s, "&", " and ", -1)
+	buf := &strings.Builder{}
+	space := true
+	for _, r := range strings.ToLower(s) {
+		if unicode.Is(unicode.Mn, r) {
+			// combining accent
+			continue
+		}
+		if folded, ok := foldedRunes[r]; ok {
+			buf.WriteString(folded)
+			space = false
+			continue
+		}
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			buf.WriteRune(r)
+			space = false
+			continue
+		}
+		if r == '\'' || r == '’' {
+			// "don't" == "dont"
+			continue
+		}
+		if !space {
+			buf.WriteByte(' ')
+			space = true
+		}
+	}
+	return strings.TrimSpace(buf.String())
+}
+
+var foldedRunes = map[rune]string{}
+
+func init() {
+	for ascii, accented := range map[string]string{
+		"a": "àáâãäåāăą",
+		"c": "çćĉċč",
+		"d": "ďđð",
+		"e": "èéêëēĕėęě",
+		"g": "ĝğġģ",
+		"h": "ĥħ",
+		"i": "ìíîïĩīĭįı",
+		"j": "ĵ",
+		"k": "ķ",
+		"l": "ĺļľŀł",
+		"n": "ñńņň",
+		"o": "òóôõöøōŏő",
+		"r": "ŕŗř",
+		"s": "śŝşš",
+		"t": "ţťŧ",
+		"u": "ùúûüũūŭůűų",
+		"w": "ŵ",
+		"y": "ýÿŷ",
+		"z": "źżž",
+		"ae": "æ",
+		"oe": "œ",
+		"ss": "ß",
+		"th": "þ",
+	} {
+		for _, r := range accented {
+			foldedRunes[r] = ascii
+		}
+	}
+}
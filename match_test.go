@@ -0,0 +1,122 @@
+package jooki
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type MatchSuite struct {}
+var _ = Suite(&MatchSuite{})
+
+func matchLibrary() *Library {
+	track := func(name, artist, album string, size int64, duration float64) *Track {
+		sz := IntStr(size)
+		dur := FloatStr(duration)
+		tr := &Track{Name: &name, Size: &sz, Duration: &dur}
+		if artist != "" {
+			tr.Artist = &artist
+		}
+		if album != "" {
+			tr.Album = &album
+		}
+		return tr
+	}
+	return &Library{
+		Tracks: map[string]*Track{
+			"a1": track("Let It Go", "Idina Menzel", "Frozen (Original Motion Picture Soundtrack)", 4839120, 201.56),
+			"a2": track("Let It Go", "Demi Lovato", "Frozen (Original Motion Picture Soundtrack)", 3700000, 229.1),
+			"b1": track("Café del Mar", "Energy 52", "", 9000000, 440),
+			"b2": track("Cafe Del Mar", "Energy 52", "", 9000000, 440),
+			"c1": track("Señorita", "Shawn Mendes", "Señorita", 3000000, 191),
+			"d1": track("Wheels on the Bus", "", "", 2000000, 120),
+		},
+	}
+}
+
+func (s *MatchSuite) TestNormalizeTitle(c *C) {
+	c.Check(normalizeTitle("  Café   Del Mar "), Equals, "cafe del mar")
+	c.Check(normalizeTitle("Señorita (feat. Camila Cabello)"), Equals, "senorita")
+	c.Check(normalizeTitle("Old Town Road [ft. Billy Ray Cyrus]"), Equals, "old town road")
+	c.Check(normalizeTitle("Don't Stop Me Now"), Equals, "dont stop me now")
+	c.Check(normalizeTitle("Simon & Garfunkel"), Equals, "simon and garfunkel")
+	c.Check(normalizeTitle("Straße"), Equals, "strasse")
+	c.Check(normalizeTitle("Café"), Equals, "cafe")
+	c.Check(normalizeTitle("Defeat the Featherweight"), Equals, "defeat the featherweight")
+	c.Check(normalizeTitle("Feat of Strength"), Equals, "feat of strength")
+	c.Check(normalizeTitle("Minor Feat Blues"), Equals, "minor feat blues")
+	c.Check(normalizeTitle("Lift Off (feat Someone)"), Equals, "lift off")
+	c.Check(normalizeTitle("Lift Off [Ft Someone]"), Equals, "lift off")
+	c.Check(normalizeTitle("Lift Off ft. Someone"), Equals, "lift off")
+	c.Check(normalizeTitle("Lift Off featuring Someone"), Equals, "lift off")
+}
+
+func (s *MatchSuite) TestMatchTracks(c *C) {
+	lib := matchLibrary()
+	name, artist, album := "let it go", "IDINA MENZEL", "Frozen"
+	size := uint64(4839120)
+	total := uint(201000)
+	matches := lib.MatchTracks(TrackSearch{Name: &name, Artist: &artist, Album: &album, Size: &size, TotalTime: &total})
+	c.Assert(len(matches) >= 2, Equals, true)
+	c.Check(*matches[0].Track.ID, Equals, "a1")
+	c.Check(matches[0].Score > 0.95, Equals, true)
+	c.Check(*matches[1].Track.ID, Equals, "a2")
+	c.Check(matches[1].Score < MatchThreshold, Equals, true)
+
+	// a different album counts against a match rather than for it
+	other := "Greatest Hits"
+	withAlbum := lib.MatchTracks(TrackSearch{Name: &name, Artist: &artist, Album: &other})
+	without := lib.MatchTracks(TrackSearch{Name: &name, Artist: &artist})
+	c.Check(withAlbum[0].Score < without[0].Score, Equals, true)
+
+	// ties are broken by ID, every time
+	cafe, energy := "cafe del mar (feat. nobody)", "Energy 52"
+	for i := 0; i < 20; i++ {
+		matches = lib.MatchTracks(TrackSearch{Name: &cafe, Artist: &energy})
+		c.Assert(matches, HasLen, 2)
+		c.Check(*matches[0].Track.ID, Equals, "b1")
+		c.Check(*matches[1].Track.ID, Equals, "b2")
+		c.Check(matches[0].Score, Equals, 1.0)
+	}
+
+	// an ID match wins ties
+	id := "b2"
+	matches = lib.MatchTracks(TrackSearch{JookiID: &id, Name: &cafe})
+	c.Check(*matches[0].Track.ID, Equals, "b2")
+	c.Check(matches[0].ByID, Equals, true)
+
+	c.Check(lib.MatchTracks(TrackSearch{}), HasLen, 0)
+}
+
+func (s *MatchSuite) TestFindTrack(c *C) {
+	lib := matchLibrary()
+	name := "Senorita (feat. Camila Cabello)"
+	tr := lib.FindTrack(TrackSearch{Name: &name})
+	c.Assert(tr, NotNil)
+	c.Check(*tr.ID, Equals, "c1")
+	// the library isn't touched
+	c.Check(lib.Tracks["c1"].ID, IsNil)
+	*tr.Name = "changed"
+	c.Check(*lib.Tracks["c1"].Name, Equals, "Señorita")
+
+	// the album was missing from the search, which used to panic
+	name = "Wheels on the Bus"
+	artist := "Super Simple Songs"
+	tr = lib.FindTrack(TrackSearch{Name: &name, Artist: &artist})
+	c.Assert(tr, NotNil)
+	c.Check(*tr.ID, Equals, "d1")
+
+	// the words of the title are all in the search, but that's not
+	// enough on its own
+	name = "Wheels on the Bus Go Round and Round"
+	c.Check(lib.FindTrack(TrackSearch{Name: &name}), IsNil)
+	dur := uint(120400)
+	tr = lib.FindTrack(TrackSearch{Name: &name, TotalTime: &dur})
+	c.Assert(tr, NotNil)
+	c.Check(*tr.ID, Equals, "d1")
+
+	name = "Baby Shark"
+	c.Check(lib.FindTrack(TrackSearch{Name: &name}), IsNil)
+	id := "nope"
+	c.Check(lib.FindTrack(TrackSearch{JookiID: &id}), IsNil)
+	id = "a2"
+	c.Check(*lib.FindTrack(TrackSearch{JookiID: &id}).ID, Equals, "a2")
+}
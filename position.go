@@ -0,0 +1,78 @@
+package jooki
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// PlaybackPosition is how far through the current track playback is.
+type PlaybackPosition struct {
+	State string
+	TrackID string
+	Elapsed time.Duration
+	// zero if the length of the track isn't known
+	Duration time.Duration
+	Remaining time.Duration
+	// from 0 to 100, or 0 if the length of the track isn't known
+	Percent float64
+	// when the device last reported the position
+	Updated time.Time
+}
+
+// NowPlayingPosition estimates how far through the current track
+// playback is.  The device only reports the position now and then, so
+// while it's playing, the time since the last report is added on, up to
+// the length of the track.  It returns false if nothing is playing or
+// paused.
+func (c *Client) NowPlayingPosition() (*PlaybackPosition, bool) {
+	now := c.Clock().Now()
+	c.stateLocker.RLock()
+	audio := c.lastState.Audio.Clone()
+	updated := c.playbackUpdated
+	c.stateLocker.RUnlock()
+	return estimatePosition(audio, updated, now)
+}
+
+// hasPosition reports whether a state delta includes the playback
+// position.  Other playback changes, such as the state alone, leave the
+// last reported position where it was.
+func hasPosition(payload []byte) bool {
+	delta := &struct {
+		Audio *struct {
+			Playback *struct {
+				Position *int `json:"position_ms"`
+			} `json:"playback"`
+		} `json:"audio"`
+	}{}
+	json.Unmarshal(payload, delta)
+	return delta.Audio != nil && delta.Audio.Playback != nil && delta.Audio.Playback.Position != nil
+}
+
+func estimatePosition(audio *Audio, updated, now time.Time) (*PlaybackPosition, bool) {
+	if audio == nil || audio.Playback == nil || audio.NowPlaying == nil {
+		return nil, false
+	}
+	pb := audio.Playback
+	np := audio.NowPlaying
+	pos := &PlaybackPosition{
+		State: pb.State,
+		TrackID: nowPlayingTrack(np),
+		Elapsed: time.Duration(pb.Position) * time.Millisecond,
+		Updated: updated,
+	}
+	if pb.State == PlaybackStatePlaying && !updated.IsZero() && now.After(updated) {
+		pos.Elapsed += now.Sub(updated)
+	}
+	if np.Duration != nil && *np.Duration > 0 {
+		pos.Duration = time.Duration(*np.Duration * float64(time.Millisecond))
+		if pos.Elapsed > pos.Duration {
+			pos.Elapsed = pos.Duration
+		}
+		pos.Remaining = pos.Duration - pos.Elapsed
+		pos.Percent = 100 * float64(pos.Elapsed) / float64(pos.Duration)
+	}
+	if pos.Elapsed < 0 {
+		pos.Elapsed = 0
+	}
+	return pos, true
+}
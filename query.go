@@ -0,0 +1,201 @@
+package jooki
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// The query methods below return the library's own entries, with their
+// IDs set, rather than copies.
+
+// SortedPlaylists lists the playlists sorted by name, ignoring case, and
+// then by ID.
+func (l *Library) SortedPlaylists() []*Playlist {
+	playlists := []*Playlist{}
+	if l == nil {
+		return playlists
+	}
+	for _, pl := range l.Playlists {
+		playlists = append(playlists, pl)
+	}
+	sortPlaylists(playlists)
+	return playlists
+}
+
+func sortPlaylists(playlists []*Playlist) {
+	sort.Slice(playlists, func(i, j int) bool {
+		a := strings.ToLower(playlists[i].Name)
+		b := strings.ToLower(playlists[j].Name)
+		if a != b {
+			return a < b
+		}
+		return strOf(playlists[i].ID) < strOf(playlists[j].ID)
+	})
+}
+
+func sortTracks(tracks []*Track) {
+	sort.Slice(tracks, func(i, j int) bool {
+		a := strings.ToLower(strOf(tracks[i].Name))
+		b := strings.ToLower(strOf(tracks[j].Name))
+		if a != b {
+			return a < b
+		}
+		return strOf(tracks[i].ID) < strOf(tracks[j].ID)
+	})
+}
+
+func strOf(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// PlaylistTracks returns the tracks on a playlist, in order.  Track IDs
+// that aren't in the library are skipped.
+func (l *Library) PlaylistTracks(playlistId string) []*Track {
+	tracks := []*Track{}
+	if l == nil {
+		return tracks
+	}
+	pl, ok := l.Playlists[playlistId]
+	if !ok {
+		return tracks
+	}
+	for _, id := range pl.Tracks {
+		if tr, ok := l.Tracks[id]; ok && tr != nil {
+			tracks = append(tracks, tr)
+		}
+	}
+	return tracks
+}
+
+// PlaylistsWithTrack lists the playlists a track is on, sorted by name.
+func (l *Library) PlaylistsWithTrack(trackId string) []*Playlist {
+	playlists := []*Playlist{}
+	if l == nil {
+		return playlists
+	}
+	for _, pl := range l.Playlists {
+		for _, id := range pl.Tracks {
+			if id == trackId {
+				playlists = append(playlists, pl)
+				break
+			}
+		}
+	}
+	sortPlaylists(playlists)
+	return playlists
+}
+
+// SearchTracks finds the tracks whose title, artist and album between
+// them contain every word of the query.  Words are compared the same way
+// as in MatchTracks, so case and accents don't matter, and a word
+// matches any word it begins, e.g. "twink" matches "Twinkle".  Results
+// are sorted by title.
+func (l *Library) SearchTracks(query string) []*Track {
+	tracks := []*Track{}
+	words := strings.Fields(normalizeTitle(query))
+	if l == nil || len(words) == 0 {
+		return tracks
+	}
+	for _, tr := range l.Tracks {
+		if tr == nil {
+			continue
+		}
+		text := strings.Fields(normalizeTitle(strOf(tr.Name) + " " + strOf(tr.Artist) + " " + strOf(tr.Album)))
+		if containsWords(text, words) {
+			tracks = append(tracks, tr)
+		}
+	}
+	sortTracks(tracks)
+	return tracks
+}
+
+func containsWords(text, words []string) bool {
+	for _, w := range words {
+		found := false
+		for _, t := range text {
+			if strings.HasPrefix(t, w) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// OrphanedTracks lists the tracks that aren't on any playlist, sorted by
+// title.
+func (l *Library) OrphanedTracks() []*Track {
+	tracks := []*Track{}
+	if l == nil {
+		return tracks
+	}
+	used := map[string]bool{}
+	for _, pl := range l.Playlists {
+		for _, id := range pl.Tracks {
+			used[id] = true
+		}
+	}
+	for id, tr := range l.Tracks {
+		if tr != nil && !used[id] {
+			tracks = append(tracks, tr)
+		}
+	}
+	sortTracks(tracks)
+	return tracks
+}
+
+type PlaylistStats struct {
+	Tracks int
+	// tracks on the playlist that aren't in the library
+	Missing int
+	Duration time.Duration
+	// in bytes
+	Size int64
+}
+
+// PlaylistStats totals up the tracks on a playlist.  It returns nil if
+// there's no such playlist.
+func (l *Library) PlaylistStats(playlistId string) *PlaylistStats {
+	if l == nil {
+		return nil
+	}
+	pl, ok := l.Playlists[playlistId]
+	if !ok {
+		return nil
+	}
+	stats := &PlaylistStats{}
+	for _, id := range pl.Tracks {
+		tr, ok := l.Tracks[id]
+		if !ok || tr == nil {
+			stats.Missing += 1
+			continue
+		}
+		stats.Tracks += 1
+		if tr.Duration != nil {
+			stats.Duration += time.Duration(float64(*tr.Duration) * float64(time.Second))
+		}
+		if tr.Size != nil {
+			stats.Size += int64(*tr.Size)
+		}
+	}
+	return stats
+}
+
+// TokenPlaylist returns the playlist a token is assigned to, or nil.
+func (l *Library) TokenPlaylist(tokenId string) *Playlist {
+	if l == nil {
+		return nil
+	}
+	token, ok := l.Tokens[tokenId]
+	if !ok || token == nil {
+		return nil
+	}
+	return l.StarPlaylist(token.StarID)
+}
@@ -0,0 +1,86 @@
+package jooki
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type QuerySuite struct {}
+var _ = Suite(&QuerySuite{})
+
+func queryLibrary(c *C) *Library {
+	lib := applyFixture(c, NewStateReducer(), "01_get_state.json").Library
+	c.Assert(lib, NotNil)
+	orphan := "Wheels on the Bus"
+	id := "1122334455667788"
+	size := IntStr(1000)
+	lib.Tracks[id] = &Track{ID: &id, Name: &orphan, Size: &size}
+	// a playlist referring to a track that isn't in the library
+	lib.Playlists["5f0c1a2b3c4d5e6f70819205"] = &Playlist{Name: "animals", Tracks: []string{"9b1f3c0d2e4a5b6c", "ffffffffffffffff"}}
+	return lib
+}
+
+func playlistNames(playlists []*Playlist) []string {
+	names := []string{}
+	for _, pl := range playlists {
+		names = append(names, pl.Name)
+	}
+	return names
+}
+
+func trackNames(tracks []*Track) []string {
+	names := []string{}
+	for _, tr := range tracks {
+		names = append(names, *tr.Name)
+	}
+	return names
+}
+
+func (s *QuerySuite) TestPlaylists(c *C) {
+	lib := queryLibrary(c)
+	c.Check(playlistNames(lib.SortedPlaylists()), DeepEquals, []string{"animals", "Bedtime", "Stories"})
+	c.Check(trackNames(lib.PlaylistTracks("5f0c1a2b3c4d5e6f70819203")), DeepEquals, []string{"Twinkle Twinkle", "Brahms Lullaby"})
+	c.Check(trackNames(lib.PlaylistTracks("5f0c1a2b3c4d5e6f70819205")), DeepEquals, []string{"Twinkle Twinkle"})
+	c.Check(lib.PlaylistTracks("nope"), HasLen, 0)
+	c.Check(playlistNames(lib.PlaylistsWithTrack("9b1f3c0d2e4a5b6c")), DeepEquals, []string{"animals", "Bedtime"})
+	c.Check(lib.PlaylistsWithTrack("1122334455667788"), HasLen, 0)
+	pl := lib.TokenPlaylist("04a2b3c4d5e680")
+	c.Assert(pl, NotNil)
+	c.Check(pl.Name, Equals, "Bedtime")
+	c.Check(lib.TokenPlaylist("nope"), IsNil)
+	var nilLib *Library
+	c.Check(nilLib.SortedPlaylists(), HasLen, 0)
+}
+
+func (s *QuerySuite) TestSearchTracks(c *C) {
+	lib := queryLibrary(c)
+	c.Check(trackNames(lib.SearchTracks("lullab")), DeepEquals, []string{"Brahms Lullaby", "Twinkle Twinkle"})
+	c.Check(trackNames(lib.SearchTracks("twinkle LULLABIES")), DeepEquals, []string{"Twinkle Twinkle"})
+	c.Check(trackNames(lib.SearchTracks("grandma bears")), DeepEquals, []string{"The Three Bears"})
+	c.Check(lib.SearchTracks("bears lullabies"), HasLen, 0)
+	c.Check(lib.SearchTracks("  "), HasLen, 0)
+}
+
+func (s *QuerySuite) TestOrphanedTracks(c *C) {
+	lib := queryLibrary(c)
+	orphans := lib.OrphanedTracks()
+	c.Assert(orphans, HasLen, 1)
+	c.Check(*orphans[0].ID, Equals, "1122334455667788")
+}
+
+func (s *QuerySuite) TestPlaylistStats(c *C) {
+	lib := queryLibrary(c)
+	c.Check(lib.PlaylistStats("5f0c1a2b3c4d5e6f70819203"), DeepEquals, &PlaylistStats{
+		Tracks: 2,
+		Duration: 333200 * time.Millisecond,
+		Size: 2912000 + 2419200,
+	})
+	c.Check(lib.PlaylistStats("5f0c1a2b3c4d5e6f70819205"), DeepEquals, &PlaylistStats{
+		Tracks: 1,
+		Missing: 1,
+		Duration: 182 * time.Second,
+		Size: 2912000,
+	})
+	c.Check(lib.PlaylistStats("nope"), IsNil)
+}
@@ -0,0 +1,257 @@
+package jooki
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var (
+	// delay before the first attempt to reestablish a lost connection
+	ReconnectMinBackoff = time.Second
+	// upper bound on the delay between reconnection attempts
+	ReconnectMaxBackoff = time.Minute
+	// number of failed attempts after which the device is rediscovered,
+	// in case it has moved to a new address
+	ReconnectRediscoverAttempts = 5
+	// how long to wait for the broker to accept a connection
+	ConnectTimeout = time.Second * 10
+)
+
+type ConnectionStatus int
+
+const (
+	StatusConnecting = ConnectionStatus(iota)
+	StatusConnected
+	StatusReconnecting
+	StatusClosed
+)
+
+func (s ConnectionStatus) String() string {
+	switch s {
+	case StatusConnecting:
+		return "connecting"
+	case StatusConnected:
+		return "connected"
+	case StatusReconnecting:
+		return "reconnecting"
+	case StatusClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+func (c *Client) Status() ConnectionStatus {
+	c.connLocker.RLock()
+	defer c.connLocker.RUnlock()
+	return c.status
+}
+
+func (c *Client) Connected() bool {
+	return c.Status() == StatusConnected
+}
+
+// OnStatusChange registers a function to be called whenever the
+// connection status changes.  When the connection is lost, err is the
+// reason reported by the MQTT client.  The returned ID can be passed to
+// RemoveStatusHandler.
+func (c *Client) OnStatusChange(f func(status ConnectionStatus, err error)) int {
+	c.connLocker.Lock()
+	defer c.connLocker.Unlock()
+	id := len(c.statusHandlers)
+	for {
+		_, ok := c.statusHandlers[id]
+		if !ok {
+			break
+		}
+		id += 1
+	}
+	c.statusHandlers[id] = f
+	return id
+}
+
+func (c *Client) RemoveStatusHandler(id int) {
+	c.connLocker.Lock()
+	defer c.connLocker.Unlock()
+	delete(c.statusHandlers, id)
+}
+
+// waitConnected waits until the deadline, by the given clock, for the
+// client to be connected.
+func (c *Client) waitConnected(ctx context.Context, clock Clock, deadline time.Time) error {
+	if c.Connected() {
+		return nil
+	}
+	connected := make(chan bool, 1)
+	id := c.OnStatusChange(func(status ConnectionStatus, err error) {
+		if status == StatusConnected {
+			select {
+			case connected <- true:
+			default:
+			}
+		}
+	})
+	defer c.RemoveStatusHandler(id)
+	if c.Connected() {
+		return nil
+	}
+	timer := clock.NewTimer(deadline.Sub(clock.Now()))
+	defer timer.Stop()
+	select {
+	case <-connected:
+		return nil
+	case <-timer.C():
+		return errors.New("jooki not connected")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Client) setStatus(status ConnectionStatus, err error) {
+	c.connLocker.Lock()
+	if c.status == status {
+		c.connLocker.Unlock()
+		return
+	}
+	c.status = status
+	handlers := make([]func(ConnectionStatus, error), 0, len(c.statusHandlers))
+	for _, f := range c.statusHandlers {
+		handlers = append(handlers, f)
+	}
+	c.connLocker.Unlock()
+	for _, f := range handlers {
+		f(status, err)
+	}
+	c.dispatchEvents([]Event{&ConnectionEvent{Status: status, Err: err}})
+}
+
+// reconnectLoop retries the connection with exponential backoff until it
+// succeeds or the client is closed.  Awaiters are left open throughout so
+// that pending commands can still complete once the state resyncs.
+func (c *Client) reconnectLoop() {
+	c.connLocker.Lock()
+	if c.reconnecting || c.closed {
+		c.connLocker.Unlock()
+		return
+	}
+	c.reconnecting = true
+	done := c.done
+	c.connLocker.Unlock()
+	defer func() {
+		c.connLocker.Lock()
+		c.reconnecting = false
+		c.connLocker.Unlock()
+	}()
+	delay := ReconnectMinBackoff
+	attempts := 0
+	for {
+		timer := time.NewTimer(delay)
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		err := c.reconnect()
+		if err == nil {
+			return
+		}
+		attempts += 1
+		log.Printf("jooki reconnect attempt %d failed: %s", attempts, err)
+		if ReconnectRediscoverAttempts > 0 && attempts % ReconnectRediscoverAttempts == 0 {
+			err = c.rediscover()
+			if err != nil {
+				log.Println("can't rediscover jooki:", err)
+			}
+		}
+		delay *= 2
+		if delay > ReconnectMaxBackoff {
+			delay = ReconnectMaxBackoff
+		}
+	}
+}
+
+func (c *Client) reconnect() error {
+	c.reconnectLocker.Lock()
+	defer c.reconnectLocker.Unlock()
+	if c.Closed() {
+		return errors.New("jooki client is closed")
+	}
+	if c.Connected() {
+		return nil
+	}
+	conn := c.mqttConn()
+	err := c.connect(conn)
+	if err != nil {
+		return err
+	}
+	err = c.resume()
+	if err != nil {
+		conn.Disconnect(0)
+		return err
+	}
+	log.Println("jooki connection reestablished")
+	c.setStatus(StatusConnected, nil)
+	return nil
+}
+
+// connect waits up to ConnectTimeout for conn to connect, giving up
+// early if the client is closed.
+func (c *Client) connect(conn mqtt.Client) error {
+	c.connLocker.RLock()
+	done := c.done
+	c.connLocker.RUnlock()
+	tok := conn.Connect()
+	timer := time.NewTimer(ConnectTimeout)
+	defer timer.Stop()
+	select {
+	case <-tok.Done():
+		return tok.Error()
+	case <-done:
+		conn.Disconnect(0)
+		return errors.New("jooki client is closed")
+	case <-timer.C:
+		conn.Disconnect(0)
+		return errors.New("timeout connecting to jooki")
+	}
+}
+
+// rediscover looks for the device by ID or hostname and, if its address
+// has changed, points the client at the new address.
+func (c *Client) rediscover() error {
+	c.connLocker.RLock()
+	device := c.device
+	c.connLocker.RUnlock()
+	results, err := DiscoverAll()
+	if err != nil {
+		return err
+	}
+	var res *DiscoveryResult
+	if device.ID != "" {
+		res = FindDevice(results, device.ID)
+	}
+	if res == nil && device.Hostname != "" && device.Hostname != device.IP {
+		res = FindDevice(results, device.Hostname)
+	}
+	if res == nil || !res.Online() {
+		return errors.New("jooki device not found")
+	}
+	if res.Device.IP == device.IP {
+		return nil
+	}
+	log.Printf("jooki moved from %s to %s", device.IP, res.Device.IP)
+	c.reconnectLocker.Lock()
+	defer c.reconnectLocker.Unlock()
+	c.connLocker.Lock()
+	defer c.connLocker.Unlock()
+	if c.conn != nil && c.conn.IsConnected() {
+		c.conn.Disconnect(0)
+	}
+	c.device = res.Device
+	c.dpi = res.Ping
+	c.conn = c.newConn(res.Device)
+	return nil
+}
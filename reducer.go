@@ -0,0 +1,103 @@
+package jooki
+
+import (
+	"encoding/json"
+)
+
+// StateReducer rebuilds the device state from the stream of partial
+// state documents published on /j/web/output/state.  Each document is
+// applied as a JSON merge patch (RFC 7386): objects are merged key by
+// key, a null value deletes the key, and anything else (including an
+// empty array, which the device sends in place of an empty object)
+// replaces the existing value outright.
+//
+// The exception is the full state dump the device sends in reply to
+// GET_STATE, which has no nulls for whatever was deleted since the last
+// one.  Call Reset before requesting it so that it replaces the
+// accumulated state instead of being merged into it.
+type StateReducer struct {
+	doc map[string]interface{}
+	state *JookiState
+	replace bool
+}
+
+func NewStateReducer() *StateReducer {
+	return &StateReducer{
+		doc: map[string]interface{}{},
+		state: &JookiState{},
+	}
+}
+
+// Apply merges a state document into the accumulated state and returns
+// the result.  If the document isn't valid JSON, the accumulated state is
+// left unchanged.  If some part of it doesn't decode, the error is
+// returned along with the rest of the state.
+func (r *StateReducer) Apply(delta []byte) (*JookiState, error) {
+	var patch interface{}
+	err := json.Unmarshal(delta, &patch)
+	if err != nil {
+		return r.state, err
+	}
+	var target interface{} = r.doc
+	if r.replace {
+		target = nil
+	}
+	doc, ok := MergePatch(target, patch).(map[string]interface{})
+	if !ok {
+		doc = map[string]interface{}{}
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return r.state, err
+	}
+	// a value of the wrong type is skipped, leaving its field empty, but
+	// the rest of the state is still decoded
+	state := &JookiState{}
+	err = json.Unmarshal(data, state)
+	r.doc = doc
+	r.state = state
+	r.replace = false
+	return state, err
+}
+
+// Reset makes the next document replace the accumulated state rather
+// than being merged into it.  Until then, State still returns the old
+// state.
+func (r *StateReducer) Reset() {
+	r.replace = true
+}
+
+// State returns the accumulated state.  The caller must not modify it.
+func (r *StateReducer) State() *JookiState {
+	return r.state
+}
+
+// Document returns the accumulated state as raw JSON.
+func (r *StateReducer) Document() ([]byte, error) {
+	return json.Marshal(r.doc)
+}
+
+// MergePatch applies a JSON merge patch, as decoded by encoding/json into
+// an interface{}, to a target document.  The target is not modified;
+// objects along the patched paths are copied and everything else is
+// shared with the result.
+func MergePatch(target, patch interface{}) interface{} {
+	obj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	doc := map[string]interface{}{}
+	if orig, ok := target.(map[string]interface{}); ok {
+		for k, v := range orig {
+			doc[k] = v
+		}
+	}
+	for k, v := range obj {
+		if v == nil {
+			delete(doc, k)
+		} else {
+			doc[k] = MergePatch(doc[k], v)
+		}
+	}
+	return doc
+}
@@ -0,0 +1,159 @@
+package jooki
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+type ReducerSuite struct {}
+var _ = Suite(&ReducerSuite{})
+
+func applyFixture(c *C, r *StateReducer, name string) *JookiState {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "state", name))
+	c.Assert(err, IsNil)
+	state, err := r.Apply(data)
+	c.Assert(err, IsNil)
+	return state
+}
+
+func (s *ReducerSuite) TestMergePatch(c *C) {
+	target := map[string]interface{}{
+		"a": "b",
+		"c": map[string]interface{}{"d": "e", "f": "g"},
+	}
+	patch := map[string]interface{}{
+		"a": "z",
+		"c": map[string]interface{}{"f": nil},
+	}
+	result := MergePatch(target, patch)
+	c.Check(result, DeepEquals, map[string]interface{}{
+		"a": "z",
+		"c": map[string]interface{}{"d": "e"},
+	})
+	c.Check(target["a"], Equals, "b")
+	c.Check(target["c"].(map[string]interface{})["f"], Equals, "g")
+	c.Check(MergePatch(target, []interface{}{}), DeepEquals, []interface{}{})
+	c.Check(MergePatch([]interface{}{}, patch), DeepEquals, map[string]interface{}{
+		"a": "z",
+		"c": map[string]interface{}{},
+	})
+}
+
+func (s *ReducerSuite) TestDeviceSequence(c *C) {
+	r := NewStateReducer()
+	state := applyFixture(c, r, "01_get_state.json")
+	c.Assert(state.Library, NotNil)
+	c.Check(state.Library.Playlists, HasLen, 2)
+	c.Check(state.Library.Tracks, HasLen, 3)
+	c.Check(*state.Library.Playlists["5f0c1a2b3c4d5e6f70819203"].ID, Equals, "5f0c1a2b3c4d5e6f70819203")
+	c.Check(*state.Library.Playlists["5f0c1a2b3c4d5e6f70819204"].Audiobook, Equals, true)
+	c.Check(*state.Library.Tracks["8899aabbccddeeff"].ID, Equals, "8899aabbccddeeff")
+	c.Check(*state.Audio.NowPlaying.TrackID, Equals, "9b1f3c0d2e4a5b6c")
+	c.Check(state.NFC.Empty(), Equals, true)
+	c.Check(state.Settings.QuietTime.Active, Equals, true)
+
+	state = applyFixture(c, r, "02_playlist_deleted.json")
+	c.Check(state.Library.Playlists, HasLen, 1)
+	_, ok := state.Library.Playlists["5f0c1a2b3c4d5e6f70819204"]
+	c.Check(ok, Equals, false)
+	c.Check(state.Library.Tracks, HasLen, 3)
+
+	state = applyFixture(c, r, "03_track_deleted.json")
+	c.Check(state.Library.Tracks, HasLen, 2)
+	_, ok = state.Library.Tracks["8899aabbccddeeff"]
+	c.Check(ok, Equals, false)
+
+	state = applyFixture(c, r, "04_volume.json")
+	c.Check(state.Audio.Config.Volume, Equals, uint8(35))
+	c.Check(state.Audio.NowPlaying, NotNil)
+	c.Check(state.Audio.Playback.Position, Equals, 61234)
+
+	state = applyFixture(c, r, "05_position.json")
+	c.Check(state.Audio.Playback.Position, Equals, 71234)
+	c.Check(state.Audio.Config.Volume, Equals, uint8(35))
+
+	state = applyFixture(c, r, "06_stopped.json")
+	c.Check(state.Audio.NowPlaying, IsNil)
+	c.Check(state.Audio.Playback.State, Equals, PlaybackStateEnded)
+	c.Check(state.Audio.Config, NotNil)
+
+	state = applyFixture(c, r, "07_playlist_renamed.json")
+	c.Check(state.Library.Playlists["5f0c1a2b3c4d5e6f70819203"].Name, Equals, "Sleepy Time")
+	c.Check(state.Library.Tracks, HasLen, 2)
+	c.Check(state.Device.Hostname, Equals, "jooki-7f3a")
+
+	state = applyFixture(c, r, "08_library_cleared.json")
+	c.Check(state.Library.Playlists, HasLen, 0)
+	c.Check(state.Library.Tokens, HasLen, 0)
+	c.Check(state.Library.Tracks, HasLen, 0)
+}
+
+func (s *ReducerSuite) TestBadDelta(c *C) {
+	r := NewStateReducer()
+	before := applyFixture(c, r, "04_volume.json")
+	state, err := r.Apply([]byte(`{"audio":`))
+	c.Check(err, NotNil)
+	c.Check(state, Equals, before)
+	state, err = r.Apply([]byte(`{"audio":{"config":{"volume":"loud"}},"device":{"firmware":"1.5.0"}}`))
+	c.Check(err, NotNil)
+	c.Check(state, Not(Equals), before)
+	c.Check(state.Audio.Config.Volume, Equals, uint8(0))
+	c.Check(state.Audio.Config.ShuffleMode, Equals, false)
+	c.Check(state.Device.Firmware, Equals, "1.5.0")
+	c.Check(r.State(), Equals, state)
+	state, err = r.Apply([]byte(`{"audio":{"config":{"volume":40}}}`))
+	c.Check(err, IsNil)
+	c.Check(state.Audio.Config.Volume, Equals, uint8(40))
+	c.Check(state.Device.Firmware, Equals, "1.5.0")
+}
+
+func (s *ReducerSuite) TestReset(c *C) {
+	r := NewStateReducer()
+	state := applyFixture(c, r, "01_get_state.json")
+	c.Assert(state.Library.Playlists, HasLen, 2)
+	r.Reset()
+	c.Check(r.State().Library.Playlists, HasLen, 2)
+	state, err := r.Apply([]byte(`{"db":{"playlists":{"5f0c1a2b3c4d5e6f70819203":{"title":"Only"}}}}`))
+	c.Assert(err, IsNil)
+	c.Check(state.Library.Playlists, HasLen, 1)
+	c.Check(state.Library.Tracks, HasLen, 0)
+	c.Check(state.Audio, IsNil)
+	// back to merging after the replacement
+	state, err = r.Apply([]byte(`{"db":{"playlists":{"5f0c1a2b3c4d5e6f70819204":{"title":"Another"}}}}`))
+	c.Assert(err, IsNil)
+	c.Check(state.Library.Playlists, HasLen, 2)
+}
+
+func (s *ReducerSuite) TestUnexpectedShape(c *C) {
+	r := NewStateReducer()
+	applyFixture(c, r, "01_get_state.json")
+	state, err := r.Apply([]byte(`{"device":{"flags":{"beta":true}}}`))
+	c.Assert(err, IsNil)
+	c.Check(state.Library.Playlists, HasLen, 2)
+	c.Check(state.Device.Hostname, Equals, "jooki-7f3a")
+	c.Check(state.Device.Flags, IsNil)
+	c.Check(string(state.Device.Raw), Matches, `.*"flags":\{"beta":true\}.*`)
+	state, err = r.Apply([]byte(`{"settings":{"quietTime":"off"},"deezer":[{"id":7}],"userMessages":["hello"]}`))
+	c.Assert(err, IsNil)
+	c.Check(string(state.Settings.Raw), Equals, `{"quietTime":"off"}`)
+	c.Assert(state.Deezer, HasLen, 1)
+	c.Check(string(state.Deezer[0].Raw), Equals, `{"id":7}`)
+	c.Assert(state.UserMessages, HasLen, 1)
+	c.Check(string(state.UserMessages[0].Raw), Equals, `"hello"`)
+	// shapes that fit don't keep a copy
+	state, err = r.Apply([]byte(`{"device":{"flags":["beta"]}}`))
+	c.Assert(err, IsNil)
+	c.Check(state.Device.Flags, DeepEquals, []string{"beta"})
+	c.Check(state.Device.Raw, IsNil)
+}
+
+func (s *ReducerSuite) TestHasPosition(c *C) {
+	c.Check(hasPosition([]byte(`{"audio":{"playback":{"position_ms":0}}}`)), Equals, true)
+	c.Check(hasPosition([]byte(`{"audio":{"playback":{"position_ms":61234,"state":"PLAYING"}}}`)), Equals, true)
+	c.Check(hasPosition([]byte(`{"audio":{"playback":{"state":"PAUSED"}}}`)), Equals, false)
+	c.Check(hasPosition([]byte(`{"audio":{"playback":null}}`)), Equals, false)
+	c.Check(hasPosition([]byte(`{"audio":{"config":{"volume":35}}}`)), Equals, false)
+	c.Check(hasPosition([]byte(`{"audio":`)), Equals, false)
+}
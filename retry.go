@@ -0,0 +1,296 @@
+package jooki
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"path/filepath"
+	"time"
+)
+
+var (
+	// number of times a failed upload is retried
+	UploadRetries = 3
+	// delay before the first retry of a failed upload
+	UploadMinBackoff = time.Second
+	// upper bound on the delay between upload retries
+	UploadMaxBackoff = time.Second * 30
+	// how far the duration the device reports for an upload may be from
+	// the duration of the local file
+	UploadDurationTolerance = time.Second
+)
+
+type UploadOptions struct {
+	// retries after the first attempt fails; defaults to UploadRetries,
+	// and a negative value disables retries
+	Retries int
+	// defaults to UploadMinBackoff and UploadMaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// don't check the uploaded track against the local file
+	NoVerify bool
+}
+
+// TrackDuration is implemented by TrackUploads that know how long they
+// are, so that the upload can be checked against the duration the
+// device reports.  A zero duration means it isn't known.
+type TrackDuration interface {
+	Duration() time.Duration
+}
+
+// VerifyError reports that a track in the library doesn't match the
+// file that was uploaded.
+type VerifyError struct {
+	TrackID string
+	Field string
+	Expected string
+	Actual string
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("uploaded track %s has %s %s, expected %s", e.TrackID, e.Field, e.Actual, e.Expected)
+}
+
+// localError marks upload failures caused by the track itself, e.g. a
+// file that can't be read, which retrying won't fix.
+type localError struct {
+	err error
+}
+
+func (e *localError) Error() string {
+	return e.err.Error()
+}
+
+func (e *localError) Unwrap() error {
+	return e.err
+}
+
+// UploadTrack uploads a track to a playlist, retrying with exponential
+// backoff if the upload fails or the result doesn't match the local
+// file.  The device can't resume an upload, so each retry sends the
+// whole file again.  If the track is already in the library, it's added
+// to the playlist without uploading it.  Progress updates for every
+// attempt are sent on ch, which is closed when the upload is finished.
+func (c *Client) UploadTrack(playlistId string, track TrackUpload, opts *UploadOptions, ch chan ProgressUpdate) *UploadResult {
+	return c.UploadTrackContext(context.Background(), playlistId, track, opts, ch)
+}
+
+func (c *Client) UploadTrackContext(ctx context.Context, playlistId string, track TrackUpload, opts *UploadOptions, ch chan ProgressUpdate) *UploadResult {
+	if ch != nil {
+		defer close(ch)
+	}
+	if opts == nil {
+		opts = &UploadOptions{}
+	}
+	retries := opts.Retries
+	if retries == 0 {
+		retries = UploadRetries
+	}
+	delay := opts.MinBackoff
+	if delay <= 0 {
+		delay = UploadMinBackoff
+	}
+	maxDelay := opts.MaxBackoff
+	if maxDelay <= 0 {
+		maxDelay = UploadMaxBackoff
+	}
+	res := &UploadResult{Path: track.FileName()}
+	id := track.MD5()[:16]
+	before := c.GetState()
+	if before == nil || before.Library == nil {
+		res.Err = errors.New("jooki library not loaded")
+		return res
+	}
+	if _, ok := before.Library.Tracks[id]; ok {
+		res.Existing = true
+	}
+	partial := map[string]bool{}
+	defer c.unlistOrphans(playlistId, res)
+	for try := 0; ; try++ {
+		tr, err := c.ensureTrack(ctx, playlistId, id)
+		if tr == nil && err == nil {
+			res.Attempts += 1
+			tr, err = c.uploadAttempt(ctx, playlistId, track, ch)
+		}
+		if err == nil && !opts.NoVerify {
+			err = verifyUpload(track, tr)
+			res.Verified = err == nil
+			var verr *VerifyError
+			if errors.As(err, &verr) && verr.Field == "duration" {
+				// the device has exactly the file that was sent, so
+				// sending it again won't change how it reads it
+				res.Err = err
+				return res
+			}
+		}
+		if err == nil {
+			res.Track = tr
+			res.Err = nil
+			return res
+		}
+		res.Err = err
+		for _, k := range c.partialUploads(before, track, id) {
+			if !partial[k] {
+				partial[k] = true
+				res.Orphaned = append(res.Orphaned, k)
+			}
+		}
+		var lerr *localError
+		if errors.As(err, &lerr) {
+			res.Err = lerr.err
+			return res
+		}
+		if ctx.Err() != nil || try >= retries {
+			return res
+		}
+		log.Printf("upload of %s failed (attempt %d): %s; retrying in %s", track.FileName(), try + 1, err, delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			res.Err = ctx.Err()
+			return res
+		case <-timer.C:
+		}
+		delay *= 2
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
+
+// ensureTrack checks whether a track is already in the library, e.g.
+// because an earlier attempt to upload it got through even though it
+// appeared to fail, and if so makes sure it's on the playlist.  It
+// returns nil if the track isn't in the library.
+func (c *Client) ensureTrack(ctx context.Context, playlistId, id string) (*Track, error) {
+	state := c.GetState()
+	tr, ok := state.Library.Tracks[id]
+	if !ok {
+		return nil, nil
+	}
+	pl, ok := state.Library.Playlists[playlistId]
+	if !ok {
+		return nil, errors.New("no such playlist")
+	}
+	for _, trackId := range pl.Tracks {
+		if trackId == id {
+			return tr, nil
+		}
+	}
+	addCtx, cancel := context.WithTimeout(ctx, time.Second * 5)
+	defer cancel()
+	_, err := c.AddTrackToPlaylistContext(addCtx, playlistId, id)
+	if err != nil {
+		return nil, err
+	}
+	return tr, nil
+}
+
+// uploadAttempt makes a single upload, passing its progress updates on
+// to ch.  It doesn't fall back to matching the track by name and size,
+// so an upload the device stored under the wrong checksum fails and is
+// tried again.
+func (c *Client) uploadAttempt(ctx context.Context, playlistId string, track TrackUpload, ch chan ProgressUpdate) (*Track, error) {
+	attemptCh := make(chan ProgressUpdate, 100)
+	done := make(chan bool)
+	go func() {
+		for update := range attemptCh {
+			if ch != nil {
+				ch <- update
+			}
+		}
+		close(done)
+	}()
+	tr, err := c.uploadToPlaylist(ctx, playlistId, track, attemptCh, false)
+	<-done
+	return tr, err
+}
+
+// partialUploads finds tracks that have appeared in the library since
+// the upload started with the same file name as the upload but not the
+// same content.
+func (c *Client) partialUploads(before *JookiState, track TrackUpload, id string) []string {
+	state := c.GetState()
+	if state == nil || state.Library == nil {
+		return nil
+	}
+	name := filepath.Base(track.FileName())
+	found := []string{}
+	for k, tr := range state.Library.Tracks {
+		if k == id || tr.Location == nil || *tr.Location != name {
+			continue
+		}
+		if _, ok := before.Library.Tracks[k]; ok {
+			continue
+		}
+		found = append(found, k)
+	}
+	return found
+}
+
+// unlistOrphans takes the tracks left by failed attempts off the
+// playlist, where a corrupt upload will have been added.  It carries on
+// even if the upload was cancelled.
+func (c *Client) unlistOrphans(playlistId string, res *UploadResult) {
+	if len(res.Orphaned) == 0 {
+		return
+	}
+	orphaned := map[string]bool{}
+	for _, id := range res.Orphaned {
+		orphaned[id] = true
+	}
+	state := c.GetState()
+	pl, ok := state.Library.Playlists[playlistId]
+	if !ok {
+		return
+	}
+	tracks := []string{}
+	for _, id := range pl.Tracks {
+		if !orphaned[id] {
+			tracks = append(tracks, id)
+		}
+	}
+	if len(tracks) == len(pl.Tracks) {
+		return
+	}
+	_, err := c.UpdatePlaylistTracks(playlistId, tracks)
+	if err != nil {
+		log.Println("can't remove failed uploads from jooki playlist:", err)
+	}
+}
+
+// verifyUpload checks a track in the library against the file it was
+// uploaded from.
+func verifyUpload(track TrackUpload, tr *Track) error {
+	id := ""
+	if tr.ID != nil {
+		id = *tr.ID
+	}
+	if expected := track.MD5()[:16]; id != expected {
+		return &VerifyError{TrackID: id, Field: "md5", Expected: expected, Actual: id}
+	}
+	if sizer, ok := track.(TrackSizer); ok && tr.Size != nil && int64(*tr.Size) != sizer.Size() {
+		return &VerifyError{
+			TrackID: id,
+			Field: "size",
+			Expected: fmt.Sprintf("%d", sizer.Size()),
+			Actual: fmt.Sprintf("%d", *tr.Size),
+		}
+	}
+	if dur, ok := track.(TrackDuration); ok && dur.Duration() > 0 && tr.Duration != nil {
+		expected := dur.Duration().Seconds()
+		actual := float64(*tr.Duration)
+		if math.Abs(expected - actual) > UploadDurationTolerance.Seconds() {
+			return &VerifyError{
+				TrackID: id,
+				Field: "duration",
+				Expected: fmt.Sprintf("%.3fs", expected),
+				Actual: fmt.Sprintf("%.3fs", actual),
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,647 @@
+package jooki
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ScheduleGrace is how long a job that comes due while the device is
+// disconnected waits for the connection to come back before it's given
+// up on.
+var ScheduleGrace = time.Minute * 10
+
+type ScheduleAction string
+
+const (
+	// play a playlist
+	SchedulePlay = ScheduleAction("play")
+	SchedulePause = ScheduleAction("pause")
+	ScheduleVolume = ScheduleAction("volume")
+	ScheduleShuffle = ScheduleAction("shuffle")
+	// fade the volume (see FadeVolume)
+	ScheduleFade = ScheduleAction("fade")
+)
+
+// JobStep is one thing a scheduled job does.
+type JobStep struct {
+	Action ScheduleAction `json:"action"`
+	// for play: the ID or name of the playlist, and the track to start
+	// at, counting from 0
+	Playlist string `json:"playlist,omitempty"`
+	TrackIndex int `json:"trackIndex,omitempty"`
+	// for volume and fade
+	Volume *int `json:"volume,omitempty"`
+	// for fade: how long it takes, and whether to pause and put the
+	// volume back afterwards
+	Seconds int `json:"seconds,omitempty"`
+	Pause bool `json:"pause,omitempty"`
+	Restore bool `json:"restore,omitempty"`
+	// for shuffle
+	Shuffle *bool `json:"shuffle,omitempty"`
+	// the volume before a fade first started, so that one that starts
+	// over still restores it
+	restoreVolume *int
+}
+
+func (st *JobStep) validate() error {
+	switch st.Action {
+	case SchedulePlay:
+		if st.Playlist == "" {
+			return errors.New("play needs a playlist")
+		}
+	case SchedulePause:
+	case ScheduleVolume, ScheduleFade:
+		if st.Volume == nil || *st.Volume < 0 || *st.Volume > 100 {
+			return fmt.Errorf("%s needs a volume from 0 to 100", st.Action)
+		}
+		if st.Seconds < 0 {
+			return fmt.Errorf("%s can't take %d seconds", st.Action, st.Seconds)
+		}
+	case ScheduleShuffle:
+		if st.Shuffle == nil {
+			return errors.New("shuffle needs on or off")
+		}
+	default:
+		return fmt.Errorf("unknown action %q", st.Action)
+	}
+	return nil
+}
+
+func (st *JobStep) String() string {
+	switch st.Action {
+	case SchedulePlay:
+		return fmt.Sprintf("play %s", st.Playlist)
+	case ScheduleVolume:
+		if st.Volume != nil {
+			return fmt.Sprintf("volume %d", *st.Volume)
+		}
+	case ScheduleShuffle:
+		if st.Shuffle != nil {
+			return fmt.Sprintf("shuffle %t", *st.Shuffle)
+		}
+	case ScheduleFade:
+		if st.Volume != nil {
+			s := fmt.Sprintf("fade to %d over %s", *st.Volume, time.Duration(st.Seconds) * time.Second)
+			if st.Pause {
+				s += " and pause"
+			}
+			if st.Restore {
+				s += " and restore"
+			}
+			return s
+		}
+	}
+	return string(st.Action)
+}
+
+// Job is a list of steps to run at set times: either every day at a
+// time of day, or on a cron schedule (see CronSchedule).
+type Job struct {
+	ID string `json:"id"`
+	Name string `json:"name,omitempty"`
+	Cron string `json:"cron,omitempty"`
+	At *TimeOfDay `json:"at,omitempty"`
+	Steps []*JobStep `json:"steps"`
+	Disabled bool `json:"disabled,omitempty"`
+	cron *CronSchedule
+}
+
+func (j *Job) Clone() *Job {
+	if j == nil {
+		return nil
+	}
+	clone := *j
+	clone.At = j.At.Clone()
+	clone.Steps = make([]*JobStep, len(j.Steps))
+	for i, st := range j.Steps {
+		if st == nil {
+			continue
+		}
+		v := *st
+		if st.Volume != nil {
+			vol := *st.Volume
+			v.Volume = &vol
+		}
+		if st.Shuffle != nil {
+			shuffle := *st.Shuffle
+			v.Shuffle = &shuffle
+		}
+		clone.Steps[i] = &v
+	}
+	return &clone
+}
+
+func (j *Job) validate() error {
+	switch {
+	case j.Cron != "" && j.At != nil:
+		return errors.New("job has both a cron schedule and a time of day")
+	case j.Cron != "":
+		cron, err := ParseCron(j.Cron)
+		if err != nil {
+			return err
+		}
+		j.cron = cron
+	case j.At != nil:
+		if !j.At.Valid() {
+			return fmt.Errorf("bad time of day %s", j.At)
+		}
+	default:
+		return errors.New("job has no schedule")
+	}
+	if len(j.Steps) == 0 {
+		return errors.New("job has no steps")
+	}
+	for i, st := range j.Steps {
+		if st == nil {
+			return fmt.Errorf("step %d is empty", i + 1)
+		}
+		if err := st.validate(); err != nil {
+			return fmt.Errorf("step %d: %s", i + 1, err)
+		}
+	}
+	return nil
+}
+
+// Next returns the first time after t that the job is due, or the zero
+// time if it never is.
+func (j *Job) Next(t time.Time) time.Time {
+	if j.cron != nil {
+		return j.cron.Next(t)
+	}
+	if j.At == nil {
+		return time.Time{}
+	}
+	next := j.At.Next(t)
+	if !next.After(t) {
+		next = j.At.Next(t.Add(time.Minute))
+	}
+	return next
+}
+
+func (j *Job) String() string {
+	when := j.Cron
+	if j.At != nil {
+		when = "at " + j.At.String()
+	}
+	steps := make([]string, len(j.Steps))
+	for i, st := range j.Steps {
+		steps[i] = st.String()
+	}
+	s := fmt.Sprintf("%s %s: %s", j.ID, when, strings.Join(steps, ", "))
+	if j.Name != "" {
+		s = fmt.Sprintf("%s (%s)", s, j.Name)
+	}
+	if j.Disabled {
+		s += " [disabled]"
+	}
+	return s
+}
+
+// JobRun reports a job having been run.
+type JobRun struct {
+	Job *Job
+	// when the job was due
+	Scheduled time.Time
+	Started time.Time
+	Finished time.Time
+	Err error
+}
+
+type SchedulerOptions struct {
+	// defaults to the client's clock
+	Clock Clock
+	// where the schedule is saved; if the file exists, the schedule is
+	// loaded from it
+	File string
+	// called after each job runs
+	OnRun func(*JobRun)
+}
+
+// Scheduler runs jobs on a Client at set times, e.g. to start a bedtime
+// playlist every evening.  Jobs that come due while the device is
+// disconnected wait for it to reconnect (see ScheduleGrace), and jobs
+// that came due while the scheduler wasn't running are skipped.
+type Scheduler struct {
+	client *Client
+	clock Clock
+	file string
+	onRun func(*JobRun)
+	locker *sync.Mutex
+	jobs []*Job
+	wake chan bool
+	cancel context.CancelFunc
+	done chan bool
+	wg *sync.WaitGroup
+}
+
+func NewScheduler(client *Client, opts *SchedulerOptions) (*Scheduler, error) {
+	if opts == nil {
+		opts = &SchedulerOptions{}
+	}
+	s := &Scheduler{
+		client: client,
+		clock: opts.Clock,
+		file: opts.File,
+		onRun: opts.OnRun,
+		locker: &sync.Mutex{},
+		jobs: []*Job{},
+		wake: make(chan bool, 1),
+		wg: &sync.WaitGroup{},
+	}
+	if s.clock == nil {
+		s.clock = client.Clock()
+	}
+	if s.file != "" {
+		err := s.load()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+type scheduleFile struct {
+	Jobs []*Job `json:"jobs"`
+}
+
+func (s *Scheduler) load() error {
+	data, err := ioutil.ReadFile(s.file)
+	if err != nil {
+		return err
+	}
+	sf := &scheduleFile{}
+	err = json.Unmarshal(data, sf)
+	if err != nil {
+		return fmt.Errorf("can't read schedule %s: %s", s.file, err)
+	}
+	for _, job := range sf.Jobs {
+		if job == nil {
+			continue
+		}
+		if err := job.validate(); err != nil {
+			return fmt.Errorf("can't read schedule %s: job %s: %s", s.file, job.ID, err)
+		}
+		s.jobs = append(s.jobs, job)
+	}
+	return nil
+}
+
+// save writes the schedule to the file.  The caller must hold the lock.
+func (s *Scheduler) save() error {
+	if s.file == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(&scheduleFile{Jobs: s.jobs}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.file, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// Jobs lists the scheduled jobs, in the order they were added.
+func (s *Scheduler) Jobs() []*Job {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	jobs := make([]*Job, len(s.jobs))
+	for i, job := range s.jobs {
+		jobs[i] = job.Clone()
+	}
+	return jobs
+}
+
+// Add schedules a job, or replaces the job with the same ID.  Jobs
+// without an ID are given one.  The schedule is saved before Add
+// returns.
+func (s *Scheduler) Add(job *Job) (*Job, error) {
+	job = job.Clone()
+	err := job.validate()
+	if err != nil {
+		return nil, err
+	}
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	jobs := append([]*Job{}, s.jobs...)
+	if job.ID == "" {
+		n := 0
+		for _, other := range jobs {
+			if v, err := strconv.Atoi(other.ID); err == nil && v > n {
+				n = v
+			}
+		}
+		job.ID = strconv.Itoa(n + 1)
+	}
+	replaced := false
+	for i, other := range jobs {
+		if other.ID == job.ID {
+			jobs[i] = job
+			replaced = true
+		}
+	}
+	if !replaced {
+		jobs = append(jobs, job)
+	}
+	err = s.setJobs(jobs)
+	if err != nil {
+		return nil, err
+	}
+	return job.Clone(), nil
+}
+
+// Remove takes a job off the schedule.
+func (s *Scheduler) Remove(id string) error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	jobs := []*Job{}
+	for _, job := range s.jobs {
+		if job.ID != id {
+			jobs = append(jobs, job)
+		}
+	}
+	if len(jobs) == len(s.jobs) {
+		return fmt.Errorf("no job %s", id)
+	}
+	return s.setJobs(jobs)
+}
+
+// setJobs replaces the schedule and saves it.  The caller must hold the
+// lock.
+func (s *Scheduler) setJobs(jobs []*Job) error {
+	prev := s.jobs
+	s.jobs = jobs
+	err := s.save()
+	if err != nil {
+		s.jobs = prev
+		return err
+	}
+	select {
+	case s.wake <- true:
+	default:
+	}
+	return nil
+}
+
+// Next returns the job that's due next after t, and when, or nil if no
+// jobs are scheduled.
+func (s *Scheduler) Next(t time.Time) (*Job, time.Time) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	var next *Job
+	var when time.Time
+	for _, job := range s.jobs {
+		if job.Disabled {
+			continue
+		}
+		tm := job.Next(t)
+		if tm.IsZero() {
+			continue
+		}
+		if next == nil || tm.Before(when) {
+			next = job
+			when = tm
+		}
+	}
+	return next.Clone(), when
+}
+
+// due lists the jobs due after last and up to now, in the order they
+// came due.
+func (s *Scheduler) due(last, now time.Time) []*JobRun {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	runs := []*JobRun{}
+	for _, job := range s.jobs {
+		if job.Disabled {
+			continue
+		}
+		tm := job.Next(last)
+		if !tm.IsZero() && !tm.After(now) {
+			runs = append(runs, &JobRun{Job: job.Clone(), Scheduled: tm})
+		}
+	}
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].Scheduled.Before(runs[j].Scheduled) })
+	return runs
+}
+
+// Start runs the scheduler in the background until Stop is called.
+func (s *Scheduler) Start() {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if s.done != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.done = make(chan bool)
+	go s.loop(ctx, s.done)
+}
+
+// Stop stops the scheduler, cancelling any jobs that are running, and
+// waits for them to finish.
+func (s *Scheduler) Stop() {
+	s.locker.Lock()
+	cancel, done := s.cancel, s.done
+	s.cancel = nil
+	s.done = nil
+	s.locker.Unlock()
+	if done == nil {
+		return
+	}
+	cancel()
+	<-done
+	s.wg.Wait()
+}
+
+func (s *Scheduler) loop(ctx context.Context, done chan bool) {
+	defer close(done)
+	last := s.clock.Now()
+	for {
+		_, next := s.Next(last)
+		var timer Timer
+		var fire <-chan time.Time
+		if !next.IsZero() {
+			timer = s.clock.NewTimer(next.Sub(s.clock.Now()))
+			fire = timer.C()
+		}
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case <-s.wake:
+			now := s.clock.Now()
+			if timer != nil && !timer.Stop() {
+				// the timer went off too, so catch up with it first
+				s.runDue(ctx, last, now)
+			}
+			// a job added or enabled now is due from now on, not at a
+			// time that's already passed today
+			last = now
+		case <-fire:
+			now := s.clock.Now()
+			s.runDue(ctx, last, now)
+			last = now
+		}
+	}
+}
+
+func (s *Scheduler) runDue(ctx context.Context, last, now time.Time) {
+	for _, run := range s.due(last, now) {
+		s.wg.Add(1)
+		go func(run *JobRun) {
+			defer s.wg.Done()
+			s.run(ctx, run)
+		}(run)
+	}
+}
+
+// RunJob runs a scheduled job now.
+func (s *Scheduler) RunJob(ctx context.Context, id string) error {
+	var job *Job
+	for _, j := range s.Jobs() {
+		if j.ID == id {
+			job = j
+		}
+	}
+	if job == nil {
+		return fmt.Errorf("no job %s", id)
+	}
+	run := &JobRun{Job: job, Scheduled: s.clock.Now()}
+	s.run(ctx, run)
+	return run.Err
+}
+
+func (s *Scheduler) run(ctx context.Context, run *JobRun) {
+	run.Started = s.clock.Now()
+	deadline := run.Started.Add(ScheduleGrace)
+	locker := &sync.Mutex{}
+	var cancelStep context.CancelFunc
+	dropped := false
+	id := s.client.OnStatusChange(func(status ConnectionStatus, err error) {
+		if status == StatusConnected {
+			return
+		}
+		locker.Lock()
+		defer locker.Unlock()
+		dropped = true
+		if cancelStep != nil {
+			cancelStep()
+		}
+	})
+	for i, st := range run.Job.Steps {
+		run.Err = s.runStep(ctx, st, deadline, func(cancel context.CancelFunc) bool {
+			locker.Lock()
+			defer locker.Unlock()
+			lost := dropped
+			dropped = false
+			cancelStep = cancel
+			return lost
+		})
+		if run.Err != nil {
+			run.Err = fmt.Errorf("job %s step %d (%s): %s", run.Job.ID, i + 1, st, run.Err)
+			break
+		}
+	}
+	s.client.RemoveStatusHandler(id)
+	run.Finished = s.clock.Now()
+	if s.onRun != nil {
+		s.onRun(run)
+	}
+}
+
+// runStep runs a step, starting over if the connection drops before it
+// completes, until the deadline.  watch is called with a function to
+// cancel the step when the connection drops, and with nil afterwards to
+// find out whether it did.
+func (s *Scheduler) runStep(ctx context.Context, st *JobStep, deadline time.Time, watch func(context.CancelFunc) bool) error {
+	for {
+		err := s.client.waitConnected(ctx, s.clock, deadline)
+		if err != nil {
+			return err
+		}
+		stepCtx, cancel := context.WithCancel(ctx)
+		watch(cancel)
+		if !s.client.Connected() {
+			cancel()
+		}
+		err = s.client.runJobStep(stepCtx, st)
+		cancel()
+		lost := watch(nil) || !s.client.Connected()
+		if err == nil || !lost || ctx.Err() != nil {
+			return err
+		}
+	}
+}
+
+func (c *Client) runJobStep(ctx context.Context, st *JobStep) error {
+	if st.Action == ScheduleFade {
+		// a fade takes as long as it takes, each step with its own
+		// timeout; if it's interrupted by the connection dropping, it
+		// starts over from wherever the volume got to
+		if st.restoreVolume == nil {
+			if vol, ok := c.volume(); ok {
+				st.restoreVolume = &vol
+			}
+		}
+		opts := &FadeOptions{Pause: st.Pause, Restore: st.Restore, RestoreVolume: st.restoreVolume}
+		_, err := c.FadeVolumeContext(ctx, *st.Volume, time.Duration(st.Seconds) * time.Second, opts)
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second * 10)
+	defer cancel()
+	var err error
+	switch st.Action {
+	case SchedulePlay:
+		var id string
+		id, err = c.findPlaylist(st.Playlist)
+		if err == nil {
+			_, err = c.PlayPlaylistContext(ctx, id, st.TrackIndex)
+		}
+	case SchedulePause:
+		_, err = c.PauseContext(ctx)
+	case ScheduleVolume:
+		_, err = c.SetVolumeContext(ctx, *st.Volume)
+	case ScheduleShuffle:
+		_, err = c.SetShuffleModeContext(ctx, *st.Shuffle)
+	default:
+		err = fmt.Errorf("unknown action %q", st.Action)
+	}
+	return err
+}
+
+// findPlaylist looks up a playlist by ID, or failing that by name, so
+// that schedules still work after a playlist has been restored from a
+// backup with a new ID.
+func (c *Client) findPlaylist(idOrName string) (string, error) {
+	state := c.GetState()
+	if state == nil || state.Library == nil {
+		return "", errors.New("jooki library not loaded")
+	}
+	if _, ok := state.Library.Playlists[idOrName]; ok {
+		return idOrName, nil
+	}
+	ids := []string{}
+	for id, pl := range state.Library.Playlists {
+		if strings.EqualFold(pl.Name, idOrName) {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return "", fmt.Errorf("no playlist %q", idOrName)
+	}
+	sort.Strings(ids)
+	return ids[0], nil
+}
@@ -0,0 +1,329 @@
+package jooki
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrSleepCancelled is a cancelled SleepTimer's Err.
+var ErrSleepCancelled = errors.New("sleep timer cancelled")
+
+// SleepTimer pauses playback after a while, or after some number of
+// tracks have finished.  A client has at most one; setting a new one
+// cancels the old.
+//
+// Tracks are counted by watching NowPlaying.TrackID change, so a track
+// repeating itself doesn't count as finishing, and the next track may be
+// heard for a moment before playback pauses.
+type SleepTimer struct {
+	client *Client
+	clock Clock
+	deadline time.Time
+	locker *sync.Mutex
+	tracks int
+	cancel context.CancelFunc
+	done chan bool
+	err error
+}
+
+// SleepAfter pauses playback once d has passed.
+func (c *Client) SleepAfter(d time.Duration) (*SleepTimer, error) {
+	if d < 0 {
+		return nil, fmt.Errorf("bad sleep time %s", d)
+	}
+	t := c.newSleepTimer()
+	t.deadline = t.clock.Now().Add(d)
+	ctx := c.setSleepTimer(t)
+	timer := t.clock.NewTimer(d)
+	go func() {
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			t.finish(ctx.Err())
+		case <-timer.C():
+			t.finish(t.pause(ctx))
+		}
+	}()
+	return t, nil
+}
+
+// SleepAfterTracks pauses playback once n tracks have finished, counting
+// the one playing now.
+func (c *Client) SleepAfterTracks(n int) (*SleepTimer, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("bad track count %d", n)
+	}
+	// subscribe first so that no track change is missed
+	sub, err := c.Subscribe(&SubscribeOptions{Types: []EventType{EventTrackChanged, EventPlaybackStateChanged}})
+	if err != nil {
+		return nil, err
+	}
+	current := ""
+	if state := c.GetState(); state != nil && state.Audio != nil {
+		current = nowPlayingTrack(state.Audio.NowPlaying)
+	}
+	if current == "" {
+		sub.Close()
+		return nil, errors.New("nothing is playing")
+	}
+	t := c.newSleepTimer()
+	t.tracks = n
+	ctx := c.setSleepTimer(t)
+	go func() {
+		defer sub.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				t.finish(ctx.Err())
+				return
+			case ev, ok := <-sub.Events():
+				if !ok {
+					t.finish(errors.New("jooki client is closed"))
+					return
+				}
+				switch e := ev.(type) {
+				case *TrackChangedEvent:
+					id := nowPlayingTrack(e.After)
+					if id == current {
+						continue
+					}
+					current = id
+					if t.trackFinished() > 0 {
+						continue
+					}
+					if id == "" {
+						t.finish(nil)
+					} else {
+						t.finish(t.pause(ctx))
+					}
+					return
+				case *PlaybackStateEvent:
+					if e.After == PlaybackStateEnded {
+						// nothing left to pause
+						t.finish(nil)
+						return
+					}
+				}
+			}
+		}
+	}()
+	return t, nil
+}
+
+// SleepAtEndOfTrack pauses playback when the current track finishes.
+func (c *Client) SleepAtEndOfTrack() (*SleepTimer, error) {
+	return c.SleepAfterTracks(1)
+}
+
+// SleepTimer returns the client's sleep timer, or nil if it doesn't have
+// one running.
+func (c *Client) SleepTimer() *SleepTimer {
+	c.sleepLocker.Lock()
+	t := c.sleepTimer
+	c.sleepLocker.Unlock()
+	if t == nil || t.Finished() {
+		return nil
+	}
+	return t
+}
+
+// CancelSleepTimer cancels the client's sleep timer, and reports whether
+// there was one running.
+func (c *Client) CancelSleepTimer() bool {
+	c.sleepLocker.Lock()
+	t := c.sleepTimer
+	c.sleepLocker.Unlock()
+	if t == nil {
+		return false
+	}
+	return t.Cancel()
+}
+
+func (c *Client) newSleepTimer() *SleepTimer {
+	return &SleepTimer{
+		client: c,
+		clock: c.Clock(),
+		locker: &sync.Mutex{},
+		done: make(chan bool),
+	}
+}
+
+// setSleepTimer makes t the client's sleep timer, cancelling any other,
+// and returns the context t runs in.
+func (c *Client) setSleepTimer(t *SleepTimer) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.cancel = cancel
+	c.sleepLocker.Lock()
+	prev := c.sleepTimer
+	c.sleepTimer = t
+	c.sleepLocker.Unlock()
+	if prev != nil {
+		prev.Cancel()
+	}
+	return ctx
+}
+
+// Cancel stops the timer without pausing, and reports whether it was
+// still running.
+func (t *SleepTimer) Cancel() bool {
+	if t.Finished() {
+		return false
+	}
+	t.cancel()
+	<-t.done
+	return t.Err() == ErrSleepCancelled
+}
+
+// Done is closed when the timer has paused playback or been cancelled.
+func (t *SleepTimer) Done() <-chan bool {
+	return t.done
+}
+
+// Finished reports whether the timer has paused playback or been
+// cancelled.
+func (t *SleepTimer) Finished() bool {
+	select {
+	case <-t.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Err is nil while the timer is running or once it has paused playback,
+// ErrSleepCancelled if it was cancelled, or the reason it couldn't pause
+// playback.
+func (t *SleepTimer) Err() error {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	return t.err
+}
+
+// Deadline returns when the timer will pause playback, or false if it's
+// counting tracks.
+func (t *SleepTimer) Deadline() (time.Time, bool) {
+	return t.deadline, !t.deadline.IsZero()
+}
+
+// TracksLeft is how many tracks are still to finish, counting the one
+// playing now, for a timer counting tracks.
+func (t *SleepTimer) TracksLeft() int {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	return t.tracks
+}
+
+// Remaining is how long until the timer pauses playback.  For a timer
+// counting tracks, it's an estimate from the current track's position
+// and the lengths of the tracks to come, and false if there's no telling
+// (e.g. in shuffle mode, or if a track's length isn't known).
+func (t *SleepTimer) Remaining() (time.Duration, bool) {
+	if t.Finished() {
+		return 0, true
+	}
+	if !t.deadline.IsZero() {
+		d := t.deadline.Sub(t.clock.Now())
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return t.client.tracksRemaining(t.TracksLeft())
+}
+
+func (t *SleepTimer) trackFinished() int {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	t.tracks -= 1
+	return t.tracks
+}
+
+func (t *SleepTimer) finish(err error) {
+	if err == context.Canceled {
+		err = ErrSleepCancelled
+	}
+	t.locker.Lock()
+	t.err = err
+	t.locker.Unlock()
+	close(t.done)
+}
+
+// pause pauses playback, if anything is playing, waiting for the device
+// to reconnect if need be.
+func (t *SleepTimer) pause(ctx context.Context) error {
+	deadline := t.clock.Now().Add(ScheduleGrace)
+	for {
+		err := t.client.waitConnected(ctx, t.clock, deadline)
+		if err != nil {
+			return err
+		}
+		state := t.client.GetState()
+		if state == nil || state.Audio == nil || state.Audio.Playback == nil || state.Audio.Playback.State != PlaybackStatePlaying {
+			return nil
+		}
+		pctx, cancel := context.WithTimeout(ctx, time.Second * 10)
+		_, err = t.client.PauseContext(pctx)
+		cancel()
+		if err == nil || t.client.Connected() || ctx.Err() != nil {
+			return err
+		}
+	}
+}
+
+// tracksRemaining estimates how long it will take to play the rest of
+// the current track and the n - 1 tracks after it.
+func (c *Client) tracksRemaining(n int) (time.Duration, bool) {
+	pos, ok := c.NowPlayingPosition()
+	if !ok || pos.Duration == 0 {
+		return 0, false
+	}
+	d := pos.Remaining
+	if n <= 1 {
+		return d, true
+	}
+	state := c.GetState()
+	if state.Audio == nil || state.Audio.NowPlaying == nil {
+		return 0, false
+	}
+	np := state.Audio.NowPlaying
+	if state.Audio.Config != nil && state.Audio.Config.ShuffleMode {
+		return 0, false
+	}
+	if np.PlaylistID == nil || np.TrackID == nil || state.Library == nil {
+		return 0, false
+	}
+	pl, ok := state.Library.Playlists[*np.PlaylistID]
+	if !ok {
+		return 0, false
+	}
+	// find the current track by ID, since the device counts trackIndex
+	// from 1
+	idx := -1
+	for i, id := range pl.Tracks {
+		if id == *np.TrackID {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return 0, false
+	}
+	for i := idx + 1; i < idx + n && i < len(pl.Tracks); i++ {
+		tr, ok := state.Library.Tracks[pl.Tracks[i]]
+		if !ok || tr.Duration == nil {
+			return 0, false
+		}
+		d += time.Duration(float64(*tr.Duration) * float64(time.Second))
+	}
+	return d, true
+}
+
+func nowPlayingTrack(np *NowPlaying) string {
+	if np == nil || np.TrackID == nil {
+		return ""
+	}
+	return *np.TrackID
+}
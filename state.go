@@ -2,6 +2,7 @@ package jooki
 
 import (
 	"encoding/json"
+	"fmt"
 	//"log"
 	"time"
 )
@@ -34,6 +35,23 @@ func (t *TimeOfDay) Next(tm time.Time) time.Time {
 	return n
 }
 
+// ParseTimeOfDay parses a 24 hour time such as "19:30".
+func ParseTimeOfDay(s string) (TimeOfDay, error) {
+	tm, err := time.Parse("15:04", s)
+	if err != nil {
+		return TimeOfDay{}, fmt.Errorf("bad time of day %q", s)
+	}
+	return TimeOfDay{Hour: uint8(tm.Hour()), Minute: uint8(tm.Minute())}, nil
+}
+
+func (t *TimeOfDay) Valid() bool {
+	return t.Hour < 24 && t.Minute < 60
+}
+
+func (t *TimeOfDay) String() string {
+	return fmt.Sprintf("%02d:%02d", t.Hour, t.Minute)
+}
+
 func (t *TimeOfDay) Clone() *TimeOfDay {
 	if t == nil {
 		return nil
@@ -56,8 +74,28 @@ func (q *QuietTime) Clone() *QuietTime {
 	return &clone
 }
 
+// Until reports how long it is from now until the device next shuts
+// down for quiet time, and false if quiet time is off.
+func (q *QuietTime) Until(now time.Time) (time.Duration, bool) {
+	if q == nil || !q.Active || q.Shutdown == nil {
+		return 0, false
+	}
+	return q.Shutdown.Next(now).Sub(now), true
+}
+
 type JookiSettings struct {
 	QuietTime *QuietTime `json:"quietTime"`
+	// the settings as sent, if they didn't fit the fields above
+	Raw json.RawMessage `json:"-"`
+}
+
+func (s *JookiSettings) UnmarshalJSON(data []byte) error {
+	type settings JookiSettings
+	v := &settings{}
+	raw := decodeLenient(data, v)
+	*s = JookiSettings(*v)
+	s.Raw = raw
+	return nil
 }
 
 func (s *JookiSettings) Clone() *JookiSettings {
@@ -66,6 +104,7 @@ func (s *JookiSettings) Clone() *JookiSettings {
 	}
 	return &JookiSettings{
 		QuietTime: s.QuietTime.Clone(),
+		Raw: cloneRaw(s.Raw),
 	}
 }
 
@@ -119,8 +158,9 @@ func (a *AudioConfig) Clone() *AudioConfig {
 
 type ImageWrapper string
 
+// MarshalJSON sends a missing image as false, as the device does.
 func (iw *ImageWrapper) MarshalJSON() ([]byte, error) {
-	if iw == nil {
+	if iw == nil || *iw == "" {
 		return []byte("false"), nil
 	}
 	return json.Marshal(string(*iw))
@@ -162,10 +202,56 @@ func (n *NowPlaying) Clone() *NowPlaying {
 		return nil
 	}
 	clone := *n
-	// TODO: pointers?
+	clone.Album = cloneString(n.Album)
+	clone.Artist = cloneString(n.Artist)
+	if n.Duration != nil {
+		v := *n.Duration
+		clone.Duration = &v
+	}
+	if n.Image != nil {
+		v := *n.Image
+		clone.Image = &v
+	}
+	clone.PlaylistID = cloneString(n.PlaylistID)
+	clone.Service = cloneString(n.Service)
+	clone.Source = cloneString(n.Source)
+	clone.Title = cloneString(n.Title)
+	clone.TrackID = cloneString(n.TrackID)
+	if n.TrackIndex != nil {
+		v := *n.TrackIndex
+		clone.TrackIndex = &v
+	}
+	clone.URI = cloneString(n.URI)
 	return &clone
 }
 
+// decodeLenient decodes data into v, a pointer to an alias of one of the
+// types below whose shape is a guess.  If the device sends something that
+// doesn't fit, the error is dropped, whatever did fit is kept, and the
+// raw JSON is returned so that nothing is lost.
+func decodeLenient(data []byte, v interface{}) json.RawMessage {
+	err := json.Unmarshal(data, v)
+	if err == nil {
+		return nil
+	}
+	return append(json.RawMessage{}, data...)
+}
+
+func cloneRaw(raw json.RawMessage) json.RawMessage {
+	if raw == nil {
+		return nil
+	}
+	return append(json.RawMessage{}, raw...)
+}
+
+func cloneString(s *string) *string {
+	if s == nil {
+		return nil
+	}
+	v := *s
+	return &v
+}
+
 const (
 	PlaybackStateStarting = "STARTING"
 	PlaybackStateEnded    = "ENDED"
@@ -200,25 +286,27 @@ func (a *Audio) UnmarshalJSON(data []byte) error {
 	}
 	raw := &rawAudio{}
 	err := json.Unmarshal(data, raw)
-	if err != nil {
+	if _, ok := err.(*json.UnmarshalTypeError); err != nil && !ok {
 		return err
 	}
 	a.Config = raw.Config
+	// like encoding/json, decode as much as possible and report the
+	// first error
 	if len(raw.NowPlaying) > 0 && string(raw.NowPlaying) != "null" && string(raw.NowPlaying) != "[]" {
 		a.NowPlaying = &NowPlaying{}
-		err = json.Unmarshal([]byte(raw.NowPlaying), a.NowPlaying)
-		if err != nil {
-			return err
+		perr := json.Unmarshal([]byte(raw.NowPlaying), a.NowPlaying)
+		if err == nil {
+			err = perr
 		}
 	}
 	if len(raw.Playback) > 0 && string(raw.Playback) != "null" && string(raw.Playback) != "[]" {
 		a.Playback = &Playback{}
-		err = json.Unmarshal([]byte(raw.Playback), a.Playback)
-		if err != nil {
-			return err
+		perr := json.Unmarshal([]byte(raw.Playback), a.Playback)
+		if err == nil {
+			err = perr
 		}
 	}
-	return nil
+	return err
 }
 
 func (a *Audio) Clone() *Audio {
@@ -250,7 +338,8 @@ func (d *DiskUsage) Clone() *DiskUsage {
 type Device struct {
 	DiskUsage *DiskUsage `json:"diskUsage"`
 	Firmware string `json:"firmware"`
-	Flags []interface{} `json:"flags"`
+	// feature flags the device has enabled
+	Flags []string `json:"flags"`
 	Hostname string `json:"hostname"`
 	ID string `json:"id"`
 	IP string `json:"ip"`
@@ -259,6 +348,17 @@ type Device struct {
 	Usage string `json:"usage"`
 	WebApp string `json:"webapp"`
 	WiFiMac string `json:"wifi_mac"`
+	// the device info as sent, if it didn't fit the fields above
+	Raw json.RawMessage `json:"-"`
+}
+
+func (d *Device) UnmarshalJSON(data []byte) error {
+	type device Device
+	v := &device{}
+	raw := decodeLenient(data, v)
+	*d = Device(*v)
+	d.Raw = raw
+	return nil
 }
 
 func (d *Device) Clone() *Device {
@@ -267,7 +367,10 @@ func (d *Device) Clone() *Device {
 	}
 	clone := *d
 	clone.DiskUsage = d.DiskUsage.Clone()
-	// TODO: Flags
+	if d.Flags != nil {
+		clone.Flags = append([]string{}, d.Flags...)
+	}
+	clone.Raw = cloneRaw(d.Raw)
 	return &clone
 }
 
@@ -353,19 +456,134 @@ func (w *WiFi) Clone() *WiFi {
 	return &clone
 }
 
+// DeezerItem is Deezer content linked to the device: a playlist, album
+// or flow, optionally assigned to a star like a playlist in the library.
+type DeezerItem struct {
+	ID string `json:"id"`
+	// "playlist", "album" or "flow"
+	Type string `json:"type"`
+	Title string `json:"title"`
+	Image *string `json:"image"`
+	Token *string `json:"star"`
+	// the item as sent, if it didn't fit the fields above
+	Raw json.RawMessage `json:"-"`
+}
+
+func (d *DeezerItem) UnmarshalJSON(data []byte) error {
+	type item DeezerItem
+	v := &item{}
+	raw := decodeLenient(data, v)
+	*d = DeezerItem(*v)
+	d.Raw = raw
+	return nil
+}
+
+func (d *DeezerItem) Clone() *DeezerItem {
+	if d == nil {
+		return nil
+	}
+	clone := *d
+	clone.Image = cloneString(d.Image)
+	clone.Token = cloneString(d.Token)
+	clone.Raw = cloneRaw(d.Raw)
+	return &clone
+}
+
+// UserMessage is a notice the device shows in its app, such as a
+// firmware update being available.
+type UserMessage struct {
+	ID string `json:"id"`
+	// "info", "warning" or "error"
+	Level string `json:"level"`
+	Message string `json:"message"`
+	// seconds since the epoch
+	Created int64 `json:"created"`
+	// the message as sent, if it didn't fit the fields above
+	Raw json.RawMessage `json:"-"`
+}
+
+func (m *UserMessage) UnmarshalJSON(data []byte) error {
+	type message UserMessage
+	v := &message{}
+	raw := decodeLenient(data, v)
+	*m = UserMessage(*v)
+	m.Raw = raw
+	return nil
+}
+
+// CreatedTime is when the message was created, or the zero time if it
+// isn't known.
+func (m *UserMessage) CreatedTime() time.Time {
+	if m == nil || m.Created == 0 {
+		return time.Time{}
+	}
+	return time.Unix(m.Created, 0)
+}
+
+func (m *UserMessage) Clone() *UserMessage {
+	if m == nil {
+		return nil
+	}
+	clone := *m
+	clone.Raw = cloneRaw(m.Raw)
+	return &clone
+}
+
+// NFC is the token currently on the device.  The device reports an empty
+// list when there isn't one, which decodes to an empty NFC.
+type NFC struct {
+	// the token's tag ID, the key of Library.Tokens
+	TokenID string `json:"token"`
+	// the star the token is built into; empty if the device doesn't know
+	// the token
+	StarID string `json:"starId"`
+}
+
+func (n *NFC) UnmarshalJSON(data []byte) error {
+	*n = NFC{}
+	// no token comes through as an empty list
+	if data[0] == '[' {
+		var v []interface{}
+		return json.Unmarshal(data, &v)
+	}
+	type nfc NFC
+	return json.Unmarshal(data, (*nfc)(n))
+}
+
+func (n *NFC) MarshalJSON() ([]byte, error) {
+	if n.Empty() {
+		return []byte("[]"), nil
+	}
+	type nfc NFC
+	return json.Marshal((*nfc)(n))
+}
+
+// Empty reports whether there's no token on the device.
+func (n *NFC) Empty() bool {
+	return n == nil || (n.TokenID == "" && n.StarID == "")
+}
+
+func (n *NFC) Clone() *NFC {
+	if n == nil {
+		return nil
+	}
+	clone := *n
+	return &clone
+}
+
 type JookiState struct {
-	Settings *JookiSettings `json:"DISABLEDsettings"`
+	Settings *JookiSettings `json:"settings"`
 	Audio *Audio `json:"audio"`
 	Bluetooth string `json:"bt"`
 	Library *Library `json:"db"`
-	Deezer []interface{} `json:"deezer"`
+	Deezer []*DeezerItem `json:"deezer"`
 	Device *Device `json:"device"`
 	Mender *Mender `json:"mender"`
-	NFC interface{} `json:"nfc"`
+	NFC *NFC `json:"nfc"`
 	Owner *Owner `json:"owner"`
 	Power *Power `json:"power"`
 	Spotify *Spotify `json:"spotify"`
-	UserMessages []interface{} `json:"userMessages"`
+	UserMessages []*UserMessage `json:"userMessages"`
 	WiFi *WiFi `json:"wifi"`
 }
 
@@ -374,14 +592,24 @@ func (s *JookiState) Clone() *JookiState {
 	clone.Settings = s.Settings.Clone()
 	clone.Audio = s.Audio.Clone()
 	clone.Library = s.Library.Clone()
-	// TODO: Deezer
+	if s.Deezer != nil {
+		clone.Deezer = make([]*DeezerItem, len(s.Deezer))
+		for i, v := range s.Deezer {
+			clone.Deezer[i] = v.Clone()
+		}
+	}
 	clone.Device = s.Device.Clone()
 	clone.Mender = s.Mender.Clone()
-	// TODO: NFC
+	clone.NFC = s.NFC.Clone()
 	clone.Owner = s.Owner.Clone()
 	clone.Power = s.Power.Clone()
 	clone.Spotify = s.Spotify.Clone()
-	// TODO: UserMessages
+	if s.UserMessages != nil {
+		clone.UserMessages = make([]*UserMessage, len(s.UserMessages))
+		for i, v := range s.UserMessages {
+			clone.UserMessages[i] = v.Clone()
+		}
+	}
 	clone.WiFi = s.WiFi.Clone()
 	return &clone
 	/*
@@ -0,0 +1,126 @@
+package jooki
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the .golden files in testdata/golden")
+
+type StateSuite struct {}
+var _ = Suite(&StateSuite{})
+
+func loadCapture(c *C, name string) *JookiState {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "golden", name))
+	c.Assert(err, IsNil)
+	state := &JookiState{}
+	c.Assert(json.Unmarshal(data, state), IsNil)
+	return state
+}
+
+// TestGolden decodes each captured payload and checks that encoding it
+// again gives the matching .golden file.  Run with -update to rewrite
+// them after changing the models.
+func (s *StateSuite) TestGolden(c *C) {
+	fns, err := filepath.Glob(filepath.Join("testdata", "golden", "*.json"))
+	c.Assert(err, IsNil)
+	c.Assert(len(fns) > 0, Equals, true)
+	for _, fn := range fns {
+		state := loadCapture(c, filepath.Base(fn))
+		data, err := json.MarshalIndent(state, "", "  ")
+		c.Assert(err, IsNil)
+		data = append(data, '\n')
+		golden := strings.TrimSuffix(fn, ".json") + ".golden"
+		if *updateGolden {
+			c.Assert(ioutil.WriteFile(golden, data, 0644), IsNil)
+			continue
+		}
+		expected, err := ioutil.ReadFile(golden)
+		c.Assert(err, IsNil)
+		c.Check(string(data), Equals, string(expected), Commentf("%s", golden))
+		// and the encoded state decodes to the same thing
+		again := &JookiState{}
+		c.Assert(json.Unmarshal(data, again), IsNil)
+		c.Check(again, DeepEquals, state, Commentf("%s", fn))
+	}
+}
+
+func (s *StateSuite) TestTypedFields(c *C) {
+	state := loadCapture(c, "full_state.json")
+	c.Assert(state.Settings, NotNil)
+	c.Check(state.Settings.QuietTime.Active, Equals, true)
+	c.Check(*state.Settings.QuietTime.Shutdown, Equals, TimeOfDay{Hour: 19, Minute: 30})
+	c.Assert(state.Deezer, HasLen, 2)
+	c.Check(state.Deezer[0].Title, Equals, "Kids Party")
+	c.Check(*state.Deezer[0].Token, Equals, "STAR_2")
+	c.Check(state.Deezer[1].Token, IsNil)
+	c.Assert(state.UserMessages, HasLen, 1)
+	c.Check(state.UserMessages[0].Level, Equals, "info")
+	c.Check(state.UserMessages[0].CreatedTime().Equal(time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)), Equals, true)
+	c.Check(state.Device.Flags, DeepEquals, []string{"deezer", "quiet_time"})
+	c.Check(*state.NFC, Equals, NFC{TokenID: "04a2b3c4d5e680", StarID: "STAR_1"})
+
+	idle := loadCapture(c, "idle_state.json")
+	c.Check(idle.Settings, IsNil)
+	c.Check(idle.Deezer, HasLen, 0)
+	c.Check(idle.UserMessages, HasLen, 0)
+	c.Check(idle.NFC.Empty(), Equals, true)
+	c.Check(idle.Audio.NowPlaying, IsNil)
+}
+
+func (s *StateSuite) TestClone(c *C) {
+	state := loadCapture(c, "full_state.json")
+	before, err := json.Marshal(state)
+	c.Assert(err, IsNil)
+	clone := state.Clone()
+	c.Check(clone, DeepEquals, state)
+	// change everything reachable through a pointer in the clone
+	clone.Settings.QuietTime.Shutdown.Hour = 7
+	*clone.Audio.NowPlaying.Title = "changed"
+	*clone.Audio.NowPlaying.Duration = 1
+	*clone.Audio.NowPlaying.TrackIndex = 9
+	*clone.Audio.NowPlaying.Image = "changed"
+	clone.Library.Playlists["5f0c1a2b3c4d5e6f70819203"].Tracks[0] = "changed"
+	*clone.Library.Tokens["04a2b3c4d5e680"].ID = "changed"
+	*clone.Library.Tracks["9b1f3c0d2e4a5b6c"].Name = "changed"
+	clone.Deezer[0].Title = "changed"
+	*clone.Deezer[0].Image = "changed"
+	clone.Device.Flags[0] = "changed"
+	clone.Device.DiskUsage.Used = 0
+	clone.NFC.StarID = "changed"
+	clone.UserMessages[0].Message = "changed"
+	clone.Power.Level.P = 0
+	after, err := json.Marshal(state)
+	c.Assert(err, IsNil)
+	c.Check(bytes.Equal(before, after), Equals, true)
+}
+
+func (s *StateSuite) TestQuietTime(c *C) {
+	tod, err := ParseTimeOfDay("19:30")
+	c.Assert(err, IsNil)
+	c.Check(tod, Equals, TimeOfDay{Hour: 19, Minute: 30})
+	c.Check(tod.String(), Equals, "19:30")
+	_, err = ParseTimeOfDay("25:00")
+	c.Check(err, ErrorMatches, `bad time of day "25:00"`)
+	c.Check((&TimeOfDay{Hour: 24}).Valid(), Equals, false)
+	qt := &QuietTime{Active: true, Shutdown: &tod}
+	now := time.Date(2021, 3, 1, 18, 15, 0, 0, time.UTC)
+	d, ok := qt.Until(now)
+	c.Check(ok, Equals, true)
+	c.Check(d, Equals, time.Hour + 15 * time.Minute)
+	d, _ = qt.Until(time.Date(2021, 3, 1, 19, 45, 0, 0, time.UTC))
+	c.Check(d, Equals, 23 * time.Hour + 45 * time.Minute)
+	qt.Active = false
+	_, ok = qt.Until(now)
+	c.Check(ok, Equals, false)
+	var none *QuietTime
+	_, ok = none.Until(now)
+	c.Check(ok, Equals, false)
+}
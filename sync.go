@@ -0,0 +1,324 @@
+package jooki
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type SyncAction int
+
+const (
+	// upload a local file that isn't on the device
+	SyncUpload = SyncAction(iota)
+	// add a track that's already on the device to the playlist
+	SyncAdd
+	// take a track that isn't in the local playlist off the playlist.
+	// The track stays in the library.
+	SyncRemove
+	// put the playlist's tracks in the same order as the local playlist
+	SyncReorder
+)
+
+func (a SyncAction) String() string {
+	switch a {
+	case SyncUpload:
+		return "upload"
+	case SyncAdd:
+		return "add"
+	case SyncRemove:
+		return "remove"
+	case SyncReorder:
+		return "reorder"
+	}
+	return "unknown"
+}
+
+type SyncStep struct {
+	Action SyncAction
+	// the local file, for uploads and adds
+	Path string
+	// the track on the device, for adds and removes, or the ID an upload
+	// is expected to get
+	TrackID string
+	Track *Track
+}
+
+func (s *SyncStep) String() string {
+	switch s.Action {
+	case SyncUpload:
+		return fmt.Sprintf("upload %s", s.Path)
+	case SyncAdd:
+		return fmt.Sprintf("add %s (%s)", s.Path, s.TrackID)
+	case SyncRemove:
+		name := ""
+		if s.Track != nil && s.Track.Name != nil {
+			name = *s.Track.Name
+		}
+		return fmt.Sprintf("remove %s (%s)", name, s.TrackID)
+	}
+	return s.Action.String()
+}
+
+// SyncPlan lists the changes needed to make a playlist on the device
+// match a local playlist.  Nothing is changed until the plan is applied,
+// so printing the plan serves as a dry run.
+type SyncPlan struct {
+	PlaylistID string
+	Source string
+	Files []string
+	Steps []*SyncStep
+	// the playlist's tracks as they are now, and as they will be once
+	// the plan has been applied
+	Before []string
+	After []string
+	// local files that don't exist, which are left out of the playlist
+	Missing []string
+}
+
+// InSync reports whether the playlist already matches.
+func (p *SyncPlan) InSync() bool {
+	return len(p.Steps) == 0
+}
+
+func (p *SyncPlan) String() string {
+	if p.InSync() && len(p.Missing) == 0 {
+		return "in sync"
+	}
+	lines := []string{}
+	for _, step := range p.Steps {
+		lines = append(lines, step.String())
+	}
+	for _, fn := range p.Missing {
+		lines = append(lines, "missing " + fn)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// NewSyncPlan works out how to make a playlist in lib match the local
+// playlist at source (see LocalPlaylist).  Local files are matched to
+// tracks in the library with FindTrack.
+func NewSyncPlan(lib *Library, playlistId, source string) (*SyncPlan, error) {
+	files, err := LocalPlaylist(source)
+	if err != nil {
+		return nil, err
+	}
+	return newSyncPlan(lib, playlistId, source, files, func(i int, lib *Library) (*Track, string, error) {
+		track, err := NewFileTrack(files[i])
+		if err != nil {
+			return nil, "", err
+		}
+		id := track.ID()
+		name := strings.TrimSuffix(filepath.Base(files[i]), filepath.Ext(files[i]))
+		size := uint64(track.Size())
+		return lib.FindTrack(TrackSearch{JookiID: &id, Name: &name, Size: &size}), id, nil
+	})
+}
+
+// newSyncPlan builds a sync plan for a list of local files.  find
+// returns the track in the library matching the i'th file, if any, and
+// the ID the file will get if it's uploaded.
+func newSyncPlan(lib *Library, playlistId, source string, files []string, find func(i int, lib *Library) (*Track, string, error)) (*SyncPlan, error) {
+	if lib == nil {
+		return nil, errors.New("jooki library not loaded")
+	}
+	pl, ok := lib.Playlists[playlistId]
+	if !ok {
+		return nil, errors.New("no such playlist")
+	}
+	plan := &SyncPlan{
+		PlaylistID: playlistId,
+		Source: source,
+		Files: files,
+		Steps: []*SyncStep{},
+		Before: append([]string{}, pl.Tracks...),
+		After: []string{},
+		Missing: []string{},
+	}
+	current := map[string]bool{}
+	for _, id := range pl.Tracks {
+		current[id] = true
+	}
+	wanted := map[string]bool{}
+	// the track order the playlist ends up with if nothing is reordered
+	appended := []string{}
+	for i, fn := range files {
+		jtr, id, err := find(i, lib)
+		if err != nil {
+			if os.IsNotExist(err) {
+				plan.Missing = append(plan.Missing, fn)
+				continue
+			}
+			return nil, err
+		}
+		if jtr != nil && jtr.ID != nil {
+			id = *jtr.ID
+		}
+		if wanted[id] {
+			continue
+		}
+		wanted[id] = true
+		plan.After = append(plan.After, id)
+		switch {
+		case jtr == nil:
+			plan.Steps = append(plan.Steps, &SyncStep{Action: SyncUpload, Path: fn, TrackID: id})
+			appended = append(appended, id)
+		case !current[id]:
+			plan.Steps = append(plan.Steps, &SyncStep{Action: SyncAdd, Path: fn, TrackID: id, Track: jtr})
+			appended = append(appended, id)
+		}
+	}
+	kept := []string{}
+	for _, id := range pl.Tracks {
+		if wanted[id] {
+			kept = append(kept, id)
+			continue
+		}
+		plan.Steps = append(plan.Steps, &SyncStep{Action: SyncRemove, TrackID: id, Track: lib.Tracks[id]})
+	}
+	if !sameTracks(append(kept, appended...), plan.After) {
+		plan.Steps = append(plan.Steps, &SyncStep{Action: SyncReorder})
+	}
+	return plan, nil
+}
+
+func sameTracks(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Client) PlanSync(playlistId, source string) (*SyncPlan, error) {
+	return NewSyncPlan(c.GetState().Library, playlistId, source)
+}
+
+// findOrCreatePlaylist returns the ID of the playlist with the given
+// name, ignoring case, creating it if there isn't one.
+func (c *Client) findOrCreatePlaylist(ctx context.Context, name string) (string, error) {
+	state := c.GetState()
+	if state == nil || state.Library == nil {
+		return "", errors.New("jooki library not loaded")
+	}
+	for _, pl := range state.Library.SortedPlaylists() {
+		if strings.EqualFold(pl.Name, name) {
+			return *pl.ID, nil
+		}
+	}
+	createCtx, cancel := context.WithTimeout(ctx, time.Second * 10)
+	defer cancel()
+	pl, err := c.CreatePlaylistContext(createCtx, name)
+	if err != nil {
+		return "", err
+	}
+	return *pl.ID, nil
+}
+
+type SyncResult struct {
+	Plan *SyncPlan
+	Uploads []*UploadResult
+	Playlist *Playlist
+}
+
+// Sync makes a playlist on the device match a local playlist.
+func (c *Client) Sync(playlistId, source string, opts *BulkUploadOptions) (*SyncResult, error) {
+	return c.SyncContext(context.Background(), playlistId, source, opts)
+}
+
+func (c *Client) SyncContext(ctx context.Context, playlistId, source string, opts *BulkUploadOptions) (*SyncResult, error) {
+	plan, err := c.PlanSync(playlistId, source)
+	if err != nil {
+		if opts != nil && opts.Progress != nil {
+			close(opts.Progress)
+		}
+		return nil, err
+	}
+	return c.ApplySyncContext(ctx, plan, opts)
+}
+
+// ApplySync carries out a sync plan: missing files are uploaded, tracks
+// already on the device are added, and then the playlist's tracks are
+// set in one go, which removes the extras and fixes the order.  Files
+// that fail to upload are left out of the playlist, and an error is
+// returned along with the result.
+func (c *Client) ApplySync(plan *SyncPlan, opts *BulkUploadOptions) (*SyncResult, error) {
+	return c.ApplySyncContext(context.Background(), plan, opts)
+}
+
+func (c *Client) ApplySyncContext(ctx context.Context, plan *SyncPlan, opts *BulkUploadOptions) (*SyncResult, error) {
+	res := &SyncResult{Plan: plan, Uploads: []*UploadResult{}}
+	if state := c.GetState(); state == nil || state.Library == nil {
+		if opts != nil && opts.Progress != nil {
+			close(opts.Progress)
+		}
+		return res, errors.New("jooki library not loaded")
+	}
+	uploads := []*SyncStep{}
+	// maps the track IDs in the plan to the IDs they actually end up
+	// with on the device
+	ids := map[string]string{}
+	for _, id := range plan.Before {
+		ids[id] = id
+	}
+	for _, step := range plan.Steps {
+		switch step.Action {
+		case SyncUpload:
+			uploads = append(uploads, step)
+		case SyncAdd:
+			// setting the playlist's tracks at the end adds these
+			ids[step.TrackID] = step.TrackID
+		}
+	}
+	failed := 0
+	if len(uploads) > 0 {
+		files := make([]string, len(uploads))
+		for i, step := range uploads {
+			files[i] = step.Path
+		}
+		results, err := c.UploadFilesContext(ctx, plan.PlaylistID, files, opts)
+		if err != nil {
+			return res, err
+		}
+		res.Uploads = results
+		for i, ur := range results {
+			if ur.Err != nil || ur.Track == nil || ur.Track.ID == nil {
+				failed += 1
+				continue
+			}
+			ids[uploads[i].TrackID] = *ur.Track.ID
+		}
+	} else if opts != nil && opts.Progress != nil {
+		close(opts.Progress)
+	}
+	tracks := []string{}
+	for _, id := range plan.After {
+		if newId, ok := ids[id]; ok {
+			tracks = append(tracks, newId)
+		}
+	}
+	state := c.GetState()
+	if pl, ok := state.Library.Playlists[plan.PlaylistID]; ok && sameTracks(pl.Tracks, tracks) {
+		res.Playlist = pl
+	} else {
+		updateCtx, cancel := context.WithTimeout(ctx, time.Second * 10)
+		defer cancel()
+		pl, err := c.UpdatePlaylistTracksContext(updateCtx, plan.PlaylistID, tracks)
+		if err != nil {
+			return res, err
+		}
+		res.Playlist = pl
+	}
+	if failed > 0 {
+		return res, fmt.Errorf("%d of %d uploads failed", failed, len(uploads))
+	}
+	return res, nil
+}
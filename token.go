@@ -0,0 +1,189 @@
+package jooki
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// SeenTime is when the token was last placed on the device, or the zero
+// time if it never has been.
+func (t *Token) SeenTime() time.Time {
+	if t == nil || t.Seen == 0 {
+		return time.Time{}
+	}
+	return time.Unix(t.Seen, 0)
+}
+
+// TokenAssignment ties a star (the figurine a token is built into) to
+// the playlist it plays.
+type TokenAssignment struct {
+	StarID string
+	// the token with this star ID, if the device has seen it
+	Token *Token
+	// nil if the star isn't assigned to a playlist
+	Playlist *Playlist
+}
+
+// TokenAssignments lists every star the library knows of, either because
+// its token has been placed on the device or because a playlist is
+// assigned to it, sorted by star ID.
+func (l *Library) TokenAssignments() []*TokenAssignment {
+	assignments := []*TokenAssignment{}
+	if l == nil {
+		return assignments
+	}
+	stars := map[string]*TokenAssignment{}
+	star := func(id string) *TokenAssignment {
+		ta, ok := stars[id]
+		if !ok {
+			ta = &TokenAssignment{StarID: id}
+			stars[id] = ta
+			assignments = append(assignments, ta)
+		}
+		return ta
+	}
+	for _, token := range l.Tokens {
+		if token != nil && token.StarID != "" {
+			star(token.StarID).Token = token
+		}
+	}
+	for _, pl := range l.SortedPlaylists() {
+		if pl.Token != nil && *pl.Token != "" {
+			ta := star(*pl.Token)
+			if ta.Playlist == nil {
+				ta.Playlist = pl
+			}
+		}
+	}
+	sort.Slice(assignments, func(i, j int) bool { return assignments[i].StarID < assignments[j].StarID })
+	return assignments
+}
+
+// StarPlaylist returns the playlist assigned to a star, or nil.
+func (l *Library) StarPlaylist(starId string) *Playlist {
+	if l == nil || starId == "" {
+		return nil
+	}
+	for _, pl := range l.SortedPlaylists() {
+		if pl.Token != nil && *pl.Token == starId {
+			return pl
+		}
+	}
+	return nil
+}
+
+// AssignToken assigns a star to a playlist, so that placing its token on
+// the device plays the playlist.  A star plays one playlist, so it's
+// first unassigned from any other playlist it's assigned to, and
+// assigned back again if the assignment fails.
+func (c *Client) AssignToken(starId, playlistId string) (*Playlist, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 10)
+	defer cancel()
+	return c.AssignTokenContext(ctx, starId, playlistId)
+}
+
+func (c *Client) AssignTokenContext(ctx context.Context, starId, playlistId string) (*Playlist, error) {
+	if starId == "" {
+		return nil, errors.New("no star ID")
+	}
+	lib := c.GetState().Library
+	pl, ok := lib.Playlists[playlistId]
+	if !ok {
+		return nil, errors.New("no such playlist")
+	}
+	unassigned := []string{}
+	undo := func() {
+		undoCtx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+		defer cancel()
+		for _, id := range unassigned {
+			c.UpdatePlaylistTokenContext(undoCtx, id, starId)
+		}
+	}
+	for _, other := range lib.SortedPlaylists() {
+		if *other.ID != playlistId && other.Token != nil && *other.Token == starId {
+			_, err := c.UpdatePlaylistTokenContext(ctx, *other.ID, "")
+			if err != nil {
+				undo()
+				return nil, err
+			}
+			unassigned = append(unassigned, *other.ID)
+		}
+	}
+	if pl.Token != nil && *pl.Token == starId {
+		return pl, nil
+	}
+	updated, err := c.UpdatePlaylistTokenContext(ctx, playlistId, starId)
+	if err != nil {
+		undo()
+		return nil, err
+	}
+	return updated, nil
+}
+
+// UnassignToken takes a star off the playlists it's assigned to.  See
+// UpdatePlaylistToken for how.
+func (c *Client) UnassignToken(starId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 10)
+	defer cancel()
+	return c.UnassignTokenContext(ctx, starId)
+}
+
+func (c *Client) UnassignTokenContext(ctx context.Context, starId string) error {
+	if starId == "" {
+		return errors.New("no star ID")
+	}
+	found := false
+	for _, pl := range c.GetState().Library.SortedPlaylists() {
+		if pl.Token != nil && *pl.Token == starId {
+			found = true
+			_, err := c.UpdatePlaylistTokenContext(ctx, *pl.ID, "")
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if !found {
+		return fmt.Errorf("star %s isn't assigned to a playlist", starId)
+	}
+	return nil
+}
+
+// SwapTokens swaps the stars assigned to two playlists.  Either playlist
+// may have no star, in which case the other's star moves across.  If the
+// second update fails, the first is undone.
+func (c *Client) SwapTokens(playlistA, playlistB string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 10)
+	defer cancel()
+	return c.SwapTokensContext(ctx, playlistA, playlistB)
+}
+
+func (c *Client) SwapTokensContext(ctx context.Context, playlistA, playlistB string) error {
+	lib := c.GetState().Library
+	a, ok := lib.Playlists[playlistA]
+	if !ok {
+		return fmt.Errorf("no such playlist %s", playlistA)
+	}
+	b, ok := lib.Playlists[playlistB]
+	if !ok {
+		return fmt.Errorf("no such playlist %s", playlistB)
+	}
+	starA, starB := strOf(a.Token), strOf(b.Token)
+	if starA == starB {
+		return nil
+	}
+	_, err := c.UpdatePlaylistTokenContext(ctx, playlistA, starB)
+	if err != nil {
+		return err
+	}
+	_, err = c.UpdatePlaylistTokenContext(ctx, playlistB, starA)
+	if err != nil {
+		undoCtx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+		defer cancel()
+		c.UpdatePlaylistTokenContext(undoCtx, playlistA, starA)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package jooki
+
+import (
+	"encoding/json"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type TokenSuite struct {}
+var _ = Suite(&TokenSuite{})
+
+func (s *TokenSuite) TestTokenAssignments(c *C) {
+	lib := queryLibrary(c)
+	star := "STAR_2"
+	lib.Playlists["5f0c1a2b3c4d5e6f70819204"].Token = &star
+	assignments := lib.TokenAssignments()
+	c.Assert(assignments, HasLen, 2)
+	c.Check(assignments[0].StarID, Equals, "STAR_1")
+	c.Check(*assignments[0].Token.ID, Equals, "04a2b3c4d5e680")
+	c.Check(assignments[0].Token.SeenTime().Equal(time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC)), Equals, true)
+	c.Check(assignments[0].Playlist.Name, Equals, "Bedtime")
+	c.Check(assignments[1].StarID, Equals, "STAR_2")
+	c.Check(assignments[1].Token, IsNil)
+	c.Check(assignments[1].Playlist.Name, Equals, "Stories")
+	c.Check(lib.StarPlaylist("STAR_2").Name, Equals, "Stories")
+	c.Check(lib.StarPlaylist("STAR_3"), IsNil)
+	c.Check((&Token{}).SeenTime().IsZero(), Equals, true)
+}
+
+func (s *TokenSuite) TestPlaylistUpdateJSON(c *C) {
+	star := "STAR_1"
+	unset := ""
+	for _, t := range []struct {
+		update *PlaylistUpdate
+		json string
+	}{
+		{&PlaylistUpdate{ID: "pl"}, `{"id":"pl"}`},
+		{&PlaylistUpdate{ID: "pl", Token: &star}, `{"id":"pl","star":"STAR_1"}`},
+		{&PlaylistUpdate{ID: "pl", Token: &unset}, `{"id":"pl","star":""}`},
+		{&PlaylistUpdate{ID: "pl", Tracks: []string{}}, `{"id":"pl","tracks":[]}`},
+	} {
+		data, err := json.Marshal(t.update)
+		c.Assert(err, IsNil)
+		c.Check(string(data), Equals, t.json)
+		update := &PlaylistUpdate{}
+		c.Assert(json.Unmarshal(data, update), IsNil)
+		c.Check(update, DeepEquals, t.update)
+	}
+}
@@ -0,0 +1,331 @@
+package jooki
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BulkUploadConcurrency is the default number of files uploaded at once.
+var BulkUploadConcurrency = 2
+
+// LocalPlaylist lists the audio files making up a local playlist, which
+// is either an M3U/M3U8 file or a directory.  Directories are searched
+// recursively and the files sorted by path; hidden files and files
+// without a recognized audio extension are ignored.
+func LocalPlaylist(path string) ([]string, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !st.IsDir() {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return ReadM3U(f, filepath.Dir(path))
+	}
+	files := []string{}
+	err = filepath.Walk(path, func(fn string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := info.Name()
+		if strings.HasPrefix(name, ".") && fn != path {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() && isAudioFile(name) {
+			files = append(files, fn)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func isAudioFile(name string) bool {
+	_, ok := audioContentTypes[strings.ToLower(filepath.Ext(name))]
+	return ok
+}
+
+// ReadM3U parses an M3U or M3U8 playlist.  Relative entries are resolved
+// against dir, and file:// URLs are converted to paths.  Comments and
+// extended M3U directives are skipped.
+func ReadM3U(r io.Reader, dir string) ([]string, error) {
+	files := []string{}
+	scanner := bufio.NewScanner(r)
+	first := true
+	for scanner.Scan() {
+		line := scanner.Text()
+		if first {
+			line = strings.TrimPrefix(line, "\ufeff")
+			first = false
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "file://") {
+			u, err := url.Parse(line)
+			if err != nil {
+				return nil, err
+			}
+			line = u.Path
+		}
+		line = filepath.FromSlash(line)
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(dir, line)
+		}
+		files = append(files, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+type BulkUploadOptions struct {
+	UploadOptions
+	// how many files to upload at once; defaults to
+	// BulkUploadConcurrency
+	Concurrency int
+	// receives aggregated progress as the upload proceeds, and is
+	// closed when it's finished
+	Progress chan BulkProgress
+}
+
+type BulkProgress struct {
+	Files int
+	// files finished so far, whether uploaded, skipped or failed
+	Completed int
+	Skipped int
+	Failed int
+	BytesTotal int64
+	BytesSent int64
+	// the most recent update for an individual file
+	Update ProgressUpdate
+}
+
+// Fraction reports overall progress as a fraction of the bytes to be
+// uploaded.
+func (p BulkProgress) Fraction() float64 {
+	if p.BytesTotal <= 0 {
+		if p.Files == 0 {
+			return 1
+		}
+		return float64(p.Completed) / float64(p.Files)
+	}
+	return float64(p.BytesSent) / float64(p.BytesTotal)
+}
+
+type UploadResult struct {
+	Path string
+	Track *Track
+	// the track was already in the library, so it was added to the
+	// playlist without uploading it again
+	Existing bool
+	// number of times the file was uploaded
+	Attempts int
+	// IDs of tracks that failed attempts left in the library, where the
+	// device ingested part of the file before the upload broke off or
+	// the upload was corrupted.  They're taken off the playlist but not
+	// deleted, so they show up in a GC plan.
+	Orphaned []string
+	// the uploaded track was checked against the local file
+	Verified bool
+	Err error
+}
+
+// BulkUpload uploads the files in a local playlist (see LocalPlaylist) to
+// a playlist on the jooki.
+func (c *Client) BulkUpload(playlistId, path string, opts *BulkUploadOptions) ([]*UploadResult, error) {
+	return c.BulkUploadContext(context.Background(), playlistId, path, opts)
+}
+
+func (c *Client) BulkUploadContext(ctx context.Context, playlistId, path string, opts *BulkUploadOptions) ([]*UploadResult, error) {
+	files, err := LocalPlaylist(path)
+	if err != nil {
+		if opts != nil && opts.Progress != nil {
+			close(opts.Progress)
+		}
+		return nil, err
+	}
+	return c.UploadFilesContext(ctx, playlistId, files, opts)
+}
+
+// UploadFiles uploads files to a playlist, skipping the upload for any
+// that are already in the library.  It returns a result for each file,
+// in the same order as the files; an error is only returned if nothing
+// could be attempted.
+func (c *Client) UploadFiles(playlistId string, files []string, opts *BulkUploadOptions) ([]*UploadResult, error) {
+	return c.UploadFilesContext(context.Background(), playlistId, files, opts)
+}
+
+func (c *Client) UploadFilesContext(ctx context.Context, playlistId string, files []string, opts *BulkUploadOptions) ([]*UploadResult, error) {
+	if opts == nil {
+		opts = &BulkUploadOptions{}
+	}
+	if opts.Progress != nil {
+		defer close(opts.Progress)
+	}
+	state := c.GetState()
+	if state == nil || state.Library == nil {
+		return nil, errors.New("jooki library not loaded")
+	}
+	if _, ok := state.Library.Playlists[playlistId]; !ok {
+		return nil, errors.New("no such playlist")
+	}
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = BulkUploadConcurrency
+	}
+	results := make([]*UploadResult, len(files))
+	sizes := make([]int64, len(files))
+	prog := BulkProgress{Files: len(files)}
+	for i, fn := range files {
+		results[i] = &UploadResult{Path: fn}
+		st, err := os.Stat(fn)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		sizes[i] = st.Size()
+		prog.BytesTotal += sizes[i]
+	}
+	progLocker := &sync.Mutex{}
+	sent := make([]int64, len(files))
+	report := func(i int, update *ProgressUpdate, done bool) {
+		progLocker.Lock()
+		defer progLocker.Unlock()
+		if update != nil {
+			sent[i] = update.BytesSent
+			prog.Update = *update
+		}
+		if done {
+			sent[i] = sizes[i]
+			prog.Completed += 1
+			if results[i].Err != nil {
+				prog.Failed += 1
+			} else if results[i].Existing {
+				prog.Skipped += 1
+			}
+		}
+		prog.BytesSent = 0
+		for _, n := range sent {
+			prog.BytesSent += n
+		}
+		if opts.Progress != nil {
+			opts.Progress <- prog
+		}
+	}
+	queue := make(chan int)
+	wg := &sync.WaitGroup{}
+	for n := 0; n < concurrency; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				c.uploadFile(ctx, playlistId, results[i], &opts.UploadOptions, func(update *ProgressUpdate) {
+					report(i, update, false)
+				})
+				report(i, nil, true)
+			}
+		}()
+	}
+	for i := range files {
+		if results[i].Err != nil {
+			report(i, nil, true)
+			continue
+		}
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+	if concurrency > 1 {
+		err := c.orderUploads(ctx, playlistId, results)
+		if err != nil {
+			log.Println("can't put jooki playlist back in upload order:", err)
+		}
+	}
+	return results, nil
+}
+
+// orderUploads puts the uploaded tracks back in the order of the files,
+// since concurrent uploads are added to the playlist in the order they
+// finish.  Other tracks on the playlist are left where they are.
+func (c *Client) orderUploads(ctx context.Context, playlistId string, results []*UploadResult) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	uploaded := []string{}
+	seen := map[string]bool{}
+	for _, res := range results {
+		if res.Err != nil || res.Track == nil || res.Track.ID == nil || seen[*res.Track.ID] {
+			continue
+		}
+		seen[*res.Track.ID] = true
+		uploaded = append(uploaded, *res.Track.ID)
+	}
+	state := c.GetState()
+	pl, ok := state.Library.Playlists[playlistId]
+	if !ok {
+		return errors.New("no such playlist")
+	}
+	// fill the slots the uploaded tracks ended up in, in file order
+	tracks := make([]string, len(pl.Tracks))
+	next := 0
+	for i, id := range pl.Tracks {
+		tracks[i] = id
+		if seen[id] && next < len(uploaded) {
+			tracks[i] = uploaded[next]
+			next += 1
+			delete(seen, id)
+		}
+	}
+	if sameTracks(pl.Tracks, tracks) {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second * 10)
+	defer cancel()
+	_, err := c.UpdatePlaylistTracksContext(ctx, playlistId, tracks)
+	return err
+}
+
+func (c *Client) uploadFile(ctx context.Context, playlistId string, res *UploadResult, opts *UploadOptions, progress func(*ProgressUpdate)) {
+	if err := ctx.Err(); err != nil {
+		res.Err = err
+		return
+	}
+	track, err := NewFileTrack(res.Path)
+	if err != nil {
+		res.Err = err
+		return
+	}
+	ch := make(chan ProgressUpdate, 100)
+	done := make(chan bool)
+	go func() {
+		for update := range ch {
+			progress(&update)
+		}
+		close(done)
+	}()
+	*res = *c.UploadTrackContext(ctx, playlistId, track, opts, ch)
+	res.Path = track.Path
+	<-done
+}
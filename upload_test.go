@@ -0,0 +1,150 @@
+package jooki
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	. "gopkg.in/check.v1"
+)
+
+type UploadSuite struct {}
+var _ = Suite(&UploadSuite{})
+
+func (s *UploadSuite) TestReadM3U(c *C) {
+	m3u := "\ufeff#EXTM3U\n#EXTINF:123,Artist - Title\n01 one.mp3\n\n/abs/two.m4a\r\nfile:///abs/three%203.flac\n"
+	files, err := ReadM3U(strings.NewReader(m3u), "/music/list")
+	c.Assert(err, IsNil)
+	c.Check(files, DeepEquals, []string{
+		"/music/list/01 one.mp3",
+		"/abs/two.m4a",
+		"/abs/three 3.flac",
+	})
+}
+
+func (s *UploadSuite) TestLocalPlaylist(c *C) {
+	dir := c.MkDir()
+	for _, fn := range []string{"b.mp3", "a.MP3", "cover.jpg", ".hidden.mp3", "disc2/c.m4a", ".git/d.mp3"} {
+		path := filepath.Join(dir, fn)
+		c.Assert(os.MkdirAll(filepath.Dir(path), 0755), IsNil)
+		c.Assert(ioutil.WriteFile(path, []byte(fn), 0644), IsNil)
+	}
+	files, err := LocalPlaylist(dir)
+	c.Assert(err, IsNil)
+	c.Check(files, DeepEquals, []string{
+		filepath.Join(dir, "a.MP3"),
+		filepath.Join(dir, "b.mp3"),
+		filepath.Join(dir, "disc2", "c.m4a"),
+	})
+	m3u := filepath.Join(dir, "list.m3u8")
+	c.Assert(ioutil.WriteFile(m3u, []byte("disc2/c.m4a\nb.mp3\n"), 0644), IsNil)
+	files, err = LocalPlaylist(m3u)
+	c.Assert(err, IsNil)
+	c.Check(files, DeepEquals, []string{
+		filepath.Join(dir, "disc2", "c.m4a"),
+		filepath.Join(dir, "b.mp3"),
+	})
+}
+
+func (s *UploadSuite) TestFileTrack(c *C) {
+	fn := filepath.Join(c.MkDir(), "song.m4a")
+	c.Assert(ioutil.WriteFile(fn, []byte("hello"), 0644), IsNil)
+	track, err := NewFileTrack(fn)
+	c.Assert(err, IsNil)
+	c.Check(track.MD5(), Equals, "5d41402abc4b2a76b9719d911017c592")
+	c.Check(track.ID(), Equals, "5d41402abc4b2a76")
+	c.Check(track.Size(), Equals, int64(5))
+	c.Check(track.FileName(), Equals, "song.m4a")
+	c.Check(track.ContentType(), Equals, "audio/mp4")
+}
+
+type sizedTrack struct {
+	data []byte
+	size int64
+}
+
+func (t *sizedTrack) ContentType() string { return "audio/mpeg" }
+func (t *sizedTrack) FileName() string { return "dir/track.mp3" }
+func (t *sizedTrack) MD5() string { return "" }
+func (t *sizedTrack) Size() int64 { return t.size }
+
+func (t *sizedTrack) Reader() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(t.data)), nil
+}
+
+func (s *UploadSuite) TestUploadForm(c *C) {
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	for _, track := range []TrackUpload{
+		&sizedTrack{data: data, size: int64(len(data))},
+		&unsizedTrack{sizedTrack{data: data}},
+	} {
+		form, err := newUploadForm(42, track)
+		c.Assert(err, IsNil)
+		var progress []int64
+		body, err := ioutil.ReadAll(NewUploadBody(form, form.length, func(sent, total int64) {
+			c.Check(total, Equals, form.length)
+			progress = append(progress, sent)
+		}))
+		c.Assert(err, IsNil)
+		c.Check(form.Close(), IsNil)
+		c.Check(int64(len(body)), Equals, form.length)
+		c.Check(form.size, Equals, int64(len(data)))
+		c.Check(progress[len(progress) - 1], Equals, form.length)
+		_, params, err := mime.ParseMediaType(form.contentType)
+		c.Assert(err, IsNil)
+		part, err := multipart.NewReader(bytes.NewReader(body), params["boundary"]).NextPart()
+		c.Assert(err, IsNil)
+		c.Check(part.FormName(), Equals, "42")
+		c.Check(part.FileName(), Equals, "track.mp3")
+		partData, err := ioutil.ReadAll(part)
+		c.Assert(err, IsNil)
+		c.Check(bytes.Equal(partData, data), Equals, true)
+	}
+
+	form, err := newUploadForm(42, &sizedTrack{data: data, size: 100})
+	c.Assert(err, IsNil)
+	_, err = ioutil.ReadAll(form)
+	c.Check(err, ErrorMatches, "track is larger than its reported size")
+}
+
+type unsizedTrack struct {
+	sizedTrack
+}
+
+// Size hides sizedTrack.Size, so unsizedTrack isn't a TrackSizer and the
+// upload has to be spooled.
+func (t *unsizedTrack) Size() {}
+
+func (s *UploadSuite) TestProgressBody(c *C) {
+	pb := NewProgressBody()
+	_, err := pb.Write([]byte("0123456789"))
+	c.Assert(err, IsNil)
+	c.Check(pb.Len(), Equals, 10)
+	data, err := ioutil.ReadAll(pb)
+	c.Assert(err, IsNil)
+	c.Check(string(data), Equals, "0123456789")
+	c.Check(pb.UploadProgress(), Equals, 1.0)
+	var last float64
+	for prog := range pb.Progress {
+		last = prog
+	}
+	c.Check(last, Equals, 1.0)
+}
+
+func (s *UploadSuite) TestSyncNotLoaded(c *C) {
+	client := newTestClient()
+	client.stateLocker = &sync.RWMutex{}
+	client.lastState = &JookiState{}
+	progress := make(chan BulkProgress, 1)
+	_, err := client.ApplySyncContext(context.Background(), &SyncPlan{PlaylistID: "pl1"}, &BulkUploadOptions{Progress: progress})
+	c.Check(err, ErrorMatches, "jooki library not loaded")
+	_, ok := <-progress
+	c.Check(ok, Equals, false)
+}